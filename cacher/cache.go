@@ -4,6 +4,7 @@
 package cacher
 
 import (
+	"io"
 	"time"
 
 	"github.com/fresh8/go-cache/engine/common"
@@ -12,64 +13,131 @@ import (
 
 type cacher struct {
 	engine   common.Engine
-	jobQueue chan joque.Job
+	jobQueue *joque.Queue
 }
 
 // Cacher defines the interface for a caching system so it can be customised.
 type Cacher interface {
 	Get(string, time.Time, func() ([]byte, error)) func() ([]byte, error)
+	GetTagged(string, time.Time, []string, func() ([]byte, error)) func() ([]byte, error)
 	Expire(string) error
+	ExpireTag(string) error
+	ExpirePrefix(string, func(int)) (int, error)
+	Close() error
 }
 
 // NewCacher creates a new generic cacher with the given engine.
 func NewCacher(engine common.Engine, maxQueueSize int, maxWorkers int) Cacher {
 	return cacher{
 		engine:   engine,
-		jobQueue: joque.Setup(maxQueueSize, maxWorkers),
+		jobQueue: joque.New(maxQueueSize, maxWorkers),
 	}
 }
 
-func (c cacher) get(key string, expires time.Time, regenerate func() ([]byte, error)) (data []byte, err error) {
-	if c.engine.Exists(key) {
-		data, err = c.engine.Get(key)
+// lookup is the state of a key as read by get. Unless the engine is a Fetcher,
+// isExpired and isLocked query the engine when called.
+type lookup struct {
+	exists    bool
+	data      []byte
+	isExpired func() bool
+	isLocked  func() bool
+}
 
-		// Return, something went wrong
-		if err != nil {
-			return
+// lookup reads the key, in a single round trip if the engine is a Fetcher
+func (c cacher) lookup(key string) (l lookup, err error) {
+	if fetcher, ok := c.engine.(common.Fetcher); ok {
+		entry, err := fetcher.Fetch(key)
+		if err != nil && err != common.ErrNonExistentKey {
+			return l, err
 		}
 
+		l.exists = err == nil
+		l.data = entry.Data
+		l.isExpired = func() bool {
+			return !entry.Expires.IsZero() && time.Now().After(entry.Expires)
+		}
+		l.isLocked = func() bool {
+			return entry.Locked
+		}
+
+		return l, nil
+	}
+
+	l.isExpired = func() bool {
+		return c.engine.IsExpired(key)
+	}
+	l.isLocked = func() bool {
+		return c.engine.IsLocked(key)
+	}
+
+	if c.engine.Exists(key) {
+		l.exists = true
+		l.data, err = c.engine.Get(key)
+	}
+
+	return l, err
+}
+
+func (c cacher) get(key string, expires time.Time, tags []string, regenerate func() ([]byte, error)) (data []byte, err error) {
+	// Return, the data couldn't be stored with its tags once regenerated
+	if _, ok := c.engine.(common.Tagger); len(tags) > 0 && !ok {
+		return nil, common.ErrNotSupported
+	}
+
+	l, err := c.lookup(key)
+
+	// Return, something went wrong
+	if err != nil {
+		return l.data, err
+	}
+
+	if l.exists {
+		data = l.data
+
 		// Return, data is fresh enough
-		if !c.engine.IsExpired(key) {
+		if !l.isExpired() {
 			return
 		}
 
 		// Return, as data is being regenerated by another process
-		if c.engine.IsLocked(key) {
+		if l.isLocked() {
 			return
 		}
 
-		// Send the regenerate function to the job queue to be processed
-		c.jobQueue <- func() {
+		// Send the regenerate function to the job queue to be processed, once
+		// the cacher is closed the stale data is returned as is
+		c.jobQueue.Push(func() {
 			// TODO handle errors within this function
-			c.engine.Lock(key)
+			// Skip, as the key is being regenerated by another process. The
+			// lock isn't released, as it isn't held by this one.
+			if c.engine.Lock(key) != nil {
+				return
+			}
 			defer c.engine.Unlock(key)
 
 			regeneratedData, regenerateError := regenerate()
 			if regenerateError == nil {
-				c.engine.Put(key, regeneratedData, expires)
+				c.put(key, regeneratedData, expires, tags)
 			}
-		}
+		})
 
 		return
 	}
 
 	// Return, as data is being regenerated by another process
-	if c.engine.IsLocked(key) {
+	if l.isLocked() {
 		return nil, common.ErrEngineLocked
 	}
 
-	// Lock on initial generation so that things
-	c.engine.Lock(key)
+	// Lock on initial generation so that things. Return if the lock was taken
+	// by another process in the meantime, as only the holder may release it.
+	err = c.engine.Lock(key)
+	if err == common.ErrKeyAlreadyLocked {
+		return nil, common.ErrEngineLocked
+	}
+	if err != nil {
+		return nil, err
+	}
 	defer c.engine.Unlock(key)
 
 	// If the key doesn't exist, generate it now and return
@@ -78,19 +146,38 @@ func (c cacher) get(key string, expires time.Time, regenerate func() ([]byte, er
 		return
 	}
 
-	err = c.engine.Put(key, data, expires)
+	err = c.put(key, data, expires, tags)
 
 	return
 }
 
+func (c cacher) put(key string, data []byte, expires time.Time, tags []string) error {
+	if len(tags) == 0 {
+		return c.engine.Put(key, data, expires)
+	}
+
+	tagger, ok := c.engine.(common.Tagger)
+	if !ok {
+		return common.ErrNotSupported
+	}
+
+	return tagger.PutTagged(key, data, expires, tags)
+}
+
 func (c cacher) Get(key string, expires time.Time, regenerate func() ([]byte, error)) func() ([]byte, error) {
+	return c.GetTagged(key, expires, nil, regenerate)
+}
+
+// GetTagged behaves like Get, associating the key with the given tags whenever
+// it is (re)generated
+func (c cacher) GetTagged(key string, expires time.Time, tags []string, regenerate func() ([]byte, error)) func() ([]byte, error) {
 	var data []byte
 	var err error
 
 	ch := make(chan struct{}, 1)
 	go func() {
 		defer close(ch)
-		data, err = c.get(key, expires, regenerate)
+		data, err = c.get(key, expires, tags, regenerate)
 	}()
 
 	return func() ([]byte, error) {
@@ -103,3 +190,37 @@ func (c cacher) Get(key string, expires time.Time, regenerate func() ([]byte, er
 func (c cacher) Expire(key string) error {
 	return c.engine.Expire(key)
 }
+
+// ExpireTag expires every key carrying the given tag within the cache engine
+func (c cacher) ExpireTag(tag string) error {
+	tagger, ok := c.engine.(common.Tagger)
+	if !ok {
+		return common.ErrNotSupported
+	}
+
+	return tagger.ExpireTag(tag)
+}
+
+// ExpirePrefix expires every key starting with the prefix within the cache
+// engine. As this may take a while on large keyspaces, progress (if not nil)
+// is called with the running total of expired keys.
+func (c cacher) ExpirePrefix(prefix string, progress func(int)) (int, error) {
+	deleter, ok := c.engine.(common.PrefixDeleter)
+	if !ok {
+		return 0, common.ErrNotSupported
+	}
+
+	return deleter.DeletePrefix(prefix, progress)
+}
+
+// Close stops the regeneration workers once the queued jobs are done, and
+// closes the cache engine if it can be closed
+func (c cacher) Close() error {
+	c.jobQueue.Close()
+
+	if closer, ok := c.engine.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
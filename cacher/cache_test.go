@@ -14,7 +14,7 @@ import (
 
 func TestCacherGet(t *testing.T) {
 	var (
-		e       = engine.NewMemoryStore(time.Second * 60)
+		e       = engine.NewMemoryStore(time.Second*60, time.Hour)
 		cache   = NewCacher(e, 5, 5)
 		content = []byte("hello")
 
@@ -411,3 +411,229 @@ func TestCacherPersistsOnRegenerateError(t *testing.T) {
 		t.Fatalf("data expected to be different, %s expected, %s given", content, data)
 	}
 }
+
+// Test that tagged keys are invalidated together, and that engines without
+// tag support report it
+func TestCacherGetTagged(t *testing.T) {
+	var (
+		e          = engine.NewMemoryStore(time.Second*60, time.Hour)
+		cache      = NewCacher(e, 5, 5)
+		content    = []byte("hello")
+		countChan  = make(chan int, 10)
+		regenerate = func() ([]byte, error) {
+			countChan <- 1
+			return content, nil
+		}
+	)
+
+	_, err := cache.GetTagged("page-1", time.Now().Add(1*time.Minute), []string{"product:1"}, regenerate)()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	_, err = cache.GetTagged("page-2", time.Now().Add(1*time.Minute), []string{"product:1"}, regenerate)()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(countChan) != 2 {
+		t.Fatalf("regenerate function run count should be 2, %d given", len(countChan))
+	}
+
+	err = cache.ExpireTag("product:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if e.Exists("page-1") || e.Exists("page-2") {
+		t.Fatal("tagged keys should have been expired")
+	}
+
+	eng := &common.EngineMock{
+		ExistsFunc:   func(key string) bool { return false },
+		IsLockedFunc: func(key string) bool { return false },
+		LockFunc:     func(key string) error { return nil },
+		UnlockFunc:   func(key string) error { return nil },
+	}
+	cache = NewCacher(eng, 5, 5)
+
+	_, err = cache.GetTagged("page-1", time.Now().Add(1*time.Minute), []string{"product:1"}, regenerate)()
+	if err != common.ErrNotSupported {
+		t.Fatalf("not supported error expected, %s given", err)
+	}
+
+	if len(countChan) != 2 {
+		t.Fatalf("data which can't be tagged shouldn't be regenerated, %d runs given", len(countChan))
+	}
+
+	err = cache.ExpireTag("product:1")
+	if err != common.ErrNotSupported {
+		t.Fatalf("not supported error expected, %s given", err)
+	}
+}
+
+func TestCacherExpirePrefix(t *testing.T) {
+	var (
+		e       = engine.NewMemoryStore(time.Second*60, time.Hour)
+		cache   = NewCacher(e, 5, 5)
+		content = []byte("hello")
+		expires = time.Now().Add(1 * time.Minute)
+	)
+
+	e.Put("search:shoes", content, expires)
+	e.Put("search:hats", content, expires)
+	e.Put("product:1", content, expires)
+
+	progress := 0
+	expired, err := cache.ExpirePrefix("search:", func(n int) {
+		progress = n
+	})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if expired != 2 || progress != 2 {
+		t.Fatalf("2 keys should have been expired, %d given with progress %d", expired, progress)
+	}
+
+	if !e.Exists("product:1") {
+		t.Fatal("keys outside the prefix should still exist")
+	}
+
+	cache = NewCacher(&common.EngineMock{}, 5, 5)
+
+	_, err = cache.ExpirePrefix("search:", nil)
+	if err != common.ErrNotSupported {
+		t.Fatalf("not supported error expected, %s given", err)
+	}
+}
+
+// closingEngine records whether the cacher closed it
+type closingEngine struct {
+	*common.EngineMock
+	closed bool
+}
+
+func (e *closingEngine) Close() error {
+	e.closed = true
+	return nil
+}
+
+func TestCacherClose(t *testing.T) {
+	e := &closingEngine{EngineMock: &common.EngineMock{}}
+	cache := NewCacher(e, 5, 5)
+
+	err := cache.Close()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !e.closed {
+		t.Fatal("engine should have been closed")
+	}
+
+	// Engines which can't be closed are left alone
+	cache = NewCacher(&common.EngineMock{}, 5, 5)
+
+	err = cache.Close()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+}
+
+// fetchingEngine serves lookups from Fetch, any other read panics
+type fetchingEngine struct {
+	*common.EngineMock
+	entry common.Entry
+}
+
+func (e *fetchingEngine) Fetch(key string) (common.Entry, error) {
+	if e.entry.Data == nil {
+		return e.entry, common.ErrNonExistentKey
+	}
+
+	return e.entry, nil
+}
+
+func TestCacherGetFetcher(t *testing.T) {
+	content := []byte("hello")
+	e := &fetchingEngine{
+		EngineMock: &common.EngineMock{},
+		entry:      common.Entry{Key: "existing", Data: content, Expires: time.Now().Add(time.Minute)},
+	}
+	cache := NewCacher(e, 5, 5)
+
+	data, err := cache.Get("existing", time.Now().Add(1*time.Minute), func() ([]byte, error) {
+		t.Fatal("fresh data should not be regenerated")
+		return nil, nil
+	})()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(data, content) != 0 {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+
+	e.entry = common.Entry{Key: "existing", Locked: true}
+
+	_, err = cache.Get("existing", time.Now().Add(1*time.Minute), func() ([]byte, error) {
+		t.Fatal("data being regenerated elsewhere should not be regenerated")
+		return nil, nil
+	})()
+	if err != common.ErrEngineLocked {
+		t.Fatalf("engine locked error expected, %v given", err)
+	}
+}
+
+func TestCacherLockFailure(t *testing.T) {
+	var (
+		exists      = false
+		content     = []byte("content")
+		unlockCalls = 0
+	)
+
+	eng := &common.EngineMock{
+		ExistsFunc:    func(key string) bool { return exists },
+		GetFunc:       func(key string) ([]byte, error) { return content, nil },
+		IsExpiredFunc: func(key string) bool { return true },
+		// Another process takes the lock between the check and the attempt
+		IsLockedFunc: func(key string) bool { return false },
+		LockFunc:     func(key string) error { return common.ErrKeyAlreadyLocked },
+		UnlockFunc: func(key string) error {
+			unlockCalls++
+			return nil
+		},
+	}
+
+	cache := NewCacher(eng, 5, 5)
+
+	regenerate := func() ([]byte, error) {
+		t.Fatal("data should not be regenerated without the lock")
+		return nil, nil
+	}
+
+	_, err := cache.Get("key", time.Now().Add(time.Minute), regenerate)()
+	if err != common.ErrEngineLocked {
+		t.Fatalf("engine locked error expected, %v given", err)
+	}
+
+	// Stale data is returned as is
+	exists = true
+
+	data, err := cache.Get("key", time.Now().Add(time.Minute), regenerate)()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(data, content) != 0 {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+
+	// Wait for the regeneration job
+	cache.Close()
+
+	if unlockCalls != 0 {
+		t.Fatalf("the lock of another process should not be released, %d unlocks given", unlockCalls)
+	}
+}
@@ -11,22 +11,50 @@ import "time"
 //
 //         // make and configure a mocked Cacher
 //         mockedCacher := &CacherMock{
+//             CloseFunc: func() error {
+// 	               panic("TODO: mock out the Close function")
+//             },
 //             ExpireFunc: func(in1 string) error {
 // 	               panic("TODO: mock out the Expire function")
 //             },
+//             ExpirePrefixFunc: func(in1 string, in2 func(int)) (int, error) {
+// 	               panic("TODO: mock out the ExpirePrefix function")
+//             },
+//             ExpireTagFunc: func(in1 string) error {
+// 	               panic("TODO: mock out the ExpireTag function")
+//             },
 //             GetFunc: func(in1 string, in2 time.Time, in3 func() ([]byte, error)) func() ([]byte, error) {
 // 	               panic("TODO: mock out the Get function")
 //             },
+//             GetTaggedFunc: func(in1 string, in2 time.Time, in3 []string, in4 func() ([]byte, error)) func() ([]byte, error) {
+// 	               panic("TODO: mock out the GetTagged function")
+//             },
 //         }
 //
 //         // TODO: use mockedCacher in code that requires Cacher
 //
 //     }
 type CacherMock struct {
+	// CloseFunc mocks the Close function.
+	CloseFunc func() error
 	// ExpireFunc mocks the Expire function.
 	ExpireFunc func(in1 string) error
+	// ExpirePrefixFunc mocks the ExpirePrefix function.
+	ExpirePrefixFunc func(in1 string, in2 func(int)) (int, error)
+	// ExpireTagFunc mocks the ExpireTag function.
+	ExpireTagFunc func(in1 string) error
 	// GetFunc mocks the Get function.
 	GetFunc func(in1 string, in2 time.Time, in3 func() ([]byte, error)) func() ([]byte, error)
+	// GetTaggedFunc mocks the GetTagged function.
+	GetTaggedFunc func(in1 string, in2 time.Time, in3 []string, in4 func() ([]byte, error)) func() ([]byte, error)
+}
+
+// Close calls CloseFunc.
+func (mock *CacherMock) Close() error {
+	if mock.CloseFunc == nil {
+		panic("moq: CacherMock.CloseFunc is nil but was just called")
+	}
+	return mock.CloseFunc()
 }
 
 // Expire calls ExpireFunc.
@@ -37,6 +65,22 @@ func (mock *CacherMock) Expire(in1 string) error {
 	return mock.ExpireFunc(in1)
 }
 
+// ExpirePrefix calls ExpirePrefixFunc.
+func (mock *CacherMock) ExpirePrefix(in1 string, in2 func(int)) (int, error) {
+	if mock.ExpirePrefixFunc == nil {
+		panic("moq: CacherMock.ExpirePrefixFunc is nil but was just called")
+	}
+	return mock.ExpirePrefixFunc(in1, in2)
+}
+
+// ExpireTag calls ExpireTagFunc.
+func (mock *CacherMock) ExpireTag(in1 string) error {
+	if mock.ExpireTagFunc == nil {
+		panic("moq: CacherMock.ExpireTagFunc is nil but was just called")
+	}
+	return mock.ExpireTagFunc(in1)
+}
+
 // Get calls GetFunc.
 func (mock *CacherMock) Get(in1 string, in2 time.Time, in3 func() ([]byte, error)) func() ([]byte, error) {
 	if mock.GetFunc == nil {
@@ -44,3 +88,11 @@ func (mock *CacherMock) Get(in1 string, in2 time.Time, in3 func() ([]byte, error
 	}
 	return mock.GetFunc(in1, in2, in3)
 }
+
+// GetTagged calls GetTaggedFunc.
+func (mock *CacherMock) GetTagged(in1 string, in2 time.Time, in3 []string, in4 func() ([]byte, error)) func() ([]byte, error) {
+	if mock.GetTaggedFunc == nil {
+		panic("moq: CacherMock.GetTaggedFunc is nil but was just called")
+	}
+	return mock.GetTaggedFunc(in1, in2, in3, in4)
+}
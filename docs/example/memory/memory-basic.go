@@ -11,7 +11,7 @@ import (
 )
 
 func main() {
-	memoryEngine := engine.NewMemoryStore(15 * time.Second)
+	memoryEngine := engine.NewMemoryStore(15*time.Second, 15*time.Second)
 
 	cacher := cacher.NewCacher(memoryEngine, 10, 10)
 
@@ -1,18 +1,46 @@
 package aerospike
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	as "github.com/aerospike/aerospike-client-go"
+	"github.com/aerospike/aerospike-client-go/types"
 	"github.com/fresh8/go-cache/engine/common"
 )
 
 type cl interface {
 	Put(policy *as.WritePolicy, key *as.Key, binMap as.BinMap) error
 	Get(policy *as.BasePolicy, key *as.Key, binNames ...string) (*as.Record, error)
+	BatchGet(policy *as.BatchPolicy, keys []*as.Key, binNames ...string) ([]*as.Record, error)
 	Delete(policy *as.WritePolicy, key *as.Key) (bool, error)
+	Operate(policy *as.WritePolicy, key *as.Key, operations ...*as.Operation) (*as.Record, error)
+	ScanAll(policy *as.ScanPolicy, namespace string, setName string, binNames ...string) (*as.Recordset, error)
 }
 
+// scanRecordset is a scan in progress, as returned by ScanAll
+type scanRecordset interface {
+	Results() <-chan *as.Result
+	Close() error
+}
+
+const (
+	tagPrefix  = "tag:"
+	lockPrefix = "lock:"
+)
+
+// generationBin holds the generation of tag records
+const generationBin = "generation"
+
+// progressInterval is the number of deleted keys between progress reports
+const progressInterval = 1000
+
 // Engine is the default Redis storage engine
 type Engine struct {
 	namespace string
@@ -20,55 +48,188 @@ type Engine struct {
 	client    cl
 
 	cleanupTimeout time.Duration
+	bins           BinNames
+	readPolicy     *as.BasePolicy
+	batchPolicy    *as.BatchPolicy
+	writePolicy    *as.WritePolicy
+
+	// scanAll starts a scan of the set with the client, and is replaced by
+	// tests as recordsets can't be made outside the client
+	scanAll func(policy *as.ScanPolicy, binNames ...string) (scanRecordset, error)
+
+	// Open scans by cursor, as Aerospike scans stream records rather than
+	// being resumable. Scans not resumed within scanTimeout are closed.
+	scansLock   sync.Mutex
+	scans       map[string]*openScan
+	scanID      int
+	scanTimeout time.Duration
+
+	// Tokens of the locks held by this engine, so that only the holder of a
+	// lock can release it
+	tokensLock sync.Mutex
+	tokens     map[string]string
+}
+
+// openScan is a scan waiting for its next page to be read
+type openScan struct {
+	recordset scanRecordset
+	timer     *time.Timer
+}
+
+// defaultScanTimeout is the scan timeout unless configured
+const defaultScanTimeout = time.Minute
+
+// Option configures optional behaviour of the Aerospike engine
+type Option func(*Engine)
+
+// ScanTimeout sets how long a scan is kept open for its next page to be read,
+// after which it is closed and its cursor becomes invalid. It is a minute by
+// default.
+func ScanTimeout(timeout time.Duration) Option {
+	return func(e *Engine) {
+		e.scanTimeout = timeout
+	}
+}
+
+// BinNames are the names of the bins holding each part of an entry. Empty
+// names keep their default.
+type BinNames struct {
+	// Data holds the data of entries, "data" by default
+	Data string
+	// Expires holds the expiry time of entries in Unix seconds, "expires" by
+	// default
+	Expires string
+	// Tags holds the tag generations of entries, "tags" by default
+	Tags string
+	// Lock holds the token of lock records, "token" by default
+	Lock string
+}
+
+// defaultBinNames are the bin names used unless configured otherwise
+var defaultBinNames = BinNames{
+	Data:    "data",
+	Expires: "expires",
+	Tags:    "tags",
+	Lock:    "token",
+}
+
+// Bins sets the names of the bins entries are stored in, such as to read
+// records written by another application
+func Bins(names BinNames) Option {
+	return func(e *Engine) {
+		if names.Data != "" {
+			e.bins.Data = names.Data
+		}
+		if names.Expires != "" {
+			e.bins.Expires = names.Expires
+		}
+		if names.Tags != "" {
+			e.bins.Tags = names.Tags
+		}
+		if names.Lock != "" {
+			e.bins.Lock = names.Lock
+		}
+	}
+}
+
+// ReadPolicy sets the policy of every read, such as its timeout, retries and
+// which replica is read
+func ReadPolicy(policy *as.BasePolicy) Option {
+	return func(e *Engine) {
+		e.readPolicy = policy
+	}
+}
+
+// WritePolicy sets the policy every write and delete is based on, such as its
+// timeout and commit level. The generation, expiration and record exists
+// action are set by the engine for each write.
+func WritePolicy(policy *as.WritePolicy) Option {
+	return func(e *Engine) {
+		e.writePolicy = policy
+	}
+}
+
+// BatchPolicy sets the policy of batch reads, made by Fetch and GetMulti
+func BatchPolicy(policy *as.BatchPolicy) Option {
+	return func(e *Engine) {
+		e.batchPolicy = policy
+	}
 }
 
 // NewAerospikeStore creates a new standard Aerospike-backed store
-func NewAerospikeStore(namespace, set string, client cl, cleanupTimeout time.Duration) *Engine {
-	return &Engine{
+func NewAerospikeStore(namespace, set string, client cl, cleanupTimeout time.Duration, opts ...Option) *Engine {
+	e := &Engine{
 		namespace:      namespace,
 		set:            set,
 		client:         client,
 		cleanupTimeout: cleanupTimeout,
+		bins:           defaultBinNames,
+		scans:          make(map[string]*openScan),
+		scanTimeout:    defaultScanTimeout,
+		tokens:         make(map[string]string),
+	}
+
+	e.scanAll = func(policy *as.ScanPolicy, binNames ...string) (scanRecordset, error) {
+		recordset, err := client.ScanAll(policy, namespace, set, binNames...)
+		if err != nil {
+			return nil, err
+		}
+
+		return recordset, nil
+	}
+
+	for _, opt := range opts {
+		opt(e)
 	}
+
+	return e
 }
 
-func getRecord(e *Engine, key string) (*as.Record, error) {
+// getRecord reads the given bins of a record, which is nil if it doesn't exist
+func getRecord(e *Engine, key string, binNames ...string) (*as.Record, error) {
 	asKey, err := as.NewKey(e.namespace, e.set, key)
 	if err != nil {
 		return nil, err
 	}
 
-	return e.client.Get(nil, asKey)
+	return e.client.Get(e.readPolicy, asKey, binNames...)
 }
 
 // Exists checks to see if a key exists in the store
 func (e *Engine) Exists(key string) bool {
-	record, err := getRecord(e, key)
+	record, err := getRecord(e, key, e.bins.Tags)
 	if err != nil {
 		// TODO: Handle this error properly
 		return false
 	}
 
-	if record == nil {
+	valid, _, err := e.validRecords([]*as.Record{record})
+	if err != nil {
+		// TODO: Handle this error properly
 		return false
 	}
 
-	return true
+	return valid[0]
 }
 
 // Get retrieves data from the store based on key, if it exists, else it returns an error
 func (e *Engine) Get(key string) (data []byte, err error) {
-	record, err := getRecord(e, key)
+	record, err := getRecord(e, key, e.bins.Data, e.bins.Tags)
 	if err != nil {
 		return
 	}
 
-	if record == nil {
+	valid, _, err := e.validRecords([]*as.Record{record})
+	if err != nil {
+		return
+	}
+
+	if !valid[0] {
 		err = common.ErrNonExistentKey
 		return
 	}
 
-	data, ok := record.Bins["data"].([]byte)
+	data, ok := record.Bins[e.bins.Data].([]byte)
 	if !ok {
 		err = common.ErrInvalidData
 		return
@@ -77,19 +238,113 @@ func (e *Engine) Get(key string) (data []byte, err error) {
 	return
 }
 
+// Fetch retrieves the data of a key along with its expiry time and lock state,
+// reading the record and its lock in a single batch. If the key doesn't exist
+// common.ErrNonExistentKey is returned, along with the lock state.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	entry := common.Entry{Key: key}
+
+	keys, err := e.newKeys([]string{key, lockPrefix + key})
+	if err != nil {
+		return entry, err
+	}
+
+	records, err := e.client.BatchGet(e.batchPolicy, keys, e.bins.Data, e.bins.Expires, e.bins.Tags, e.bins.Lock)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Locked = records[1] != nil
+
+	valid, _, err := e.validRecords(records[:1])
+	if err != nil {
+		return entry, err
+	}
+
+	if !valid[0] {
+		return entry, common.ErrNonExistentKey
+	}
+
+	record := records[0]
+
+	data, ok := record.Bins[e.bins.Data].([]byte)
+	if !ok {
+		return entry, common.ErrInvalidData
+	}
+	entry.Data = data
+
+	if expires, ok := int64Bin(record.Bins[e.bins.Expires]); ok {
+		entry.Expires = time.Unix(expires, 0)
+	}
+
+	return entry, nil
+}
+
+// GetMulti retrieves the data of many keys in a single batch, leaving out
+// keys that don't exist. The generations of the tags of every key are read in
+// a second batch.
+func (e *Engine) GetMulti(keys []string) (map[string][]byte, error) {
+	asKeys, err := e.newKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := e.client.BatchGet(e.batchPolicy, asKeys, e.bins.Data, e.bins.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	valid, _, err := e.validRecords(records)
+	if err != nil {
+		return nil, err
+	}
+
+	found := make(map[string][]byte, len(keys))
+	for i, record := range records {
+		if !valid[i] {
+			continue
+		}
+
+		if data, ok := record.Bins[e.bins.Data].([]byte); ok {
+			found[keys[i]] = data
+		}
+	}
+
+	return found, nil
+}
+
 // Put stores data against a key, else it returns an error
 func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	return e.PutTagged(key, data, expires, nil)
+}
+
+// PutTagged stores data against a key, recording the current generation of
+// each tag in the record. Bumping a tag generation with ExpireTag invalidates
+// every key stored against an older generation.
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
 	asKey, err := as.NewKey(e.namespace, e.set, key)
 	if err != nil {
 		return err
 	}
 
-	writePolicy := as.NewWritePolicy(0, uint32(e.cleanupTimeout.Seconds()))
+	current, err := e.tagGenerations(tags)
+	if err != nil {
+		return err
+	}
+
+	var generations []string
+	for _, tag := range tags {
+		generations = append(generations, fmt.Sprintf("%d %s", current[tag], tag))
+	}
+
+	writePolicy := e.newWritePolicy(0, uint32(e.cleanupTimeout.Seconds()))
+	// Store the key itself, not just its digest, so it can be matched on scans
+	writePolicy.SendKey = true
 
 	bins := as.BinMap{
-		"expires": expires.Unix(),
-		"locked":  0,
-		"data":    data,
+		e.bins.Expires: expires.Unix(),
+		e.bins.Data:    data,
+		e.bins.Tags:    strings.Join(generations, "\n"),
 	}
 
 	return e.client.Put(writePolicy, asKey, bins)
@@ -97,7 +352,7 @@ func (e *Engine) Put(key string, data []byte, expires time.Time) error {
 
 // IsExpired checks to see if the key has expired
 func (e *Engine) IsExpired(key string) bool {
-	record, err := getRecord(e, key)
+	record, err := getRecord(e, key, e.bins.Expires)
 	if err != nil {
 		// TODO: Handle this error properly
 		return true
@@ -107,52 +362,585 @@ func (e *Engine) IsExpired(key string) bool {
 		return true
 	}
 
-	expires, ok := record.Bins["expires"].(int)
+	expires, ok := int64Bin(record.Bins[e.bins.Expires])
 	if !ok {
 		// TODO: Handle this error properly
 		return false
 	}
 
-	return time.Now().Unix() > int64(expires)
+	return time.Now().Unix() > expires
 }
 
-// Expire marks the key as expired, and removes it from the storage engine
+// Expire marks the key as expired, and removes it and its lock from the
+// storage engine
 func (e *Engine) Expire(key string) error {
-	asKey, err := as.NewKey(e.namespace, e.set, key)
+	for _, k := range []string{key, lockPrefix + key} {
+		asKey, err := as.NewKey(e.namespace, e.set, k)
+		if err != nil {
+			return err
+		}
+
+		_, err = e.client.Delete(e.newWritePolicy(0, 0), asKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ExpireTag invalidates every key carrying the given tag by bumping its generation
+func (e *Engine) ExpireTag(tag string) error {
+	asKey, err := as.NewKey(e.namespace, e.set, tagPrefix+tag)
 	if err != nil {
 		return err
 	}
 
-	_, err = e.client.Delete(nil, asKey)
+	// Tag records never expire, so old generations can't become valid again
+	_, err = e.client.Operate(
+		e.newWritePolicy(0, math.MaxUint32),
+		asKey,
+		as.AddOp(as.NewBin(generationBin, 1)),
+	)
+
 	return err
 }
 
-// IsLocked checks to see if the key has been locked
-func (e *Engine) IsLocked(key string) bool {
-	record, err := getRecord(e, key)
+// DeletePrefix removes every key starting with the prefix from the storage engine
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.deleteWhere(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}, progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the storage engine
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	return e.deleteWhere(func(key string) bool {
+		return common.MatchGlob(pattern, key)
+	}, progress)
+}
+
+// deleteWhere scans the set and removes records whose key matches. Only
+// records written with their key stored (see Put) can be matched.
+func (e *Engine) deleteWhere(match func(string) bool, progress func(int)) (int, error) {
+	scanPolicy := as.NewScanPolicy()
+	scanPolicy.IncludeBinData = false
+
+	recordset, err := e.scanAll(scanPolicy)
 	if err != nil {
-		// TODO: Handle this error properly
-		return false
+		return 0, err
 	}
+	defer recordset.Close()
 
-	if record == nil {
-		return false
+	deleted := 0
+	for result := range recordset.Results() {
+		if result.Err != nil {
+			return deleted, result.Err
+		}
+
+		if result.Record.Key.Value() == nil {
+			continue
+		}
+
+		key, ok := result.Record.Key.Value().GetObject().(string)
+		if !ok || isCompanionKey(key) || !match(key) {
+			continue
+		}
+
+		_, err = e.client.Delete(e.newWritePolicy(0, 0), result.Record.Key)
+		if err != nil {
+			return deleted, err
+		}
+
+		deleted++
+		if progress != nil && deleted%progressInterval == 0 {
+			progress(deleted)
+		}
+	}
+
+	if progress != nil && deleted%progressInterval != 0 {
+		progress(deleted)
+	}
+
+	return deleted, nil
+}
+
+// Scan returns up to count keys starting with prefix. Only records written
+// with their key stored (see Put) are returned. The cursor identifies a scan
+// held open by the engine, which is closed if its next page isn't read within
+// the scan timeout, returning common.ErrInvalidCursor for the cursor.
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	records, next, err := e.scan(cursor, prefix, count, false)
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]string, 0, len(records))
+	for _, record := range records {
+		keys = append(keys, record.Key.Value().GetObject().(string))
+	}
+
+	return keys, next, nil
+}
+
+// ScanEntries returns up to count entries whose key starts with prefix. See
+// Scan for details of the cursor. The locks and tag generations of a page of
+// entries are read in a single batch.
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
+	records, next, err := e.scan(cursor, prefix, count, true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	lockKeys := make([]string, len(records))
+	for i, record := range records {
+		lockKeys[i] = lockPrefix + record.Key.Value().GetObject().(string)
+	}
+
+	valid, locks, err := e.validRecords(records, lockKeys...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	entries := make([]common.Entry, 0, len(records))
+	for i, record := range records {
+		if !valid[i] {
+			continue
+		}
+
+		entry := common.Entry{
+			Key: record.Key.Value().GetObject().(string),
+		}
+		entry.Data, _ = record.Bins[e.bins.Data].([]byte)
+
+		if expires, ok := int64Bin(record.Bins[e.bins.Expires]); ok {
+			entry.Expires = time.Unix(expires, 0)
+		}
+
+		entry.Locked = locks[i] != nil
+
+		entries = append(entries, entry)
+	}
+
+	return entries, next, nil
+}
+
+// scan reads the next page of matching records from the scan identified by
+// the cursor, starting a new scan if the cursor is empty
+func (e *Engine) scan(cursor string, prefix string, count int, withBins bool) ([]*as.Record, string, error) {
+	var recordset scanRecordset
+
+	e.scansLock.Lock()
+	open, ok := e.scans[cursor]
+	if ok {
+		open.timer.Stop()
+		recordset = open.recordset
+		delete(e.scans, cursor)
 	}
+	e.scansLock.Unlock()
 
-	locked, ok := record.Bins["locked"].(int64)
 	if !ok {
+		if cursor != "" {
+			return nil, "", common.ErrInvalidCursor
+		}
+
+		scanPolicy := as.NewScanPolicy()
+		scanPolicy.IncludeBinData = withBins
+
+		var err error
+		recordset, err = e.scanAll(scanPolicy, e.bins.Data, e.bins.Expires, e.bins.Tags)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	var records []*as.Record
+	for count <= 0 || len(records) < count {
+		result, ok := <-recordset.Results()
+		if !ok {
+			// The scan is complete
+			recordset.Close()
+			return records, "", nil
+		}
+
+		if result.Err != nil {
+			recordset.Close()
+			return nil, "", result.Err
+		}
+
+		if result.Record.Key.Value() == nil {
+			continue
+		}
+
+		key, ok := result.Record.Key.Value().GetObject().(string)
+		if ok && !isCompanionKey(key) && strings.HasPrefix(key, prefix) {
+			records = append(records, result.Record)
+		}
+	}
+
+	e.scansLock.Lock()
+	e.scanID++
+	next := strconv.Itoa(e.scanID)
+	e.scans[next] = &openScan{
+		recordset: recordset,
+		timer: time.AfterFunc(e.scanTimeout, func() {
+			e.closeScan(next)
+		}),
+	}
+	e.scansLock.Unlock()
+
+	return records, next, nil
+}
+
+// closeScan closes the open scan of a cursor, unless it has been resumed
+func (e *Engine) closeScan(cursor string) {
+	e.scansLock.Lock()
+	open, ok := e.scans[cursor]
+	delete(e.scans, cursor)
+	e.scansLock.Unlock()
+
+	if ok {
+		open.recordset.Close()
+	}
+}
+
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	record, err := getRecord(e, lockPrefix+key, e.bins.Lock)
+	if err != nil {
 		// TODO: Handle this error properly
+		return false
 	}
 
-	return locked == 1
+	return record != nil
 }
 
-// Lock sets a lock against the given key
+// Lock sets a lock against the given key, if it is already locked it returns
+// common.ErrKeyAlreadyLocked. The lock is a record of its own, created only if
+// it doesn't exist, which expires after the cleanup timeout so that a lock
+// abandoned by a crashed process is eventually released.
 func (e *Engine) Lock(key string) error {
+	asKey, err := as.NewKey(e.namespace, e.set, lockPrefix+key)
+	if err != nil {
+		return err
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	writePolicy := e.newWritePolicy(0, e.lockTTL())
+	writePolicy.RecordExistsAction = as.CREATE_ONLY
+	writePolicy.SendKey = true
+
+	err = e.client.Put(writePolicy, asKey, as.BinMap{e.bins.Lock: token})
+	if resultCode(err) == types.KEY_EXISTS_ERROR {
+		return common.ErrKeyAlreadyLocked
+	}
+	if err != nil {
+		return err
+	}
+
+	e.tokensLock.Lock()
+	e.tokens[key] = token
+	e.tokensLock.Unlock()
+
 	return nil
 }
 
-// Unlock removes the lock from a given key, if it doesn't exist it returns an error
+// Unlock removes the lock from a given key. If this engine doesn't hold the
+// lock it returns common.ErrNonExistentKey, and if the lock expired or was
+// taken by another process since it returns common.ErrLockNotHeld.
 func (e *Engine) Unlock(key string) error {
+	e.tokensLock.Lock()
+	token, ok := e.tokens[key]
+	delete(e.tokens, key)
+	e.tokensLock.Unlock()
+
+	if !ok {
+		return common.ErrNonExistentKey
+	}
+
+	asKey, err := as.NewKey(e.namespace, e.set, lockPrefix+key)
+	if err != nil {
+		return err
+	}
+
+	record, err := e.client.Get(e.readPolicy, asKey, e.bins.Lock)
+	if err != nil {
+		return err
+	}
+
+	if record == nil || record.Bins[e.bins.Lock] != token {
+		return common.ErrLockNotHeld
+	}
+
+	// Only delete the lock record read above, in case it expired and was
+	// taken by another process in the meantime
+	writePolicy := e.newWritePolicy(record.Generation, 0)
+	writePolicy.GenerationPolicy = as.EXPECT_GEN_EQUAL
+
+	removed, err := e.client.Delete(writePolicy, asKey)
+	if resultCode(err) == types.GENERATION_ERROR {
+		return common.ErrLockNotHeld
+	}
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return common.ErrLockNotHeld
+	}
+
+	return nil
+}
+
+// lockTTL returns the cleanup timeout in whole seconds, as used for the lease
+// of locks
+func (e *Engine) lockTTL() uint32 {
+	ttl := uint32(e.cleanupTimeout / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	return ttl
+}
+
+// tagGenerations reads the current generation of each tag in a single batch.
+// Tags which have never been expired are at generation 0.
+func (e *Engine) tagGenerations(tags []string) (map[string]int64, error) {
+	generations := make(map[string]int64, len(tags))
+	if len(tags) == 0 {
+		return generations, nil
+	}
+
+	keys := make([]string, len(tags))
+	for i, tag := range tags {
+		keys[i] = tagPrefix + tag
+	}
+
+	asKeys, err := e.newKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := e.client.BatchGet(e.batchPolicy, asKeys, generationBin)
+	if err != nil {
+		return nil, err
+	}
+
+	return readGenerations(tags, records)
+}
+
+// readGenerations returns the generation of each tag from its tag record
+func readGenerations(tags []string, records []*as.Record) (map[string]int64, error) {
+	generations := make(map[string]int64, len(tags))
+	for i, record := range records {
+		if record == nil {
+			generations[tags[i]] = 0
+			continue
+		}
+
+		generation, ok := int64Bin(record.Bins[generationBin])
+		if !ok {
+			return nil, common.ErrInvalidData
+		}
+
+		generations[tags[i]] = generation
+	}
+
+	return generations, nil
+}
+
+// storedTag is a tag recorded in an entry, along with its generation when the
+// entry was written
+type storedTag struct {
+	tag        string
+	generation string
+}
+
+// storedTags parses the tags recorded in an entry, as "<generation> <tag>"
+// lines
+func storedTags(value interface{}) ([]storedTag, bool) {
+	stored, _ := value.(string)
+	if stored == "" {
+		return nil, true
+	}
+
+	lines := strings.Split(stored, "\n")
+
+	tags := make([]storedTag, len(lines))
+	for i, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return nil, false
+		}
+
+		tags[i] = storedTag{tag: parts[1], generation: parts[0]}
+	}
+
+	return tags, true
+}
+
+// validRecords checks that each record exists and that none of its tags have
+// been expired since it was written. The generations of the tags of every
+// record are read in a single batch, along with the given companion records,
+// which are returned in order.
+func (e *Engine) validRecords(records []*as.Record, companions ...string) ([]bool, []*as.Record, error) {
+	valid := make([]bool, len(records))
+	tags := make([][]storedTag, len(records))
+
+	var names []string
+	seen := make(map[string]bool)
+	for i, record := range records {
+		if record == nil {
+			continue
+		}
+
+		tags[i], valid[i] = storedTags(record.Bins[e.bins.Tags])
+		for _, t := range tags[i] {
+			if !seen[t.tag] {
+				seen[t.tag] = true
+				names = append(names, t.tag)
+			}
+		}
+	}
+
+	if len(names) == 0 && len(companions) == 0 {
+		return valid, nil, nil
+	}
+
+	keys := make([]string, 0, len(companions)+len(names))
+	keys = append(keys, companions...)
+	for _, tag := range names {
+		keys = append(keys, tagPrefix+tag)
+	}
+
+	asKeys, err := e.newKeys(keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	batch, err := e.client.BatchGet(e.batchPolicy, asKeys, generationBin, e.bins.Lock)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	generations, err := readGenerations(names, batch[len(companions):])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i := range records {
+		for _, t := range tags[i] {
+			if strconv.FormatInt(generations[t.tag], 10) != t.generation {
+				valid[i] = false
+				break
+			}
+		}
+	}
+
+	return valid, batch[:len(companions)], nil
+}
+
+// newWritePolicy returns a copy of the configured write policy with the
+// generation and expiration of a write
+func (e *Engine) newWritePolicy(generation, expiration uint32) *as.WritePolicy {
+	if e.writePolicy == nil {
+		return as.NewWritePolicy(generation, expiration)
+	}
+
+	policy := *e.writePolicy
+	policy.RecordExistsAction = as.UPDATE
+	policy.GenerationPolicy = as.NONE
+	policy.Generation = generation
+	policy.Expiration = expiration
+
+	return &policy
+}
+
+// int64Bin decodes a numeric bin, which the client returns as int or int64
+// depending on the platform and value, or as float64 when written by other
+// clients
+func int64Bin(value interface{}) (int64, bool) {
+	switch n := value.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case int32:
+		return int64(n), true
+	case uint32:
+		return int64(n), true
+	case uint64:
+		if n > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	}
+
+	return 0, false
+}
+
+// newKeys returns the Aerospike keys of the records of the keys
+func (e *Engine) newKeys(keys []string) ([]*as.Key, error) {
+	asKeys := make([]*as.Key, 0, len(keys))
+	for _, key := range keys {
+		asKey, err := as.NewKey(e.namespace, e.set, key)
+		if err != nil {
+			return nil, err
+		}
+
+		asKeys = append(asKeys, asKey)
+	}
+
+	return asKeys, nil
+}
+
+// isCompanionKey reports whether the key is a tag or lock record rather than
+// an entry
+func isCompanionKey(key string) bool {
+	return strings.HasPrefix(key, tagPrefix) || strings.HasPrefix(key, lockPrefix)
+}
+
+// resultCode returns the Aerospike result code of an error, or types.OK
+func resultCode(err error) types.ResultCode {
+	if asErr, ok := err.(types.AerospikeError); ok {
+		return asErr.ResultCode()
+	}
+
+	return types.OK
+}
+
+// newToken returns a random token identifying a lock holder
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Close abandons any open scans and closes the client, if it can be closed
+func (e *Engine) Close() error {
+	e.scansLock.Lock()
+	for cursor, open := range e.scans {
+		open.timer.Stop()
+		open.recordset.Close()
+		delete(e.scans, cursor)
+	}
+	e.scansLock.Unlock()
+
+	if closer, ok := e.client.(interface {
+		Close()
+	}); ok {
+		closer.Close()
+	}
+
 	return nil
 }
@@ -0,0 +1,588 @@
+package aerospike
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	as "github.com/aerospike/aerospike-client-go"
+	"github.com/aerospike/aerospike-client-go/types"
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// mockClient keeps records in memory, honouring the record exists action and
+// generation checks of write policies
+type mockClient struct {
+	lock    sync.Mutex
+	records map[string]*as.Record
+
+	// The policy and bins of the last read
+	readPolicy *as.BasePolicy
+	readBins   []string
+
+	// The number of batch reads
+	batches int
+	// The number of operations
+	operations int
+	// The number of scans started
+	scans int
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{records: make(map[string]*as.Record)}
+}
+
+func (c *mockClient) Put(policy *as.WritePolicy, key *as.Key, binMap as.BinMap) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := key.Value().String()
+	record, exists := c.records[k]
+
+	if exists && policy != nil && policy.RecordExistsAction == as.CREATE_ONLY {
+		return types.NewAerospikeError(types.KEY_EXISTS_ERROR, "key exists")
+	}
+
+	generation := uint32(1)
+	if exists {
+		generation = record.Generation + 1
+	}
+
+	c.records[k] = &as.Record{Key: key, Bins: binMap, Generation: generation}
+	return nil
+}
+
+func (c *mockClient) Get(policy *as.BasePolicy, key *as.Key, binNames ...string) (*as.Record, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.readPolicy = policy
+	c.readBins = binNames
+
+	record, exists := c.records[key.Value().String()]
+	if !exists || len(binNames) == 0 {
+		return record, nil
+	}
+
+	bins := as.BinMap{}
+	for _, name := range binNames {
+		if value, ok := record.Bins[name]; ok {
+			bins[name] = value
+		}
+	}
+
+	return &as.Record{Key: record.Key, Bins: bins, Generation: record.Generation}, nil
+}
+
+func (c *mockClient) BatchGet(policy *as.BatchPolicy, keys []*as.Key, binNames ...string) ([]*as.Record, error) {
+	c.lock.Lock()
+	c.batches++
+	c.lock.Unlock()
+
+	records := make([]*as.Record, len(keys))
+	for i, key := range keys {
+		records[i], _ = c.Get(nil, key, binNames...)
+	}
+
+	return records, nil
+}
+
+func (c *mockClient) Delete(policy *as.WritePolicy, key *as.Key) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := key.Value().String()
+	record, exists := c.records[k]
+	if !exists {
+		return false, nil
+	}
+
+	if policy != nil && policy.GenerationPolicy == as.EXPECT_GEN_EQUAL && policy.Generation != record.Generation {
+		return false, types.NewAerospikeError(types.GENERATION_ERROR, "generation mismatch")
+	}
+
+	delete(c.records, k)
+	return true, nil
+}
+
+// Operate bumps the generation of a tag record, the only operation the engine
+// makes, as operations can't be inspected
+func (c *mockClient) Operate(policy *as.WritePolicy, key *as.Key, operations ...*as.Operation) (*as.Record, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.operations++
+
+	k := key.Value().String()
+	record, exists := c.records[k]
+	if !exists {
+		record = &as.Record{Key: key, Bins: as.BinMap{generationBin: 0}}
+		c.records[k] = record
+	}
+
+	generation, _ := int64Bin(record.Bins[generationBin])
+	record.Bins[generationBin] = generation + 1
+	record.Generation++
+
+	return record, nil
+}
+
+func (c *mockClient) ScanAll(policy *as.ScanPolicy, namespace string, setName string, binNames ...string) (*as.Recordset, error) {
+	return nil, common.ErrNotSupported
+}
+
+// scanAll stands in for ScanAll, returning every record in key order
+func (c *mockClient) scanAll(policy *as.ScanPolicy, binNames ...string) (scanRecordset, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := make([]string, 0, len(c.records))
+	for k := range c.records {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	results := make(chan *as.Result, len(keys))
+	for _, k := range keys {
+		record := *c.records[k]
+		if !policy.IncludeBinData {
+			record.Bins = nil
+		}
+
+		results <- &as.Result{Record: &record}
+	}
+	close(results)
+
+	c.scans++
+
+	return &mockRecordset{results: results}, nil
+}
+
+// mockRecordset is a scan of the records of a mockClient
+type mockRecordset struct {
+	results chan *as.Result
+
+	lock   sync.Mutex
+	closed bool
+}
+
+func (r *mockRecordset) Results() <-chan *as.Result {
+	return r.results
+}
+
+func (r *mockRecordset) Close() error {
+	r.lock.Lock()
+	r.closed = true
+	r.lock.Unlock()
+	return nil
+}
+
+func (r *mockRecordset) isClosed() bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.closed
+}
+
+// mustKey returns the key of a record of the test set
+func mustKey(key string) *as.Key {
+	asKey, _ := as.NewKey("test", "cache", key)
+	return asKey
+}
+
+// newTestStore creates a store on a new mockClient, scanning its records
+func newTestStore(opts ...Option) (*Engine, *mockClient) {
+	client := newMockClient()
+
+	engine := NewAerospikeStore("test", "cache", client, time.Minute, opts...)
+	engine.scanAll = client.scanAll
+
+	return engine, client
+}
+
+func TestAerospikeEngine_Lock(t *testing.T) {
+	client := newMockClient()
+	engine := NewAerospikeStore("test", "cache", client, time.Minute)
+	other := NewAerospikeStore("test", "cache", client, time.Minute)
+
+	engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+
+	if engine.IsLocked("key") {
+		t.Fatal("key shouldn't be locked yet")
+	}
+
+	err := engine.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !other.IsLocked("key") {
+		t.Fatal("the lock should be seen by other processes")
+	}
+
+	err = other.Lock("key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("%s expected, %v given", common.ErrKeyAlreadyLocked, err)
+	}
+
+	err = other.Unlock("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("only the holder should release the lock, %v given", err)
+	}
+
+	err = engine.Unlock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.IsLocked("key") {
+		t.Fatal("key should have been unlocked")
+	}
+}
+
+func TestAerospikeEngine_LockTakenOver(t *testing.T) {
+	client := newMockClient()
+	engine := NewAerospikeStore("test", "cache", client, time.Minute)
+	other := NewAerospikeStore("test", "cache", client, time.Minute)
+
+	engine.Lock("key")
+
+	// The lease runs out, and another process takes the lock
+	lockKey, _ := as.NewKey("test", "cache", lockPrefix+"key")
+	client.Delete(nil, lockKey)
+
+	err := other.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = engine.Unlock("key")
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("%s expected, %v given", common.ErrLockNotHeld, err)
+	}
+
+	if !other.IsLocked("key") {
+		t.Fatal("the lock of the other process should have been kept")
+	}
+
+	err = other.Expire("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if other.IsLocked("key") {
+		t.Fatal("the lock should have been removed with the key")
+	}
+}
+
+func TestAerospikeEngine_Options(t *testing.T) {
+	client := newMockClient()
+	readPolicy := as.NewPolicy()
+
+	engine := NewAerospikeStore("test", "cache", client, time.Minute,
+		Bins(BinNames{Data: "d", Expires: "e"}),
+		ReadPolicy(readPolicy),
+		WritePolicy(&as.WritePolicy{CommitLevel: as.COMMIT_MASTER}),
+	)
+
+	engine.Put("key", []byte("hello"), time.Now().Add(-time.Hour))
+
+	record := client.records["key"]
+	if _, ok := record.Bins["d"]; !ok {
+		t.Fatalf("data should be stored in the configured bin, %v given", record.Bins)
+	}
+
+	data, err := engine.Get("key")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("hello expected, %s given", data)
+	}
+
+	if client.readPolicy != readPolicy {
+		t.Fatal("the configured read policy should be used")
+	}
+
+	if !engine.IsExpired("key") {
+		t.Fatal("key should have expired")
+	}
+
+	if len(client.readBins) != 1 || client.readBins[0] != "e" {
+		t.Fatalf("only the expiry bin should be read, %v given", client.readBins)
+	}
+}
+
+func TestAerospikeEngine_NumericBins(t *testing.T) {
+	client := newMockClient()
+	engine := NewAerospikeStore("test", "cache", client, time.Minute)
+
+	future := time.Now().Add(time.Hour).Unix()
+	values := []interface{}{int(future), future, float64(future)}
+
+	for _, value := range values {
+		key, _ := as.NewKey("test", "cache", "key")
+		client.Put(nil, key, as.BinMap{"expires": value})
+
+		if engine.IsExpired("key") {
+			t.Fatalf("key shouldn't have expired given a %T expiry", value)
+		}
+	}
+}
+
+func TestAerospikeEngine_Fetch(t *testing.T) {
+	client := newMockClient()
+	engine := NewAerospikeStore("test", "cache", client, time.Minute)
+
+	expires := time.Now().Add(time.Hour)
+	engine.Put("key", []byte("hello"), expires)
+	engine.Lock("key")
+
+	entry, err := engine.Fetch("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if string(entry.Data) != "hello" || entry.Expires.Unix() != expires.Unix() || !entry.Locked {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	if client.batches != 1 {
+		t.Fatalf("the entry should be read in a single batch, %d given", client.batches)
+	}
+
+	engine.Expire("key")
+	engine.Lock("key")
+
+	entry, err = engine.Fetch("key")
+	if err != common.ErrNonExistentKey || !entry.Locked {
+		t.Fatalf("%s expected with the lock state, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestAerospikeEngine_GetMulti(t *testing.T) {
+	client := newMockClient()
+	engine := NewAerospikeStore("test", "cache", client, time.Minute)
+
+	engine.Put("first", []byte("1"), time.Now().Add(time.Hour))
+	engine.Put("second", []byte("2"), time.Now().Add(time.Hour))
+
+	found, err := engine.GetMulti([]string{"first", "missing", "second"})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(found) != 2 || string(found["first"]) != "1" || string(found["second"]) != "2" {
+		t.Fatalf("the existing keys expected, %q given", found)
+	}
+
+	if client.batches != 1 {
+		t.Fatalf("the keys should be read in a single batch, %d given", client.batches)
+	}
+
+	engine.PutTagged("first", []byte("1"), time.Now().Add(time.Hour), []string{"all", "odd"})
+	engine.PutTagged("second", []byte("2"), time.Now().Add(time.Hour), []string{"all"})
+	client.batches = 0
+
+	found, err = engine.GetMulti([]string{"first", "second"})
+	if err != nil || len(found) != 2 {
+		t.Fatalf("the tagged keys expected, %q %v given", found, err)
+	}
+
+	if client.batches != 2 {
+		t.Fatalf("the tags of every key should be read in a single batch, %d batches given", client.batches)
+	}
+}
+
+func TestAerospikeEngine_ExpireTag(t *testing.T) {
+	client := newMockClient()
+	engine := NewAerospikeStore("test", "cache", client, time.Minute)
+
+	expires := time.Now().Add(time.Hour)
+	engine.PutTagged("first", []byte("1"), expires, []string{"all", "odd"})
+	engine.PutTagged("second", []byte("2"), expires, []string{"all"})
+
+	if !engine.Exists("first") || !engine.Exists("second") {
+		t.Fatal("tagged keys should exist")
+	}
+
+	if client.operations != 0 {
+		t.Fatalf("tag generations should only be read, %d operations given", client.operations)
+	}
+
+	err := engine.ExpireTag("odd")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.Exists("first") || !engine.Exists("second") {
+		t.Fatal("only the keys carrying the tag should have been expired")
+	}
+
+	// Keys stored after the tag was expired carry its new generation
+	engine.PutTagged("first", []byte("1"), expires, []string{"all", "odd"})
+
+	_, err = engine.Get("first")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	engine.ExpireTag("all")
+
+	found, _ := engine.GetMulti([]string{"first", "second"})
+	if len(found) != 0 {
+		t.Fatalf("every key carrying the tag should have been expired, %q given", found)
+	}
+}
+
+func TestAerospikeEngine_DeletePrefix(t *testing.T) {
+	engine, client := newTestStore()
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 2500; i++ {
+		engine.Put(fmt.Sprintf("a:%d", i), []byte("hello"), expires)
+	}
+	engine.Put("b:1", []byte("hello"), expires)
+	engine.PutTagged("a_1", []byte("hello"), expires, []string{"a:"})
+	engine.Lock("a:1")
+
+	var progress []int
+	deleted, err := engine.DeletePrefix("a:", func(n int) {
+		progress = append(progress, n)
+	})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if deleted != 2500 {
+		t.Fatalf("2500 deletions expected, %d given", deleted)
+	}
+
+	if fmt.Sprint(progress) != "[1000 2000 2500]" {
+		t.Fatalf("progress every 1000 keys and at the end expected, %v given", progress)
+	}
+
+	if engine.Exists("a:1") || !engine.Exists("b:1") || !engine.Exists("a_1") {
+		t.Fatal("only the keys starting with the prefix should have been deleted")
+	}
+
+	// Lock records are left alone
+	if _, ok := client.records[lockPrefix+"a:1"]; !ok {
+		t.Fatal("lock records shouldn't be deleted")
+	}
+}
+
+func TestAerospikeEngine_DeleteMatching(t *testing.T) {
+	engine, _ := newTestStore()
+
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"a*1", "ab1", "a?2", "b*1"} {
+		engine.Put(key, []byte("hello"), expires)
+	}
+
+	var progress []int
+	deleted, err := engine.DeleteMatching(`a\*?`, func(n int) {
+		progress = append(progress, n)
+	})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if deleted != 1 || fmt.Sprint(progress) != "[1]" {
+		t.Fatalf("1 deletion expected, %d given with progress %v", deleted, progress)
+	}
+
+	if engine.Exists("a*1") || !engine.Exists("ab1") || !engine.Exists("a?2") {
+		t.Fatal("only the keys matching the escaped pattern should have been deleted")
+	}
+
+	deleted, err = engine.DeleteMatching("nothing*", nil)
+	if err != nil || deleted != 0 {
+		t.Fatalf("no deletions expected, %d given", deleted)
+	}
+}
+
+func TestAerospikeEngine_Scan(t *testing.T) {
+	engine, client := newTestStore()
+
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"a:1", "a:2", "a:3", "b:1"} {
+		engine.Put(key, []byte(key), expires)
+	}
+	engine.Lock("a:2")
+
+	keys, cursor, err := engine.Scan("", "a:", 2)
+	if err != nil || len(keys) != 2 || keys[0] != "a:1" || cursor == "" {
+		t.Fatalf("the first page expected, %v %q %v given", keys, cursor, err)
+	}
+
+	keys, cursor, err = engine.Scan(cursor, "a:", 2)
+	if err != nil || len(keys) != 1 || keys[0] != "a:3" || cursor != "" {
+		t.Fatalf("the last page expected, %v %q %v given", keys, cursor, err)
+	}
+
+	entries, _, _ := engine.ScanEntries("", "a:2", 0)
+	if len(entries) != 1 || string(entries[0].Data) != "a:2" || !entries[0].Locked || entries[0].Expires.Unix() != expires.Unix() {
+		t.Fatalf("the entry with its lock state expected, %+v given", entries)
+	}
+
+	engine.PutTagged("a:1", []byte("a:1"), expires, []string{"odd"})
+	engine.PutTagged("a:3", []byte("a:3"), expires, []string{"odd"})
+	engine.ExpireTag("odd")
+	engine.PutTagged("a:3", []byte("a:3"), expires, []string{"odd"})
+	client.batches = 0
+
+	entries, _, _ = engine.ScanEntries("", "a:", 0)
+	if len(entries) != 2 || entries[0].Key != "a:2" || !entries[0].Locked || entries[1].Key != "a:3" || entries[1].Locked {
+		t.Fatalf("the entries with valid tags expected, %+v given", entries)
+	}
+
+	if client.batches != 1 {
+		t.Fatalf("the locks and tags of a page should be read in a single batch, %d given", client.batches)
+	}
+
+	_, _, err = engine.Scan("unknown", "", 1)
+	if err != common.ErrInvalidCursor {
+		t.Fatalf("%s expected, %v given", common.ErrInvalidCursor, err)
+	}
+
+	if client.scans != 3 {
+		t.Fatalf("a scan should only be started without a cursor, %d given", client.scans)
+	}
+}
+
+func TestAerospikeEngine_ScanTimeout(t *testing.T) {
+	engine, client := newTestStore(ScanTimeout(10 * time.Millisecond))
+
+	for _, key := range []string{"a:1", "a:2", "a:3"} {
+		client.Put(nil, mustKey(key), as.BinMap{"data": []byte(key)})
+	}
+
+	_, cursor, _ := engine.Scan("", "", 1)
+
+	engine.scansLock.Lock()
+	recordset := engine.scans[cursor].recordset.(*mockRecordset)
+	engine.scansLock.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if !recordset.isClosed() {
+		t.Fatal("the idle scan should have been closed")
+	}
+
+	_, _, err := engine.Scan(cursor, "", 1)
+	if err != common.ErrInvalidCursor {
+		t.Fatalf("%s expected, %v given", common.ErrInvalidCursor, err)
+	}
+
+	// Open scans are closed along with the engine
+	_, cursor, _ = engine.Scan("", "", 1)
+
+	engine.scansLock.Lock()
+	recordset = engine.scans[cursor].recordset.(*mockRecordset)
+	engine.scansLock.Unlock()
+
+	engine.Close()
+
+	if !recordset.isClosed() {
+		t.Fatal("the scan should have been closed with the engine")
+	}
+}
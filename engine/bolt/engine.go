@@ -0,0 +1,608 @@
+// Package bolt is a storage engine persisting entries to a single file with
+// bbolt, so that a cache on a single host survives restarts without running a
+// separate server.
+package bolt
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// Engine stores entries in a bbolt database, with the same semantics as the
+// memory engine: an entry stays available once it has expired, so that stale
+// data can be served while it is regenerated, until cleanupTimeout after it
+// was stored. Hard expired entries are removed in the background, freeing
+// their pages for reuse.
+//
+// bbolt holds an exclusive lock on the file while it is open, so only one
+// process can use it at a time. Locks are therefore kept in memory, and never
+// outlive the process.
+type Engine struct {
+	db             *bbolt.DB
+	boltOptions    *bbolt.Options
+	expirePoll     time.Duration
+	cleanupTimeout time.Duration
+
+	locksLock sync.Mutex
+	locks     map[string]bool
+
+	// done is closed by Close to stop the background goroutine
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Option configures optional behaviour of the bolt engine
+type Option func(*Engine)
+
+// BoltOptions sets the options the database is opened with, such as the time
+// to wait for the file lock
+func BoltOptions(opts *bbolt.Options) Option {
+	return func(e *Engine) {
+		e.boltOptions = opts
+	}
+}
+
+var (
+	// entriesBucket holds the entries by key
+	entriesBucket = []byte("entries")
+	// expiryBucket indexes the entries by hard expiry, see expiryKey
+	expiryBucket = []byte("expiry")
+	// tagsBucket holds a bucket per tag, holding the keys carrying it
+	tagsBucket = []byte("tags")
+)
+
+// deleteBatchSize is the number of keys removed per transaction when deleting
+// by prefix or pattern, or removing hard expired keys
+const deleteBatchSize = 1000
+
+// defaultOpenTimeout is the time waited for the lock on the file, which is held
+// by any other process using it
+const defaultOpenTimeout = time.Second
+
+// NewBoltStore opens, or creates, the database at path and removes hard
+// expired keys from it every expirePoll until closed
+func NewBoltStore(path string, expirePoll time.Duration, cleanupTimeout time.Duration, opts ...Option) (*Engine, error) {
+	e := &Engine{
+		boltOptions:    &bbolt.Options{Timeout: defaultOpenTimeout},
+		expirePoll:     expirePoll,
+		cleanupTimeout: cleanupTimeout,
+		locks:          make(map[string]bool),
+		done:           make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	db, err := bbolt.Open(path, 0600, e.boltOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, expiryBucket, tagsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	e.db = db
+	e.cleanupExpiredKeys()
+
+	return e, nil
+}
+
+// Exists checks to see if a key exists in the store
+func (e *Engine) Exists(key string) bool {
+	exists := false
+
+	e.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(entriesBucket).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+
+		_, hardExpiry, err := decodeExpiry(value)
+		exists = err == nil && time.Now().Before(hardExpiry)
+		return nil
+	})
+
+	return exists
+}
+
+// Get retrieves data from the store based on key, if it exists, else it returns an error
+func (e *Engine) Get(key string) ([]byte, error) {
+	entry, err := e.Fetch(key)
+	return entry.Data, err
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state.
+// If the key doesn't exist common.ErrNonExistentKey is returned, along with the
+// lock state.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	entry := common.Entry{
+		Key:    key,
+		Locked: e.IsLocked(key),
+	}
+
+	err := e.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(entriesBucket).Get([]byte(key))
+		if value == nil {
+			return common.ErrNonExistentKey
+		}
+
+		stored, err := decodeEntry(value)
+		if err != nil {
+			return err
+		}
+
+		if !time.Now().Before(stored.hardExpiry) {
+			return common.ErrNonExistentKey
+		}
+
+		entry.Data = stored.data
+		entry.Expires = stored.expires
+		return nil
+	})
+
+	return entry, err
+}
+
+// Put stores data against a key, else it returns an error
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	return e.PutTagged(key, data, expires, nil)
+}
+
+// PutTagged stores data against a key and associates it with the given tags,
+// replacing any tags previously held by the key
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	return e.db.Update(func(tx *bbolt.Tx) error {
+		err := e.remove(tx, key)
+		if err != nil {
+			return err
+		}
+
+		stored := entry{
+			data:       data,
+			expires:    expires,
+			hardExpiry: e.hardExpiry(expires),
+			tags:       tags,
+		}
+
+		err = tx.Bucket(entriesBucket).Put([]byte(key), encodeEntry(stored))
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(expiryBucket).Put(expiryKey(stored.hardExpiry, key), nil)
+		if err != nil {
+			return err
+		}
+
+		for _, tag := range tags {
+			bucket, err := tx.Bucket(tagsBucket).CreateBucketIfNotExists([]byte(tag))
+			if err != nil {
+				return err
+			}
+
+			err = bucket.Put([]byte(key), nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	expired := true
+
+	e.db.View(func(tx *bbolt.Tx) error {
+		value := tx.Bucket(entriesBucket).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+
+		expires, hardExpiry, err := decodeExpiry(value)
+		if err != nil {
+			return nil
+		}
+
+		now := time.Now()
+		expired = !now.Before(hardExpiry) || now.After(expires)
+		return nil
+	})
+
+	return expired
+}
+
+// Expire marks the key as expired, and removes it from the storage engine
+func (e *Engine) Expire(key string) error {
+	err := e.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(entriesBucket).Get([]byte(key)) == nil {
+			return common.ErrNonExistentKey
+		}
+
+		return e.remove(tx, key)
+	})
+	if err != nil {
+		return err
+	}
+
+	e.releaseLocks([]string{key})
+
+	return nil
+}
+
+// ExpireTag removes every key carrying the given tag from the storage engine
+func (e *Engine) ExpireTag(tag string) error {
+	var keys []string
+
+	err := e.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(tagsBucket).Bucket([]byte(tag))
+		if bucket == nil {
+			return nil
+		}
+
+		err := bucket.ForEach(func(k, _ []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = e.remove(tx, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	e.releaseLocks(keys)
+
+	return nil
+}
+
+// DeletePrefix removes every key starting with the prefix from the storage engine
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.deleteWhere(prefix, func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}, progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the storage engine
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	return e.deleteWhere("", func(key string) bool {
+		return common.MatchGlob(pattern, key)
+	}, progress)
+}
+
+// Scan returns up to count keys starting with prefix, in key order. The cursor
+// is the last key returned by the previous page.
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	var keys []string
+
+	next, err := e.scan(cursor, prefix, count, func(key string, _ entry) {
+		keys = append(keys, key)
+	})
+
+	return keys, next, err
+}
+
+// ScanEntries returns up to count entries whose key starts with prefix, in key
+// order. The cursor is the last key returned by the previous page.
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
+	var entries []common.Entry
+
+	next, err := e.scan(cursor, prefix, count, func(key string, stored entry) {
+		entries = append(entries, common.Entry{
+			Key:     key,
+			Data:    stored.data,
+			Expires: stored.expires,
+			Locked:  e.IsLocked(key),
+		})
+	})
+
+	return entries, next, err
+}
+
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	e.locksLock.Lock()
+	defer e.locksLock.Unlock()
+
+	return e.locks[key]
+}
+
+// Lock sets a lock against the given key
+func (e *Engine) Lock(key string) error {
+	e.locksLock.Lock()
+	defer e.locksLock.Unlock()
+
+	if e.locks[key] {
+		return common.ErrKeyAlreadyLocked
+	}
+
+	e.locks[key] = true
+
+	return nil
+}
+
+// Unlock removes the lock from a given key, if it doesn't exist it returns an error
+func (e *Engine) Unlock(key string) error {
+	e.locksLock.Lock()
+	defer e.locksLock.Unlock()
+
+	if !e.locks[key] {
+		return common.ErrNonExistentKey
+	}
+
+	delete(e.locks, key)
+
+	return nil
+}
+
+// Close stops removing hard expired keys, and closes the database
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.closeErr = e.db.Close()
+	})
+
+	return e.closeErr
+}
+
+// hardExpiry returns when an entry stored now with the given expiry is removed
+func (e *Engine) hardExpiry(expires time.Time) time.Time {
+	if e.cleanupTimeout <= 0 {
+		return expires
+	}
+
+	return time.Now().Add(e.cleanupTimeout)
+}
+
+// releaseLocks releases the locks of removed keys, as the memory engine does
+func (e *Engine) releaseLocks(keys []string) {
+	e.locksLock.Lock()
+	defer e.locksLock.Unlock()
+
+	for _, key := range keys {
+		delete(e.locks, key)
+	}
+}
+
+// remove deletes the entry of a key, if it exists, along with its expiry and
+// tag index entries. Its lock is released by the caller once the transaction
+// is committed.
+func (e *Engine) remove(tx *bbolt.Tx, key string) error {
+	entries := tx.Bucket(entriesBucket)
+
+	value := entries.Get([]byte(key))
+	if value == nil {
+		return nil
+	}
+
+	stored, err := decodeEntry(value)
+	if err != nil {
+		// Nothing can be unindexed, but the entry itself can still go
+		return entries.Delete([]byte(key))
+	}
+
+	err = tx.Bucket(expiryBucket).Delete(expiryKey(stored.hardExpiry, key))
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range stored.tags {
+		bucket := tx.Bucket(tagsBucket).Bucket([]byte(tag))
+		if bucket == nil {
+			continue
+		}
+
+		err = bucket.Delete([]byte(key))
+		if err != nil {
+			return err
+		}
+
+		if k, _ := bucket.Cursor().First(); k == nil {
+			err = tx.Bucket(tagsBucket).DeleteBucket([]byte(tag))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return entries.Delete([]byte(key))
+}
+
+// scan passes the live entries following the cursor and starting with prefix
+// to fn, in key order, and returns the cursor of the next page
+func (e *Engine) scan(cursor string, prefix string, count int, fn func(key string, stored entry)) (string, error) {
+	next := ""
+
+	err := e.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(entriesBucket).Cursor()
+		now := time.Now()
+
+		start := []byte(prefix)
+		if cursor > prefix {
+			start = []byte(cursor)
+		}
+
+		n := 0
+		for k, v := c.Seek(start); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			key := string(k)
+			if key == cursor {
+				continue
+			}
+
+			stored, err := decodeEntry(v)
+			if err != nil || !now.Before(stored.hardExpiry) {
+				continue
+			}
+
+			if count > 0 && n == count {
+				next = cursor
+				return nil
+			}
+
+			fn(key, stored)
+			cursor = key
+			n++
+		}
+
+		return nil
+	})
+
+	return next, err
+}
+
+// deleteWhere walks the keys starting with prefix and removes those matching
+// in batches, so that large deletions don't hold the write lock for their
+// whole duration
+func (e *Engine) deleteWhere(prefix string, match func(string) bool, progress func(int)) (int, error) {
+	var keys []string
+
+	err := e.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(entriesBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			if match(string(k)) {
+				keys = append(keys, string(k))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > deleteBatchSize {
+			batch = batch[:deleteBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		var removed []string
+		err = e.db.Update(func(tx *bbolt.Tx) error {
+			removed = removed[:0]
+			for _, key := range batch {
+				if tx.Bucket(entriesBucket).Get([]byte(key)) == nil {
+					continue
+				}
+
+				if err := e.remove(tx, key); err != nil {
+					return err
+				}
+				removed = append(removed, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		if len(removed) == 0 {
+			continue
+		}
+
+		e.releaseLocks(removed)
+
+		deleted += len(removed)
+		if progress != nil {
+			progress(deleted)
+		}
+	}
+
+	return deleted, nil
+}
+
+// cleanupExpiredKeys removes hard expired keys every expirePoll, until the
+// engine is closed
+func (e *Engine) cleanupExpiredKeys() {
+	if e.expirePoll <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.expirePoll)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.removeExpired()
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// removeExpired removes every hard expired key, walking the expiry index in
+// batches
+func (e *Engine) removeExpired() error {
+	for {
+		var keys [][]byte
+		now := expiryKey(time.Now(), "")
+
+		err := e.db.Update(func(tx *bbolt.Tx) error {
+			keys = keys[:0]
+
+			c := tx.Bucket(expiryBucket).Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, now) < 0 && len(keys) < deleteBatchSize; k, _ = c.Next() {
+				keys = append(keys, append([]byte{}, k...))
+			}
+
+			for _, k := range keys {
+				if err := e.remove(tx, string(k[8:])); err != nil {
+					return err
+				}
+
+				// The index entry is normally removed with its entry, unless
+				// the entry couldn't be read
+				if err := tx.Bucket(expiryBucket).Delete(k); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		removed := make([]string, len(keys))
+		for i, k := range keys {
+			removed[i] = string(k[8:])
+		}
+		e.releaseLocks(removed)
+
+		if len(keys) < deleteBatchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package bolt
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	bbolt "go.etcd.io/bbolt"
+)
+
+// newTestStore opens a database in a new directory, which the caller removes
+func newTestStore(t *testing.T) (*Engine, string) {
+	dir, err := ioutil.TempDir("", "go-cache-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := NewBoltStore(filepath.Join(dir, "cache.db"), time.Hour, time.Hour)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return engine, dir
+}
+
+func TestBoltEngine_PutGet(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+
+	content := []byte("hello")
+	expires := time.Now().Add(time.Hour)
+
+	err := engine.Put("key", content, expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	engine.Close()
+
+	// Entries survive reopening the database
+	engine, err = NewBoltStore(filepath.Join(dir, "cache.db"), time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+
+	if !engine.Exists("key") || engine.IsExpired("key") {
+		t.Fatal("key should exist and be fresh")
+	}
+
+	entry, err := engine.Fetch("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !bytes.Equal(entry.Data, content) || !entry.Expires.Equal(expires) {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	err = engine.Expire("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	_, err = engine.Get("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestBoltEngine_Expiry(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	engine.Put("stale", []byte("hello"), time.Now().Add(-time.Minute))
+
+	if !engine.Exists("stale") || !engine.IsExpired("stale") {
+		t.Fatal("expired keys should stay available until the cleanup timeout")
+	}
+
+	engine.cleanupTimeout = time.Nanosecond
+	engine.Put("gone", []byte("hello"), time.Now().Add(-time.Minute))
+	time.Sleep(time.Millisecond)
+
+	err := engine.removeExpired()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.Exists("gone") || !engine.Exists("stale") {
+		t.Fatal("only hard expired keys should have been removed")
+	}
+
+	engine.db.View(func(tx *bbolt.Tx) error {
+		if n := tx.Bucket(expiryBucket).Stats().KeyN; n != 1 {
+			t.Fatalf("the expiry index should hold 1 key, %d given", n)
+		}
+		return nil
+	})
+}
+
+func TestBoltEngine_Tags(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	engine.PutTagged("first", []byte("1"), expires, []string{"all", "odd"})
+	engine.PutTagged("second", []byte("2"), expires, []string{"all"})
+
+	// Tags are replaced by each write
+	engine.PutTagged("first", []byte("1"), expires, []string{"all"})
+
+	engine.ExpireTag("odd")
+	if !engine.Exists("first") {
+		t.Fatal("first no longer carries the odd tag")
+	}
+
+	engine.ExpireTag("all")
+	if engine.Exists("first") || engine.Exists("second") {
+		t.Fatal("every key carrying the tag should have been removed")
+	}
+}
+
+func TestBoltEngine_Scan(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"a:1", "a:2", "a:3", "b:1"} {
+		engine.Put(key, []byte(key), expires)
+	}
+
+	keys, cursor, err := engine.Scan("", "a:", 2)
+	if err != nil || len(keys) != 2 || keys[0] != "a:1" || cursor != "a:2" {
+		t.Fatalf("the first page expected, %v %q %v given", keys, cursor, err)
+	}
+
+	entries, cursor, err := engine.ScanEntries(cursor, "a:", 2)
+	if err != nil || len(entries) != 1 || string(entries[0].Data) != "a:3" || cursor != "" {
+		t.Fatalf("the last page expected, %+v %q %v given", entries, cursor, err)
+	}
+
+	var progress int
+	deleted, err := engine.DeleteMatching("a:*", func(n int) { progress = n })
+	if err != nil || deleted != 3 || progress != 3 {
+		t.Fatalf("3 deletions expected, %d given", deleted)
+	}
+
+	if !engine.Exists("b:1") {
+		t.Fatal("keys not matching shouldn't have been deleted")
+	}
+}
+
+func TestBoltEngine_Lock(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	err := engine.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !engine.IsLocked("key") {
+		t.Fatal("key should be locked")
+	}
+
+	err = engine.Lock("key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("%s expected, %v given", common.ErrKeyAlreadyLocked, err)
+	}
+
+	err = engine.Unlock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = engine.Unlock("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+
+	// Removing a key releases its lock
+	expires := time.Now().Add(time.Hour)
+	engine.PutTagged("expired", []byte("hello"), expires, nil)
+	engine.PutTagged("tagged", []byte("hello"), expires, []string{"all"})
+	engine.cleanupTimeout = time.Nanosecond
+	engine.PutTagged("swept", []byte("hello"), expires, nil)
+	time.Sleep(time.Millisecond)
+
+	for _, key := range []string{"expired", "tagged", "swept"} {
+		engine.Lock(key)
+	}
+
+	engine.Expire("expired")
+	engine.ExpireTag("all")
+	engine.removeExpired()
+
+	for _, key := range []string{"expired", "tagged", "swept"} {
+		if engine.IsLocked(key) {
+			t.Fatalf("the lock of %s should have been released", key)
+		}
+
+		err = engine.Lock(key)
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+	}
+}
+
+func TestBoltEngine_ExpiryRange(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	far := time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for _, expires := range []time.Time{{}, far} {
+		err := engine.Put("key", []byte("hello"), expires)
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		entry, err := engine.Fetch("key")
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		if expires.IsZero() != entry.Expires.IsZero() || engine.IsExpired("key") != expires.IsZero() {
+			t.Fatalf("%s expected, %s given", expires, entry.Expires)
+		}
+	}
+
+	// Far hard expiries are kept after those of the past in the index
+	engine.cleanupTimeout = 0
+	engine.Put("far", []byte("hello"), far)
+	engine.Put("past", []byte("hello"), time.Now().Add(-time.Minute))
+
+	engine.removeExpired()
+
+	if !engine.Exists("far") || engine.Exists("past") {
+		t.Fatal("only the entry expired in the past should have been removed")
+	}
+}
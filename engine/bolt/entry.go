@@ -0,0 +1,144 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// An entry is stored as
+//
+//     expires      time, see putTime
+//     hard expiry  time, see putTime
+//     tags         uvarint count, then uvarint length, bytes for each
+//     data         the remaining bytes
+
+// Bounds of the times which can be stored, as int64 Unix nanoseconds
+var (
+	minTime = time.Unix(0, math.MinInt64)
+	maxTime = time.Unix(0, math.MaxInt64)
+)
+
+// entryHeaderLength is the length of the expiry times starting an entry
+const entryHeaderLength = 16
+
+// entry is an entry as stored in the entries bucket
+type entry struct {
+	data       []byte
+	expires    time.Time
+	hardExpiry time.Time
+	tags       []string
+}
+
+// encodeEntry returns the stored form of the entry
+func encodeEntry(e entry) []byte {
+	size := entryHeaderLength + binary.MaxVarintLen64 + len(e.data)
+	for _, tag := range e.tags {
+		size += binary.MaxVarintLen64 + len(tag)
+	}
+
+	value := make([]byte, entryHeaderLength, size)
+	putTime(value, e.expires)
+	putTime(value[8:], e.hardExpiry)
+
+	value = appendUvarint(value, uint64(len(e.tags)))
+	for _, tag := range e.tags {
+		value = appendUvarint(value, uint64(len(tag)))
+		value = append(value, tag...)
+	}
+
+	return append(value, e.data...)
+}
+
+// decodeEntry parses a stored entry. The data is copied, as values read from
+// bolt are only valid during their transaction.
+func decodeEntry(value []byte) (entry, error) {
+	if len(value) < entryHeaderLength {
+		return entry{}, common.ErrInvalidData
+	}
+
+	e := entry{
+		expires:    getTime(value),
+		hardExpiry: getTime(value[8:]),
+	}
+	value = value[entryHeaderLength:]
+
+	count, n := binary.Uvarint(value)
+	if n <= 0 {
+		return entry{}, common.ErrInvalidData
+	}
+	value = value[n:]
+
+	for i := uint64(0); i < count; i++ {
+		length, n := binary.Uvarint(value)
+		if n <= 0 || uint64(len(value)-n) < length {
+			return entry{}, common.ErrInvalidData
+		}
+
+		e.tags = append(e.tags, string(value[n:n+int(length)]))
+		value = value[n+int(length):]
+	}
+
+	e.data = append([]byte{}, value...)
+
+	return e, nil
+}
+
+// decodeExpiry reads only the expiry times of a stored entry
+func decodeExpiry(value []byte) (expires time.Time, hardExpiry time.Time, err error) {
+	if len(value) < entryHeaderLength {
+		return time.Time{}, time.Time{}, common.ErrInvalidData
+	}
+
+	expires = getTime(value)
+	hardExpiry = getTime(value[8:])
+
+	return expires, hardExpiry, nil
+}
+
+// expiryKey returns the key of an entry in the expiry index, which sorts
+// entries by hard expiry
+func expiryKey(hardExpiry time.Time, key string) []byte {
+	k := make([]byte, 8+len(key))
+	putTime(k, hardExpiry)
+	copy(k[8:], key)
+
+	return k
+}
+
+// putTime writes the time as big endian Unix nanoseconds with the sign bit
+// flipped, so that stored times sort in order. Times out of the range of
+// Unix nanoseconds, such as the zero time, are clamped to it.
+func putTime(b []byte, t time.Time) {
+	var n int64
+	switch {
+	case !t.After(minTime):
+		n = math.MinInt64
+	case !t.Before(maxTime):
+		n = math.MaxInt64
+	default:
+		n = t.UnixNano()
+	}
+
+	binary.BigEndian.PutUint64(b, uint64(n)^1<<63)
+}
+
+// getTime reads a time written by putTime. The earliest time that can be
+// stored is read as the zero time.
+func getTime(b []byte) time.Time {
+	n := int64(binary.BigEndian.Uint64(b) ^ 1<<63)
+	if n == math.MinInt64 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, n)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+
+	return append(b, buf[:n]...)
+}
@@ -0,0 +1,362 @@
+// Package chunked splits values too large for a storage engine, such as
+// memcached items over 1MB, into chunks stored under keys of their own.
+package chunked
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// Engine wraps another storage engine, storing values which don't fit in the
+// chunk size as numbered chunks, along with a manifest under the key itself.
+// Smaller values are stored inline, after a single byte header.
+//
+// Chunks are written before their manifest, so readers never see a manifest
+// whose chunks are still being written. Each write uses chunk keys of its own,
+// so overwriting a value leaves the chunks of the previous one orphaned. They
+// are never read again, and are removed by the cleanup timeout of the wrapped
+// engine. Expire removes the chunks of the current value straight away.
+//
+// A value whose chunks are missing, having been evicted or removed by the
+// cleanup timeout before their manifest, or don't match its checksum is
+// removed when read, and reported as non-existent so that it is regenerated.
+//
+// Every value stored in the wrapped engine under the keys used is expected to
+// have been written through this engine.
+type Engine struct {
+	engine    common.Engine
+	chunkSize int
+}
+
+const (
+	// formatInline prefixes values stored whole under their key
+	formatInline = 0
+	// formatManifest prefixes the manifest of a chunked value
+	formatManifest = 1
+
+	// manifestHeaderLength is the length of the format, chunk count, total
+	// length and checksum starting a manifest, which is followed by its ID
+	manifestHeaderLength = 17
+
+	chunkSeparator = ":chunk:"
+)
+
+// NewChunkedStore creates a store on top of the given engine, splitting values
+// into chunks so that nothing larger than chunkSize bytes is stored in it.
+// Manifests take up to 32 bytes, so smaller chunk sizes aren't enforced.
+// Values chunked with another chunk size are treated as invalid.
+func NewChunkedStore(engine common.Engine, chunkSize int) *Engine {
+	return &Engine{
+		engine:    engine,
+		chunkSize: chunkSize,
+	}
+}
+
+// manifest describes the chunks of a value
+type manifest struct {
+	// id identifies the write, and is part of the key of every chunk
+	id       string
+	chunks   int
+	length   uint64
+	checksum uint32
+}
+
+// Exists checks to see if a key exists in the store. Only the manifest of a
+// chunked value is checked, a value whose chunks are missing is removed once
+// read.
+func (e *Engine) Exists(key string) bool {
+	return e.engine.Exists(key)
+}
+
+// Get retrieves data from the store based on key, if it exists, else it
+// returns an error. Chunked values are reassembled, and removed if their chunks
+// are missing or don't match the checksum of the value written.
+func (e *Engine) Get(key string) ([]byte, error) {
+	value, err := e.engine.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.decode(key, value)
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state,
+// reading them at once if the wrapped engine is a common.Fetcher. Chunked
+// values are reassembled like with Get.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	var entry common.Entry
+	var err error
+
+	if fetcher, ok := e.engine.(common.Fetcher); ok {
+		entry, err = fetcher.Fetch(key)
+	} else {
+		entry = common.Entry{Key: key, Locked: e.engine.IsLocked(key)}
+
+		entry.Data, err = e.engine.Get(key)
+		if err == nil && e.engine.IsExpired(key) {
+			// Only known to have passed
+			entry.Expires = time.Unix(0, 0)
+		}
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Data, err = e.decode(key, entry.Data)
+	return entry, err
+}
+
+// Put stores data against a key, splitting it into chunks unless it fits in
+// the chunk size along with its header
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	value, err := e.store(key, data, expires)
+	if err != nil {
+		return err
+	}
+
+	return e.engine.Put(key, value, expires)
+}
+
+// PutTagged stores data against a key, splitting it into chunks unless it
+// fits in the chunk size along with its header. Only the manifest is tagged,
+// as chunks are unreachable without it.
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	tagger, ok := e.engine.(common.Tagger)
+	if !ok {
+		return common.ErrNotSupported
+	}
+
+	value, err := e.store(key, data, expires)
+	if err != nil {
+		return err
+	}
+
+	return tagger.PutTagged(key, value, expires, tags)
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	return e.engine.IsExpired(key)
+}
+
+// Expire marks the key as expired, and removes it and its chunks from the
+// storage engine
+func (e *Engine) Expire(key string) error {
+	value, err := e.engine.Get(key)
+	if err == nil && len(value) > 0 && value[0] == formatManifest {
+		if m, err := decodeManifest(value, e.chunkSize); err == nil {
+			for i := 0; i < m.chunks; i++ {
+				// Chunks left behind are removed by the cleanup timeout
+				e.engine.Expire(chunkKey(key, m.id, i))
+			}
+		}
+	}
+
+	return e.engine.Expire(key)
+}
+
+// ExpireTag removes every key carrying the tag from the storage engine
+func (e *Engine) ExpireTag(tag string) error {
+	tagger, ok := e.engine.(common.Tagger)
+	if !ok {
+		return common.ErrNotSupported
+	}
+
+	return tagger.ExpireTag(tag)
+}
+
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	return e.engine.IsLocked(key)
+}
+
+// Lock sets a lock against the given key
+func (e *Engine) Lock(key string) error {
+	return e.engine.Lock(key)
+}
+
+// Unlock removes the lock from a given key, if it doesn't exist it returns an error
+func (e *Engine) Unlock(key string) error {
+	return e.engine.Unlock(key)
+}
+
+// Close closes the wrapped engine, if it can be closed
+func (e *Engine) Close() error {
+	if closer, ok := e.engine.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// decode returns the data of a value stored under key, reassembling it if it
+// is chunked. If the chunks are missing or invalid, the value is removed and
+// common.ErrNonExistentKey returned.
+func (e *Engine) decode(key string, value []byte) ([]byte, error) {
+	if len(value) > 0 && value[0] == formatInline {
+		return value[1:], nil
+	}
+
+	data, err := e.reassemble(key, value)
+	if err == common.ErrNonExistentKey || err == common.ErrInvalidData {
+		// Chunks left behind are removed by the cleanup timeout
+		e.Expire(key)
+		return nil, common.ErrNonExistentKey
+	}
+
+	return data, err
+}
+
+// reassemble reads the chunks of the manifest, and returns them joined if they
+// match its length and checksum
+func (e *Engine) reassemble(key string, value []byte) ([]byte, error) {
+	m, err := decodeManifest(value, e.chunkSize)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks, err := e.getChunks(key, m)
+	if err != nil {
+		return nil, err
+	}
+
+	var length uint64
+	for _, chunk := range chunks {
+		length += uint64(len(chunk))
+	}
+
+	if length != m.length {
+		return nil, common.ErrInvalidData
+	}
+
+	data := make([]byte, 0, length)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+
+	if crc32.ChecksumIEEE(data) != m.checksum {
+		return nil, common.ErrInvalidData
+	}
+
+	return data, nil
+}
+
+// store writes the chunks of data too large to be stored inline, and returns
+// the value to store under the key
+func (e *Engine) store(key string, data []byte, expires time.Time) ([]byte, error) {
+	if e.chunkSize <= 0 || len(data) < e.chunkSize {
+		return append([]byte{formatInline}, data...), nil
+	}
+
+	m := manifest{
+		id:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		chunks:   (len(data) + e.chunkSize - 1) / e.chunkSize,
+		length:   uint64(len(data)),
+		checksum: crc32.ChecksumIEEE(data),
+	}
+
+	for i := 0; i < m.chunks; i++ {
+		end := (i + 1) * e.chunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+
+		err := e.engine.Put(chunkKey(key, m.id, i), data[i*e.chunkSize:end], expires)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return encodeManifest(m), nil
+}
+
+// getChunks reads the chunks of a value, in a single round trip if the wrapped
+// engine can get many keys at once. Missing chunks, such as chunks removed by
+// the cleanup timeout, make the value non-existent.
+func (e *Engine) getChunks(key string, m manifest) ([][]byte, error) {
+	keys := make([]string, m.chunks)
+	for i := range keys {
+		keys[i] = chunkKey(key, m.id, i)
+	}
+
+	chunks := make([][]byte, m.chunks)
+
+	if multiGetter, ok := e.engine.(common.MultiGetter); ok {
+		found, err := multiGetter.GetMulti(keys)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, k := range keys {
+			chunk, ok := found[k]
+			if !ok {
+				return nil, common.ErrNonExistentKey
+			}
+
+			chunks[i] = chunk
+		}
+
+		return chunks, nil
+	}
+
+	for i, k := range keys {
+		chunk, err := e.engine.Get(k)
+		if err != nil && !e.engine.Exists(k) {
+			// Engines report misses with errors of their own
+			return nil, common.ErrNonExistentKey
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		chunks[i] = chunk
+	}
+
+	return chunks, nil
+}
+
+// chunkKey returns the key of a chunk of the write identified by id
+func chunkKey(key string, id string, i int) string {
+	return key + chunkSeparator + id + ":" + strconv.Itoa(i)
+}
+
+// encodeManifest returns the format byte, followed by the chunk count, total
+// length and checksum, big endian, and the ID
+func encodeManifest(m manifest) []byte {
+	value := make([]byte, manifestHeaderLength+len(m.id))
+	value[0] = formatManifest
+	binary.BigEndian.PutUint32(value[1:], uint32(m.chunks))
+	binary.BigEndian.PutUint64(value[5:], m.length)
+	binary.BigEndian.PutUint32(value[13:], m.checksum)
+	copy(value[manifestHeaderLength:], m.id)
+
+	return value
+}
+
+// decodeManifest parses a manifest written by encodeManifest with the given
+// chunk size. The chunk count must be that of the length split into chunks of
+// that size, so that a corrupt manifest can't cause large allocations.
+func decodeManifest(value []byte, chunkSize int) (manifest, error) {
+	if len(value) <= manifestHeaderLength || value[0] != formatManifest || chunkSize <= 0 {
+		return manifest{}, common.ErrInvalidData
+	}
+
+	m := manifest{
+		chunks:   int(binary.BigEndian.Uint32(value[1:])),
+		length:   binary.BigEndian.Uint64(value[5:]),
+		checksum: binary.BigEndian.Uint32(value[13:]),
+		id:       string(value[manifestHeaderLength:]),
+	}
+
+	size := uint64(chunkSize)
+	if m.length == 0 || uint64(m.chunks) != (m.length-1)/size+1 {
+		return manifest{}, common.ErrInvalidData
+	}
+
+	return m, nil
+}
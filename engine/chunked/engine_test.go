@@ -0,0 +1,209 @@
+package chunked
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/fresh8/go-cache/engine/memory"
+)
+
+func TestChunked_PutGet(t *testing.T) {
+	memStore := memory.NewMemoryStore(time.Minute, time.Hour)
+	defer memStore.Close()
+
+	store := NewChunkedStore(memStore, 32)
+
+	for _, content := range [][]byte{[]byte("small"), bytes.Repeat([]byte("large"), 18)} {
+		err := store.Put("key", content, time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		data, err := store.Get("key")
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		if !bytes.Equal(data, content) {
+			t.Fatalf("%s expected, %s given", content, data)
+		}
+	}
+
+	keys, _, err := memStore.Scan("", "key", 0)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// The manifest and 3 chunks
+	if len(keys) != 4 {
+		t.Fatalf("4 keys expected, %v given", keys)
+	}
+
+	for _, key := range keys {
+		value, _ := memStore.Get(key)
+		if len(value) > 32 {
+			t.Fatalf("nothing larger than the chunk size should be stored, %d bytes given", len(value))
+		}
+	}
+
+	err = store.Expire("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	keys, _, _ = memStore.Scan("", "key", 0)
+	if len(keys) != 0 {
+		t.Fatalf("the chunks should have been removed, %v given", keys)
+	}
+}
+
+func TestChunked_InvalidChunks(t *testing.T) {
+	memStore := memory.NewMemoryStore(time.Minute, time.Hour)
+	defer memStore.Close()
+
+	store := NewChunkedStore(memStore, 32)
+	store.Put("key", bytes.Repeat([]byte("large"), 18), time.Now().Add(time.Hour))
+
+	keys, _, _ := memStore.Scan("", "key"+chunkSeparator, 0)
+	for _, key := range keys {
+		if strings.HasSuffix(key, ":1") {
+			memStore.Put(key, []byte("corrupted!"), time.Now().Add(time.Hour))
+		}
+	}
+
+	// Invalid values are reported as missing, and removed along with their
+	// chunks
+	_, err := store.Get("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+
+	left, _, _ := memStore.Scan("", "key", 0)
+	if len(left) != 0 {
+		t.Fatalf("the value and its chunks should have been removed, %v given", left)
+	}
+
+	store.Put("key", bytes.Repeat([]byte("large"), 18), time.Now().Add(time.Hour))
+
+	keys, _, _ = memStore.Scan("", "key"+chunkSeparator, 0)
+	memStore.Expire(keys[0])
+
+	if !store.Exists("key") {
+		t.Fatal("only the manifest should be checked for existence")
+	}
+
+	// Engines which aren't Fetchers are read key by key
+	fetcher := NewChunkedStore(struct{ common.Engine }{memStore}, 32)
+
+	_, err = fetcher.Fetch("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+
+	if store.Exists("key") {
+		t.Fatal("values with missing chunks should have been removed")
+	}
+}
+
+// errMiss is the miss error of missEngine
+var errMiss = errors.New("miss")
+
+// missEngine reports misses with an error of its own, as some engines do
+type missEngine struct {
+	common.Engine
+}
+
+func (e missEngine) Get(key string) ([]byte, error) {
+	data, err := e.Engine.Get(key)
+	if err == common.ErrNonExistentKey {
+		return nil, errMiss
+	}
+
+	return data, err
+}
+
+func TestChunked_MissingChunkError(t *testing.T) {
+	memStore := memory.NewMemoryStore(time.Minute, time.Hour)
+	defer memStore.Close()
+
+	store := NewChunkedStore(missEngine{memStore}, 32)
+	store.Put("key", bytes.Repeat([]byte("large"), 18), time.Now().Add(time.Hour))
+
+	keys, _, _ := memStore.Scan("", "key"+chunkSeparator, 0)
+	memStore.Expire(keys[1])
+
+	_, err := store.Get("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+
+	if store.Exists("key") {
+		t.Fatal("values with missing chunks should have been removed")
+	}
+}
+
+func TestChunked_Fetch(t *testing.T) {
+	memStore := memory.NewMemoryStore(time.Minute, time.Hour)
+	defer memStore.Close()
+
+	store := NewChunkedStore(struct{ common.Engine }{memStore}, 32)
+	content := bytes.Repeat([]byte("large"), 18)
+
+	store.Put("key", content, time.Now().Add(time.Hour))
+	store.Lock("key")
+
+	entry, err := store.Fetch("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !bytes.Equal(entry.Data, content) || !entry.Expires.IsZero() || !entry.Locked {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	store.Put("key", content, time.Now().Add(-time.Minute))
+
+	entry, err = store.Fetch("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if entry.Expires.IsZero() || time.Now().Before(entry.Expires) {
+		t.Fatalf("the entry should be stale, %+v given", entry)
+	}
+
+	_, err = store.Fetch("missing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestChunked_InvalidManifest(t *testing.T) {
+	m := manifest{id: "id", chunks: 3, length: 90, checksum: 1}
+
+	_, err := decodeManifest(encodeManifest(m), 32)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	for _, invalid := range []manifest{
+		{id: "id", chunks: 1 << 30, length: 90},
+		{id: "id", chunks: 3, length: 1 << 62},
+		{id: "id", chunks: 0, length: 0},
+	} {
+		_, err := decodeManifest(encodeManifest(invalid), 32)
+		if err != common.ErrInvalidData {
+			t.Fatalf("%s expected for %+v, %v given", common.ErrInvalidData, invalid, err)
+		}
+	}
+
+	// Written with another chunk size
+	_, err = decodeManifest(encodeManifest(m), 64)
+	if err != common.ErrInvalidData {
+		t.Fatalf("%s expected, %v given", common.ErrInvalidData, err)
+	}
+}
@@ -8,7 +8,9 @@ import (
 	"time"
 )
 
-// Engine is the interface all caching engines must adhere to
+// Engine is the interface all caching engines must adhere to. Engines holding
+// resources such as background goroutines, pools or clients also implement
+// io.Closer, which cachers call when they are closed.
 type Engine interface {
 	Exists(string) bool
 	Get(string) ([]byte, error)
@@ -22,10 +24,62 @@ type Engine interface {
 	IsLocked(string) bool
 }
 
+// Tagger is implemented by engines that can associate keys with tags, so that
+// every key carrying a tag can be invalidated at once
+type Tagger interface {
+	PutTagged(string, []byte, time.Time, []string) error
+	ExpireTag(string) error
+}
+
+// PrefixDeleter is implemented by engines that can remove every key starting
+// with a prefix or matching a glob pattern (see MatchGlob). The progress
+// function, if not nil, is called after each batch with the running total of
+// removed keys, and the final total is returned.
+type PrefixDeleter interface {
+	DeletePrefix(string, func(int)) (int, error)
+	DeleteMatching(string, func(int)) (int, error)
+}
+
+// Entry is a single cache entry along with its metadata
+type Entry struct {
+	Key     string
+	Data    []byte
+	Expires time.Time
+	Locked  bool
+}
+
+// Scanner is implemented by engines that can list the keys they hold. Scans
+// are paged using an opaque cursor: an empty cursor starts a new scan, and an
+// empty cursor is returned once the scan is complete. A page may hold fewer
+// keys than requested, or none at all, before the scan is complete.
+type Scanner interface {
+	Scan(cursor string, prefix string, count int) ([]string, string, error)
+	ScanEntries(cursor string, prefix string, count int) ([]Entry, string, error)
+}
+
+// Fetcher is implemented by engines that can read the data of a key along
+// with its expiry time and lock state at once, rather than in a round trip
+// each. If the key doesn't exist ErrNonExistentKey is returned, with the lock
+// state still set on the entry. A zero Expires means the expiry is unknown, and
+// the entry is treated as fresh.
+type Fetcher interface {
+	Fetch(string) (Entry, error)
+}
+
+// MultiGetter is implemented by engines that can retrieve the data of many
+// keys at once, in fewer round trips than a Get each. Keys that don't exist
+// are left out of the returned map.
+type MultiGetter interface {
+	GetMulti([]string) (map[string][]byte, error)
+}
+
 // Errors
 var (
 	ErrNonExistentKey   = errors.New("non-existent key")
 	ErrKeyAlreadyLocked = errors.New("key already locked")
 	ErrInvalidData      = errors.New("invalid data")
 	ErrEngineLocked     = errors.New("data is being regenerated by another process")
+	ErrNotSupported     = errors.New("operation not supported by engine")
+	ErrInvalidCursor    = errors.New("invalid scan cursor")
+	ErrLockNotHeld      = errors.New("lock no longer held")
 )
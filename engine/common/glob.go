@@ -0,0 +1,116 @@
+package common
+
+import (
+	"bytes"
+	"strings"
+)
+
+// MatchGlob reports whether the key matches the Redis style glob pattern.
+// Supported are * and ? wildcards, [abc], [^abc] and [a-z] classes, and
+// backslash escaping.
+func MatchGlob(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if MatchGlob(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+
+			end := strings.IndexByte(pattern[1:], ']')
+			if end < 0 {
+				// Unterminated classes are matched literally
+				if key[0] != '[' {
+					return false
+				}
+				key = key[1:]
+				pattern = pattern[1:]
+				continue
+			}
+
+			class := pattern[1 : end+1]
+			if !matchClass(class, key[0]) {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[end+2:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		}
+	}
+
+	return len(key) == 0
+}
+
+// EscapeGlob escapes any glob special characters in s, so it is matched literally
+func EscapeGlob(s string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
+
+// matchClass checks a single character against the contents of a [...] class
+func matchClass(class string, c byte) bool {
+	negate := false
+	if len(class) > 0 && class[0] == '^' {
+		negate = true
+		class = class[1:]
+	}
+
+	match := false
+	for i := 0; i < len(class); i++ {
+		if class[i] == '\\' && i+1 < len(class) {
+			i++
+			if class[i] == c {
+				match = true
+			}
+		} else if i+2 < len(class) && class[i+1] == '-' {
+			low, high := class[i], class[i+2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				match = true
+			}
+			i += 2
+		} else if class[i] == c {
+			match = true
+		}
+	}
+
+	return match != negate
+}
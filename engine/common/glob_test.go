@@ -0,0 +1,50 @@
+package common
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"search:*", "search:shoes", true},
+		{"search:*", "search:", true},
+		{"search:*", "product:1", false},
+		{"*:1", "product:1", true},
+		{"product:?", "product:1", true},
+		{"product:?", "product:10", false},
+		{"product:[0-4]", "product:3", true},
+		{"product:[0-4]", "product:7", false},
+		{"product:[^0-4]", "product:7", true},
+		{"product:[abc]", "product:b", true},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+		{"**", "anything", true},
+		{"", "", true},
+		{"", "a", false},
+	}
+
+	for _, test := range tests {
+		if MatchGlob(test.pattern, test.key) != test.match {
+			t.Fatalf("%s matching %s should be %t", test.pattern, test.key, test.match)
+		}
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	prefix := "a*b?[c]\\"
+
+	escaped := EscapeGlob(prefix)
+	if escaped != "a\\*b\\?\\[c\\]\\\\" {
+		t.Fatalf("unexpected escaped prefix %s", escaped)
+	}
+
+	if !MatchGlob(escaped+"*", prefix+"suffix") {
+		t.Fatal("escaped prefix should match itself literally")
+	}
+
+	if MatchGlob(escaped+"*", "axb?[c]\\suffix") {
+		t.Fatal("escaped prefix should not match wildcards")
+	}
+}
@@ -0,0 +1,103 @@
+package common
+
+// KeyIterator walks every key held by a Scanner, fetching a page at a time
+type KeyIterator struct {
+	scanner Scanner
+	prefix  string
+	count   int
+
+	cursor string
+	keys   []string
+	key    string
+	done   bool
+	err    error
+}
+
+// NewKeyIterator creates an iterator over the keys starting with prefix,
+// fetching count keys per page
+func NewKeyIterator(scanner Scanner, prefix string, count int) *KeyIterator {
+	return &KeyIterator{
+		scanner: scanner,
+		prefix:  prefix,
+		count:   count,
+	}
+}
+
+// Next advances the iterator, returning false once all keys have been read or
+// an error occurred
+func (it *KeyIterator) Next() bool {
+	for len(it.keys) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+
+		it.keys, it.cursor, it.err = it.scanner.Scan(it.cursor, it.prefix, it.count)
+		it.done = it.cursor == ""
+	}
+
+	it.key = it.keys[0]
+	it.keys = it.keys[1:]
+
+	return true
+}
+
+// Key returns the current key
+func (it *KeyIterator) Key() string {
+	return it.key
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *KeyIterator) Err() error {
+	return it.err
+}
+
+// EntryIterator walks every entry held by a Scanner, fetching a page at a time
+type EntryIterator struct {
+	scanner Scanner
+	prefix  string
+	count   int
+
+	cursor  string
+	entries []Entry
+	entry   Entry
+	done    bool
+	err     error
+}
+
+// NewEntryIterator creates an iterator over the entries whose key starts with
+// prefix, fetching count entries per page
+func NewEntryIterator(scanner Scanner, prefix string, count int) *EntryIterator {
+	return &EntryIterator{
+		scanner: scanner,
+		prefix:  prefix,
+		count:   count,
+	}
+}
+
+// Next advances the iterator, returning false once all entries have been read
+// or an error occurred
+func (it *EntryIterator) Next() bool {
+	for len(it.entries) == 0 {
+		if it.done || it.err != nil {
+			return false
+		}
+
+		it.entries, it.cursor, it.err = it.scanner.ScanEntries(it.cursor, it.prefix, it.count)
+		it.done = it.cursor == ""
+	}
+
+	it.entry = it.entries[0]
+	it.entries = it.entries[1:]
+
+	return true
+}
+
+// Entry returns the current entry
+func (it *EntryIterator) Entry() Entry {
+	return it.entry
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *EntryIterator) Err() error {
+	return it.err
+}
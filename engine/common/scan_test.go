@@ -0,0 +1,87 @@
+package common
+
+import (
+	"errors"
+	"testing"
+)
+
+// pagedScanner returns a fixed set of pages, using the page number as cursor
+type pagedScanner struct {
+	pages [][]string
+	err   error
+}
+
+func (s pagedScanner) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	page := 0
+	if cursor != "" {
+		page = int(cursor[0] - '0')
+	}
+
+	if page == len(s.pages)-1 {
+		return s.pages[page], "", s.err
+	}
+
+	return s.pages[page], string('0' + byte(page+1)), nil
+}
+
+func (s pagedScanner) ScanEntries(cursor string, prefix string, count int) ([]Entry, string, error) {
+	keys, next, err := s.Scan(cursor, prefix, count)
+
+	var entries []Entry
+	for _, key := range keys {
+		entries = append(entries, Entry{Key: key})
+	}
+
+	return entries, next, err
+}
+
+func TestKeyIterator(t *testing.T) {
+	scanner := pagedScanner{
+		pages: [][]string{{"a", "b"}, {}, {"c"}},
+	}
+
+	var keys []string
+	it := NewKeyIterator(scanner, "", 2)
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	if it.Err() != nil {
+		t.Fatalf("no error expected, %s given", it.Err())
+	}
+
+	if len(keys) != 3 || keys[0] != "a" || keys[2] != "c" {
+		t.Fatalf("all keys should be iterated in order, %v given", keys)
+	}
+
+	expectedErr := errors.New("random error")
+	scanner.err = expectedErr
+
+	it = NewKeyIterator(scanner, "", 2)
+	for it.Next() {
+	}
+
+	if it.Err() != expectedErr {
+		t.Fatalf("random error expected, %s given", it.Err())
+	}
+}
+
+func TestEntryIterator(t *testing.T) {
+	scanner := pagedScanner{
+		pages: [][]string{{"a"}, {"b"}},
+	}
+
+	var keys []string
+	it := NewEntryIterator(scanner, "", 1)
+	for it.Next() {
+		keys = append(keys, it.Entry().Key)
+	}
+
+	if it.Err() != nil {
+		t.Fatalf("no error expected, %s given", it.Err())
+	}
+
+	if len(keys) != 2 || keys[1] != "b" {
+		t.Fatalf("all entries should be iterated in order, %v given", keys)
+	}
+}
@@ -0,0 +1,411 @@
+// Package filesystem is a storage engine keeping each entry in a file of its
+// own, for values too large to hold in memory or in Redis, such as rendered
+// images or reports. It uses flock(2), so it runs on Unix-like systems only.
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// Engine stores entries as files under a directory, with the same semantics as
+// the memory engine: an entry stays available once it has expired, so that
+// stale data can be served while it is regenerated, until cleanupTimeout after
+// it was stored.
+//
+// The directory can be shared by several processes on the same host. Entries
+// are written to a temporary file which is then renamed into place, so readers
+// see either the previous or the new entry in full, and locks are flock(2)
+// locks seen by every process.
+//
+// Each entry is stored under entries/ab/cd/<hash>, where hash is the SHA-256
+// of the key and ab and cd its first bytes, so that no directory grows too
+// large to list.
+type Engine struct {
+	dir            string
+	expirePoll     time.Duration
+	cleanupTimeout time.Duration
+	maxSize        int64
+
+	locksLock sync.Mutex
+	locks     map[string]*os.File
+
+	// done is closed by Close to stop the background goroutine
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Option configures optional behaviour of the filesystem engine
+type Option func(*Engine)
+
+// MaxSize caps the total size of the entry files, in bytes. Once hard expired
+// entries are removed, the entries stored the longest ago are removed until
+// the total size is within the cap. The cap is only enforced every expirePoll,
+// so the size can exceed it in between. It is not capped by default.
+func MaxSize(size int64) Option {
+	return func(e *Engine) {
+		e.maxSize = size
+	}
+}
+
+const (
+	// entriesDir holds the entry files
+	entriesDir = "entries"
+	// locksDir holds the lock files
+	locksDir = "locks"
+	// tmpDir holds the entry files being written
+	tmpDir = "tmp"
+)
+
+// staleTempAge is the age after which a temporary file is considered left
+// behind by a crashed write, and removed
+const staleTempAge = time.Hour
+
+// staleLockAge is the time after which a lock file which hasn't been locked or
+// unlocked since is removed
+const staleLockAge = time.Hour
+
+// NewFilesystemStore creates the directories used under dir if they don't
+// exist, and removes hard expired entries from it every expirePoll until
+// closed
+func NewFilesystemStore(dir string, expirePoll time.Duration, cleanupTimeout time.Duration, opts ...Option) (*Engine, error) {
+	e := &Engine{
+		dir:            dir,
+		expirePoll:     expirePoll,
+		cleanupTimeout: cleanupTimeout,
+		locks:          make(map[string]*os.File),
+		done:           make(chan struct{}),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	for _, name := range []string{entriesDir, locksDir, tmpDir} {
+		err := os.MkdirAll(filepath.Join(dir, name), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e.cleanupExpiredKeys()
+
+	return e, nil
+}
+
+// Exists checks to see if a key exists in the store
+func (e *Engine) Exists(key string) bool {
+	h, err := e.readHeader(key)
+	return err == nil && time.Now().Before(e.hardExpiry(h))
+}
+
+// Get retrieves data from the store based on key, if it exists, else it returns an error
+func (e *Engine) Get(key string) ([]byte, error) {
+	entry, err := e.Fetch(key)
+	return entry.Data, err
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state.
+// If the key doesn't exist common.ErrNonExistentKey is returned, along with the
+// lock state.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	entry := common.Entry{
+		Key:    key,
+		Locked: e.IsLocked(key),
+	}
+
+	f, err := os.Open(e.entryPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return entry, common.ErrNonExistentKey
+		}
+		return entry, err
+	}
+	defer f.Close()
+
+	h, err := readHeader(f)
+	if err != nil {
+		return entry, err
+	}
+
+	if h.key != key || !time.Now().Before(e.hardExpiry(h)) {
+		return entry, common.ErrNonExistentKey
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Data = data
+	entry.Expires = h.expires
+
+	return entry, nil
+}
+
+// Put stores data against a key, else it returns an error. The entry is
+// written to a temporary file first, then renamed over any existing entry.
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	f, err := ioutil.TempFile(filepath.Join(e.dir, tmpDir), "entry-")
+	if err != nil {
+		return err
+	}
+
+	err = e.write(f, header{key: key, expires: expires, storedAt: time.Now()}, data)
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	path := e.entryPath(key)
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	h, err := e.readHeader(key)
+	if err != nil {
+		return true
+	}
+
+	now := time.Now()
+	return !now.Before(e.hardExpiry(h)) || now.After(h.expires)
+}
+
+// Expire marks the key as expired, and removes it from the storage engine
+func (e *Engine) Expire(key string) error {
+	_, err := e.readHeader(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(e.entryPath(key))
+	if os.IsNotExist(err) {
+		return common.ErrNonExistentKey
+	}
+
+	return err
+}
+
+// Close stops removing hard expired keys, and releases the locks held by this
+// engine
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.releaseAll()
+	})
+
+	return nil
+}
+
+// hardExpiry returns when an entry with the given header is removed
+func (e *Engine) hardExpiry(h header) time.Time {
+	if e.cleanupTimeout <= 0 {
+		return h.expires
+	}
+
+	return h.storedAt.Add(e.cleanupTimeout)
+}
+
+// write writes an entry to f and closes it, syncing it to disk first so that
+// it can't be renamed into place before its contents are stored
+func (e *Engine) write(f *os.File, h header, data []byte) error {
+	_, err := f.Write(encodeHeader(h))
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// readHeader reads the header of the entry of a key. If there's no entry, or
+// the entry belongs to another key with the same hash, common.ErrNonExistentKey
+// is returned.
+func (e *Engine) readHeader(key string) (header, error) {
+	h, err := readHeaderFile(e.entryPath(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return header{}, common.ErrNonExistentKey
+		}
+		return header{}, err
+	}
+
+	if h.key != key {
+		return header{}, common.ErrNonExistentKey
+	}
+
+	return h, nil
+}
+
+// entryPath returns the path of the entry file of a key
+func (e *Engine) entryPath(key string) string {
+	return e.shardedPath(entriesDir, key)
+}
+
+// lockPath returns the path of the lock file of a key
+func (e *Engine) lockPath(key string) string {
+	return e.shardedPath(locksDir, key)
+}
+
+// shardedPath returns the path of the file of a key under the given directory
+func (e *Engine) shardedPath(dir string, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+
+	return filepath.Join(e.dir, dir, name[:2], name[2:4], name)
+}
+
+// cleanupExpiredKeys removes hard expired keys every expirePoll, until the
+// engine is closed
+func (e *Engine) cleanupExpiredKeys() {
+	if e.expirePoll <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.expirePoll)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.sweep()
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// storedFile is an entry file kept by a sweep
+type storedFile struct {
+	path     string
+	size     int64
+	storedAt time.Time
+}
+
+// sweep removes hard expired and unreadable entries, temporary files left
+// behind by crashed writes and stale lock files which aren't locked. If the
+// total size of the remaining entries exceeds the cap, the entries stored the
+// longest ago are removed until it doesn't.
+func (e *Engine) sweep() error {
+	now := time.Now()
+
+	var kept []storedFile
+	var size int64
+
+	err := filepath.Walk(filepath.Join(e.dir, entriesDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		h, err := readHeaderFile(path)
+		if os.IsNotExist(err) {
+			// Removed since the directory was listed
+			return nil
+		}
+
+		if err != nil || !now.Before(e.hardExpiry(h)) {
+			os.Remove(path)
+			return nil
+		}
+
+		kept = append(kept, storedFile{path: path, size: info.Size(), storedAt: h.storedAt})
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if e.maxSize > 0 && size > e.maxSize {
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].storedAt.Before(kept[j].storedAt)
+		})
+
+		for _, f := range kept {
+			if size <= e.maxSize {
+				break
+			}
+
+			err = os.Remove(f.path)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			size -= f.size
+		}
+	}
+
+	temps, err := ioutil.ReadDir(filepath.Join(e.dir, tmpDir))
+	if err != nil {
+		return err
+	}
+
+	for _, info := range temps {
+		if now.Sub(info.ModTime()) > staleTempAge {
+			os.Remove(filepath.Join(e.dir, tmpDir, info.Name()))
+		}
+	}
+
+	// Lock files are written to when locked and unlocked, so those of keys
+	// locked recently are left alone
+	return filepath.Walk(filepath.Join(e.dir, locksDir), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || now.Sub(info.ModTime()) <= staleLockAge {
+			return nil
+		}
+
+		return removeLockFile(path)
+	})
+}
+
+// readHeaderFile reads the header of the entry file at path
+func readHeaderFile(path string) (header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return header{}, err
+	}
+	defer f.Close()
+
+	return readHeader(f)
+}
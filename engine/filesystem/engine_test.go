@@ -0,0 +1,259 @@
+package filesystem
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// newTestStore creates a store in a new directory, which the caller removes
+func newTestStore(t *testing.T, opts ...Option) (*Engine, string) {
+	dir, err := ioutil.TempDir("", "go-cache-filesystem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	engine, err := NewFilesystemStore(dir, time.Hour, time.Hour, opts...)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return engine, dir
+}
+
+func TestFilesystemEngine_PutGet(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	content := []byte("hello")
+	expires := time.Now().Add(time.Hour)
+
+	err := engine.Put("key", []byte("previous"), expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// Puts replace the existing entry
+	err = engine.Put("key", content, expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !engine.Exists("key") || engine.IsExpired("key") {
+		t.Fatal("key should exist and be fresh")
+	}
+
+	entry, err := engine.Fetch("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !bytes.Equal(entry.Data, content) || !entry.Expires.Equal(expires) {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	temps, _ := ioutil.ReadDir(filepath.Join(dir, tmpDir))
+	if len(temps) != 0 {
+		t.Fatalf("temporary files should have been renamed, %d left", len(temps))
+	}
+
+	err = engine.Expire("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	_, err = engine.Get("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+
+	err = engine.Expire("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestFilesystemEngine_HashCollision(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+
+	// Move the entry to where another key's would be
+	os.MkdirAll(filepath.Dir(engine.entryPath("other")), 0700)
+	os.Rename(engine.entryPath("key"), engine.entryPath("other"))
+
+	if engine.Exists("other") {
+		t.Fatal("entries of other keys shouldn't be returned")
+	}
+
+	_, err := engine.Get("other")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestFilesystemEngine_Sweep(t *testing.T) {
+	engine, dir := newTestStore(t, MaxSize(1024))
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	engine.Put("stale", []byte("hello"), time.Now().Add(-time.Minute))
+
+	if !engine.Exists("stale") || !engine.IsExpired("stale") {
+		t.Fatal("expired keys should stay available until the cleanup timeout")
+	}
+
+	engine.cleanupTimeout = time.Nanosecond
+	engine.Put("gone", []byte("hello"), time.Now().Add(-time.Minute))
+	time.Sleep(time.Millisecond)
+
+	if engine.Exists("gone") {
+		t.Fatal("hard expired keys shouldn't exist")
+	}
+
+	engine.cleanupTimeout = time.Hour
+
+	data := make([]byte, 400)
+	for _, key := range []string{"first", "second", "third"} {
+		engine.Put(key, data, time.Now().Add(time.Hour))
+		time.Sleep(time.Millisecond)
+	}
+
+	err := engine.sweep()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if _, err := os.Stat(engine.entryPath("gone")); !os.IsNotExist(err) {
+		t.Fatal("the files of hard expired keys should have been removed")
+	}
+
+	// The oldest entries are removed until the size is within the cap
+	if engine.Exists("stale") || engine.Exists("first") {
+		t.Fatal("the oldest entries should have been removed")
+	}
+
+	if !engine.Exists("second") || !engine.Exists("third") {
+		t.Fatal("the newest entries should have been kept")
+	}
+}
+
+func TestFilesystemEngine_Lock(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	// Another engine sharing the directory stands in for another process
+	other, err := NewFilesystemStore(dir, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if engine.IsLocked("key") {
+		t.Fatal("key shouldn't be locked")
+	}
+
+	err = engine.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !other.IsLocked("key") {
+		t.Fatal("the lock should be seen by other processes")
+	}
+
+	err = other.Lock("key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("%s expected, %v given", common.ErrKeyAlreadyLocked, err)
+	}
+
+	err = other.Unlock("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("only the holder should release the lock, %v given", err)
+	}
+
+	err = engine.Unlock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = other.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// Closing an engine releases its locks
+	other.Close()
+
+	if engine.IsLocked("key") {
+		t.Fatal("the lock should have been released")
+	}
+}
+
+func TestFilesystemEngine_LockFiles(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	// A lock file left behind by a holder which died
+	os.MkdirAll(filepath.Dir(engine.lockPath("dead")), 0700)
+	ioutil.WriteFile(engine.lockPath("dead"), []byte("12345"), 0600)
+
+	if engine.IsLocked("dead") {
+		t.Fatal("the lock of a holder which died shouldn't be held")
+	}
+
+	if info, err := os.Stat(engine.lockPath("dead")); err != nil || info.Size() != 0 {
+		t.Fatal("the process ID of the holder which died should have been cleared")
+	}
+
+	engine.Lock("held")
+	engine.Lock("stale")
+	engine.Unlock("stale")
+
+	old := time.Now().Add(-2 * staleLockAge)
+	for _, key := range []string{"dead", "held", "stale"} {
+		os.Chtimes(engine.lockPath(key), old, old)
+	}
+
+	err := engine.sweep()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	for _, key := range []string{"dead", "stale"} {
+		if _, err := os.Stat(engine.lockPath(key)); !os.IsNotExist(err) {
+			t.Fatalf("the stale lock file of %s should have been removed", key)
+		}
+	}
+
+	if _, err := os.Stat(engine.lockPath("held")); err != nil {
+		t.Fatal("the lock file of a held lock should have been kept")
+	}
+
+	// Another engine sharing the directory stands in for another process
+	other, err := NewFilesystemStore(dir, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if !other.IsLocked("held") || other.IsLocked("stale") {
+		t.Fatal("the lock states should be unchanged")
+	}
+
+	err = engine.Lock("stale")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+}
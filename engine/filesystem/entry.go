@@ -0,0 +1,82 @@
+package filesystem
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// An entry is stored in a file of its own, starting with a header
+//
+//	version    byte, 1
+//	expires    int64 Unix nanoseconds, big endian
+//	stored at  int64 Unix nanoseconds, big endian
+//	key        uint32 length, big endian, then the key
+//	data       the remaining bytes
+//
+// The key is kept so that entries can be told apart should two keys hash to
+// the same file name.
+
+// headerVersion is the version of the header format
+const headerVersion = 1
+
+// headerLength is the length of the header preceding the key
+const headerLength = 21
+
+// maxKeyLength caps the length of keys read back, so that a corrupt header
+// doesn't cause a huge allocation
+const maxKeyLength = 1 << 20
+
+// header is the metadata stored ahead of the data of an entry
+type header struct {
+	key      string
+	expires  time.Time
+	storedAt time.Time
+}
+
+// encodeHeader returns the stored form of the header
+func encodeHeader(h header) []byte {
+	b := make([]byte, headerLength+len(h.key))
+	b[0] = headerVersion
+	binary.BigEndian.PutUint64(b[1:], uint64(h.expires.UnixNano()))
+	binary.BigEndian.PutUint64(b[9:], uint64(h.storedAt.UnixNano()))
+	binary.BigEndian.PutUint32(b[17:], uint32(len(h.key)))
+	copy(b[headerLength:], h.key)
+
+	return b
+}
+
+// readHeader reads the header from the start of an entry, leaving r at the
+// start of the data
+func readHeader(r io.Reader) (header, error) {
+	b := make([]byte, headerLength)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return header{}, common.ErrInvalidData
+		}
+		return header{}, err
+	}
+
+	length := binary.BigEndian.Uint32(b[17:])
+	if b[0] != headerVersion || length > maxKeyLength {
+		return header{}, common.ErrInvalidData
+	}
+
+	key := make([]byte, length)
+	_, err = io.ReadFull(r, key)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return header{}, common.ErrInvalidData
+		}
+		return header{}, err
+	}
+
+	return header{
+		key:      string(key),
+		expires:  time.Unix(0, int64(binary.BigEndian.Uint64(b[1:]))),
+		storedAt: time.Unix(0, int64(binary.BigEndian.Uint64(b[9:]))),
+	}, nil
+}
@@ -0,0 +1,194 @@
+package filesystem
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// Locks are flock(2) locks on a lock file per key, so they are seen by every
+// process on the host sharing the directory, and are released by the kernel
+// should the process holding them die.
+//
+// The holder of a lock writes its process ID to the lock file, and truncates
+// it when unlocking, so that IsLocked can tell whether a key is locked without
+// taking a lock which would make a concurrent Lock fail. A lock file left with
+// a process ID by a holder which died is cleared by the next IsLocked.
+//
+// Lock files which haven't been locked for staleLockAge are removed by the
+// sweep, while it holds their lock. As a process may have opened a lock file
+// before it was removed, Lock checks that the file it locked is still in place.
+
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	e.locksLock.Lock()
+	_, held := e.locks[key]
+	e.locksLock.Unlock()
+
+	if held {
+		return true
+	}
+
+	path := e.lockPath(key)
+
+	info, err := os.Stat(path)
+	if err != nil || info.Size() == 0 {
+		return false
+	}
+
+	// The process ID may have been left behind by a holder which died, in
+	// which case the lock can be taken
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		return err == syscall.EWOULDBLOCK
+	}
+
+	f.Truncate(0)
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	return false
+}
+
+// Lock sets a lock against the given key, if it is already locked by this or
+// another process it returns common.ErrKeyAlreadyLocked
+func (e *Engine) Lock(key string) error {
+	e.locksLock.Lock()
+	defer e.locksLock.Unlock()
+
+	if _, held := e.locks[key]; held {
+		return common.ErrKeyAlreadyLocked
+	}
+
+	path := e.lockPath(key)
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+
+		err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			f.Close()
+			if err == syscall.EWOULDBLOCK {
+				return common.ErrKeyAlreadyLocked
+			}
+			return err
+		}
+
+		// The sweep removed the file before it was locked, so nobody else
+		// would see the lock
+		if !lockedInPlace(f, path) {
+			f.Close()
+			continue
+		}
+
+		err = f.Truncate(0)
+		if err == nil {
+			_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		e.locks[key] = f
+
+		return nil
+	}
+}
+
+// Unlock removes the lock from a given key. If this engine doesn't hold the
+// lock it returns common.ErrNonExistentKey.
+func (e *Engine) Unlock(key string) error {
+	e.locksLock.Lock()
+	f, held := e.locks[key]
+	delete(e.locks, key)
+	e.locksLock.Unlock()
+
+	if !held {
+		return common.ErrNonExistentKey
+	}
+
+	return release(f)
+}
+
+// releaseAll unlocks every key locked by this engine
+func (e *Engine) releaseAll() {
+	e.locksLock.Lock()
+	locks := e.locks
+	e.locks = make(map[string]*os.File)
+	e.locksLock.Unlock()
+
+	for _, f := range locks {
+		release(f)
+	}
+}
+
+// release clears the process ID from a lock file, and closes it which releases
+// the lock
+func release(f *os.File) error {
+	err := f.Truncate(0)
+
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// removeLockFile removes the lock file at path, unless it is locked
+func removeLockFile(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !lockedInPlace(f, path) {
+		return nil
+	}
+
+	return os.Remove(path)
+}
+
+// lockedInPlace checks that the locked file is still the one at path
+func lockedInPlace(f *os.File, path string) bool {
+	locked, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	current, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(locked, current)
+}
@@ -1,7 +1,15 @@
 package memcache
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fresh8/go-cache/engine/common"
@@ -12,6 +20,9 @@ type cl interface {
 	Get(string) (*memcache.Item, error)
 	Delete(string) error
 	Set(*memcache.Item) error
+	Add(*memcache.Item) error
+	CompareAndSwap(*memcache.Item) error
+	Increment(string, uint64) (uint64, error)
 }
 
 // Engine is the default Redis storage engine
@@ -20,11 +31,26 @@ type Engine struct {
 	client cl
 
 	cleanupTimeout time.Duration
+
+	// Tokens of the locks held by this engine, so that only the holder of a
+	// lock can release it
+	tokensLock sync.Mutex
+	tokens     map[string]string
 }
 
+// ErrConcurrentUpdate is returned when storing a key which another process
+// stored or expired while it was being written, in which case the other
+// process' write is kept
+var ErrConcurrentUpdate = errors.New("key updated concurrently")
+
 var (
-	expirePrefix = "expire:"
 	lockPrefix   = "lock:"
+	tagPrefix    = "tag:"
+	hashPrefix   = "hash:"
+	keymapPrefix = "keymap:"
+
+	// maxKeyLength is the longest key memcached accepts
+	maxKeyLength = 250
 )
 
 // NewMemcacheStore creates a new standard Memcached-backed store
@@ -33,115 +59,374 @@ func NewMemcacheStore(prefix string, client cl, cleanupTimeout time.Duration) *E
 		prefix:         prefix + ":",
 		client:         client,
 		cleanupTimeout: cleanupTimeout,
+		tokens:         make(map[string]string),
 	}
 }
 
 // Exists checks to see if a key exists in the store
 func (e *Engine) Exists(key string) bool {
-	_, err := e.client.Get(key)
+	_, err := e.get(key)
+	return err == nil
+}
 
+// Get retrieves data from the store based on key, if it exists, else it returns an error
+func (e *Engine) Get(key string) (data []byte, err error) {
+	entry, err := e.get(key)
 	if err != nil {
-		return false
+		return nil, err
 	}
 
-	return true
+	return entry.data, nil
 }
 
-// Get retrieves data from the store based on key, if it exists, else it returns an error
-func (e *Engine) Get(key string) (data []byte, err error) {
-	item, err := e.client.Get(key)
+// Put stores data against a key, else it returns an error. The data and its
+// expiry time are stored in a single item, so are written atomically, and only
+// if no other process stored the key in the meantime, in which case
+// ErrConcurrentUpdate is returned.
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	return e.PutTagged(key, data, expires, nil)
+}
 
-	if err == memcache.ErrCacheMiss {
-		err = common.ErrNonExistentKey
-		return
-	}
+// PutTagged stores data against a key, recording the current generation of
+// each tag alongside it. Bumping a tag generation with ExpireTag invalidates
+// every key stored against an older generation. Like Put, the key is only
+// stored if no other process stored it in the meantime.
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	itemKey := e.itemKey(key)
 
+	// The key is mapped before its data is stored, so that a stored item can
+	// always be mapped back until evicted
+	err := e.recordHashedKey(key)
 	if err != nil {
-		return
+		return err
 	}
 
-	data = item.Value
+	// The item is read first so that it is only replaced, using its CAS
+	// identifier, if it hasn't changed by the time the entry is written
+	current, err := e.client.Get(itemKey)
+	if err != nil && err != memcache.ErrCacheMiss {
+		return err
+	}
 
-	return
-}
+	var generations []string
+	for _, tag := range tags {
+		generation, err := e.tagGeneration(tag)
+		if err != nil {
+			return err
+		}
 
-// Put stores data against a key, else it returns an error
-func (e *Engine) Put(key string, data []byte, expires time.Time) error {
-	item := &memcache.Item{
-		Key:        key,
-		Value:      data,
-		Expiration: int32(e.cleanupTimeout.Seconds()),
+		generations = append(generations, fmt.Sprintf("%d %s", generation, tag))
 	}
 
-	expireString := strconv.Itoa(int(expires.Unix()))
-	expireItem := &memcache.Item{
-		Key:        expirePrefix + key,
-		Value:      []byte(expireString),
-		Expiration: int32(e.cleanupTimeout.Seconds()),
-	}
+	item := encodeEntry(itemKey, entry{
+		data:    data,
+		expires: expires,
+		tags:    strings.Join(generations, "\n"),
+	}, int32(e.cleanupTimeout.Seconds()))
 
-	err := e.client.Set(item)
-	if err != nil {
-		return err
+	if current == nil {
+		err = e.client.Add(item)
+	} else {
+		current.Value = item.Value
+		current.Flags = item.Flags
+		current.Expiration = item.Expiration
+
+		err = e.client.CompareAndSwap(current)
+	}
+	if err == memcache.ErrNotStored || err == memcache.ErrCASConflict || err == memcache.ErrCacheMiss {
+		return ErrConcurrentUpdate
 	}
 
-	return e.client.Set(expireItem)
+	return err
 }
 
 // IsExpired checks to see if the key has expired
 func (e *Engine) IsExpired(key string) bool {
-	item, err := e.client.Get(expirePrefix + key)
+	entry, err := e.get(key)
 	if err != nil {
 		return true
 	}
 
-	expiresInt, err := strconv.Atoi(string(item.Value))
+	return time.Now().Unix() > entry.expires.Unix()
+}
+
+// Expire marks the key as expired, as well as locks, and removes it from the storage engine
+func (e *Engine) Expire(key string) error {
+	err := e.client.Delete(e.itemKey(key))
 	if err != nil {
-		return true
+		return err
 	}
 
-	if time.Now().Unix() > int64(expiresInt) {
-		return true
+	e.tokensLock.Lock()
+	delete(e.tokens, key)
+	e.tokensLock.Unlock()
+
+	return e.deleteIfExists(lockPrefix + key)
+}
+
+// ExpireTag invalidates every key carrying the given tag by bumping its generation
+func (e *Engine) ExpireTag(tag string) error {
+	_, err := e.client.Increment(e.itemKey(tagPrefix+tag), 1)
+
+	// Nothing has been stored against the tag, or its generation was evicted
+	// in which case the keys are already invalid
+	if err == memcache.ErrCacheMiss {
+		return nil
 	}
 
-	return false
+	return err
 }
 
-// Expire marks the key as expired, as well as locks and expire keys, and removes it from the storage engine
-func (e *Engine) Expire(key string) error {
-	err := e.client.Delete(key)
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	_, err := e.client.Get(e.itemKey(lockPrefix + key))
+	return err == nil
+}
+
+// Lock sets a lock against the given key, if it is already locked it returns
+// common.ErrKeyAlreadyLocked. The lock is only added if it doesn't exist, and
+// expires after the cleanup timeout.
+func (e *Engine) Lock(key string) error {
+	token, err := newToken()
 	if err != nil {
 		return err
 	}
 
-	err = e.client.Delete(expirePrefix + key)
+	lockItem := &memcache.Item{
+		Key:        e.itemKey(lockPrefix + key),
+		Value:      []byte(token),
+		Expiration: int32(e.cleanupTimeout.Seconds() + 1),
+	}
+
+	err = e.client.Add(lockItem)
+	if err == memcache.ErrNotStored {
+		return common.ErrKeyAlreadyLocked
+	}
 	if err != nil {
 		return err
 	}
 
-	return e.Unlock(key)
+	e.tokensLock.Lock()
+	e.tokens[key] = token
+	e.tokensLock.Unlock()
+
+	return nil
 }
 
-// IsLocked checks to see if the key has been locked
-func (e *Engine) IsLocked(key string) bool {
-	return e.Exists(lockPrefix + key)
+// Unlock removes the lock from a given key. If this engine doesn't hold the
+// lock it returns common.ErrNonExistentKey, and if the lock expired or was
+// taken by another process since it returns common.ErrLockNotHeld.
+func (e *Engine) Unlock(key string) error {
+	e.tokensLock.Lock()
+	token, ok := e.tokens[key]
+	delete(e.tokens, key)
+	e.tokensLock.Unlock()
+
+	if !ok {
+		return common.ErrNonExistentKey
+	}
+
+	item, err := e.client.Get(e.itemKey(lockPrefix + key))
+	if err == memcache.ErrCacheMiss {
+		return common.ErrLockNotHeld
+	}
+	if err != nil {
+		return err
+	}
+
+	if string(item.Value) != token {
+		return common.ErrLockNotHeld
+	}
+
+	// memcached can't delete conditionally, but swapping in an item which
+	// has already expired removes the lock unless it changed since it was read
+	item.Expiration = -1
+
+	err = e.client.CompareAndSwap(item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrCacheMiss || err == memcache.ErrNotStored {
+		return common.ErrLockNotHeld
+	}
+
+	return err
 }
 
-// Lock sets a lock against the given key
-func (e *Engine) Lock(key string) error {
-	// Set expiration to cleanup timeout
-	diff := time.Now().Add(e.cleanupTimeout).Sub(time.Now())
+// get reads the entry of a key, returning common.ErrNonExistentKey if it
+// doesn't exist or one of its tags was expired
+func (e *Engine) get(key string) (entry, error) {
+	item, err := e.client.Get(e.itemKey(key))
+	if err == memcache.ErrCacheMiss {
+		return entry{}, common.ErrNonExistentKey
+	}
+	if err != nil {
+		return entry{}, err
+	}
 
-	lockItem := &memcache.Item{
-		Key:        lockPrefix + key,
-		Value:      []byte("true"),
-		Expiration: int32(diff.Seconds() + 1),
+	ent, err := decodeEntry(item)
+	if err != nil {
+		return entry{}, err
 	}
 
-	return e.client.Set(lockItem)
+	if !e.validTags(ent.tags) {
+		return entry{}, common.ErrNonExistentKey
+	}
+
+	return ent, nil
 }
 
-// Unlock removes the lock from a given key, if it doesn't exist it returns an error
-func (e *Engine) Unlock(key string) error {
-	return e.client.Delete(lockPrefix + key)
+// tagGeneration returns the current generation of a tag, initialising it if
+// it doesn't exist yet. Generations start from the current time rather than
+// zero, so that an evicted counter never revalidates old keys.
+func (e *Engine) tagGeneration(tag string) (uint64, error) {
+	for {
+		item, err := e.client.Get(e.itemKey(tagPrefix + tag))
+		if err == nil {
+			return strconv.ParseUint(string(item.Value), 10, 64)
+		}
+
+		if err != memcache.ErrCacheMiss {
+			return 0, err
+		}
+
+		generation := uint64(time.Now().UnixNano())
+		err = e.client.Add(&memcache.Item{
+			Key:   e.itemKey(tagPrefix + tag),
+			Value: []byte(strconv.FormatUint(generation, 10)),
+		})
+		if err == nil {
+			return generation, nil
+		}
+
+		// Another process initialised the tag first, read its generation
+		if err != memcache.ErrNotStored {
+			return 0, err
+		}
+	}
+}
+
+// validTags checks that none of the tag generations stored in an entry have
+// been expired since it was written
+func (e *Engine) validTags(tags string) bool {
+	if tags == "" {
+		return true
+	}
+
+	for _, line := range strings.Split(tags, "\n") {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			return false
+		}
+
+		generation, err := e.client.Get(e.itemKey(tagPrefix + parts[1]))
+		if err != nil || string(generation.Value) != parts[0] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// deleteIfExists deletes the item of a key, ignoring cache misses
+func (e *Engine) deleteIfExists(key string) error {
+	err := e.client.Delete(e.itemKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+
+	return err
+}
+
+// ItemKey returns the memcached key the data of a key is stored under. Keys
+// which memcached can't store, being too long or containing spaces or control
+// characters, are replaced by their hash.
+func (e *Engine) ItemKey(key string) string {
+	return e.itemKey(key)
+}
+
+// OriginalKey returns the key whose data is stored under the memcached key, as
+// returned by ItemKey, for debugging. The keys of hashed items are looked up in
+// the mapping stored alongside them, which may have been evicted.
+func (e *Engine) OriginalKey(itemKey string) (string, error) {
+	if !strings.HasPrefix(itemKey, e.prefix) {
+		return "", common.ErrNonExistentKey
+	}
+
+	key := itemKey[len(e.prefix):]
+	if !strings.HasPrefix(key, hashPrefix) {
+		return key, nil
+	}
+
+	item, err := e.client.Get(e.prefix + keymapPrefix + key[len(hashPrefix):])
+	if err == memcache.ErrCacheMiss {
+		return "", common.ErrNonExistentKey
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return string(item.Value), nil
+}
+
+// itemKey prefixes a key, hashing it if memcached can't store it as is
+func (e *Engine) itemKey(key string) string {
+	if validKey(e.prefix + key) {
+		return e.prefix + key
+	}
+
+	return e.prefix + hashPrefix + hashKey(key)
+}
+
+// recordHashedKey stores the key whose data is stored under a hash, so that
+// OriginalKey can map it back
+func (e *Engine) recordHashedKey(key string) error {
+	if validKey(e.prefix + key) {
+		return nil
+	}
+
+	return e.client.Set(&memcache.Item{
+		Key:        e.prefix + keymapPrefix + hashKey(key),
+		Value:      []byte(key),
+		Expiration: int32(e.cleanupTimeout.Seconds()),
+	})
+}
+
+// validKey checks that memcached accepts the key: at most 250 bytes, without
+// spaces or control characters
+func validKey(key string) bool {
+	if len(key) > maxKeyLength {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hashKey returns the hex encoded SHA-256 hash of the key
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random token identifying a lock holder
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// Close closes the client, if it can be closed
+func (e *Engine) Close() error {
+	if closer, ok := e.client.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
 }
@@ -0,0 +1,384 @@
+package memcache
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/rainycape/memcache"
+)
+
+// mockClient keeps items in memory, rejecting the keys memcached would
+type mockClient struct {
+	lock  sync.Mutex
+	items map[string]memcache.Item
+
+	// The version of each item, bumped on each write, and the version of each
+	// item read, standing in for CAS identifiers
+	versions map[string]int
+	reads    map[*memcache.Item]int
+
+	// afterGet, if not nil, is called after each read, standing in for
+	// another process writing in between
+	afterGet func(key string)
+
+	// setErr, if not nil, is returned by Set
+	setErr error
+}
+
+func newMockClient() *mockClient {
+	return &mockClient{
+		items:    make(map[string]memcache.Item),
+		versions: make(map[string]int),
+		reads:    make(map[*memcache.Item]int),
+	}
+}
+
+// store writes the item, which must be locked
+func (c *mockClient) store(item *memcache.Item) {
+	c.versions[item.Key]++
+
+	if item.Expiration < 0 {
+		delete(c.items, item.Key)
+		return
+	}
+
+	c.items[item.Key] = *item
+}
+
+func (c *mockClient) Get(key string) (*memcache.Item, error) {
+	if c.afterGet != nil {
+		defer c.afterGet(key)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !validKey(key) {
+		return nil, memcache.ErrMalformedKey
+	}
+
+	item, ok := c.items[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+
+	c.reads[&item] = c.versions[key]
+	return &item, nil
+}
+
+func (c *mockClient) Delete(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.items[key]; !ok {
+		return memcache.ErrCacheMiss
+	}
+
+	delete(c.items, key)
+	c.versions[key]++
+	return nil
+}
+
+func (c *mockClient) Set(item *memcache.Item) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !validKey(item.Key) {
+		return memcache.ErrMalformedKey
+	}
+
+	if c.setErr != nil {
+		return c.setErr
+	}
+
+	c.store(item)
+	return nil
+}
+
+func (c *mockClient) Add(item *memcache.Item) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.items[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+
+	c.store(item)
+	return nil
+}
+
+func (c *mockClient) CompareAndSwap(item *memcache.Item) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if _, ok := c.items[item.Key]; !ok {
+		return memcache.ErrCacheMiss
+	}
+
+	version, ok := c.reads[item]
+	if !ok || version != c.versions[item.Key] {
+		return memcache.ErrCASConflict
+	}
+
+	c.store(item)
+	return nil
+}
+
+func (c *mockClient) Increment(key string, delta uint64) (uint64, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	item, ok := c.items[key]
+	if !ok {
+		return 0, memcache.ErrCacheMiss
+	}
+
+	value, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	value += delta
+	item.Value = []byte(strconv.FormatUint(value, 10))
+	c.store(&item)
+
+	return value, nil
+}
+
+func TestMemcacheEngine_Prefix(t *testing.T) {
+	client := newMockClient()
+	engine := NewMemcacheStore("testing", client, time.Minute)
+
+	err := engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	for key := range client.items {
+		if !strings.HasPrefix(key, "testing:") {
+			t.Fatalf("every item should be prefixed, %s given", key)
+		}
+	}
+
+	other := NewMemcacheStore("other", client, time.Minute)
+	if other.Exists("key") {
+		t.Fatal("engines with different prefixes shouldn't share keys")
+	}
+}
+
+func TestMemcacheEngine_InvalidKeys(t *testing.T) {
+	client := newMockClient()
+	engine := NewMemcacheStore("testing", client, time.Minute)
+
+	keys := []string{"key with spaces", strings.Repeat("long", 100), "line\nbreak"}
+
+	for _, key := range keys {
+		err := engine.Put(key, []byte("hello"), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		data, err := engine.Get(key)
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("hello expected, %s given", data)
+		}
+
+		if engine.IsExpired(key) {
+			t.Fatal("key shouldn't have expired")
+		}
+
+		itemKey := engine.ItemKey(key)
+		if !validKey(itemKey) {
+			t.Fatalf("the item key should be valid, %q given", itemKey)
+		}
+
+		original, err := engine.OriginalKey(itemKey)
+		if err != nil || original != key {
+			t.Fatalf("%q expected, %q given", key, original)
+		}
+	}
+
+	original, err := engine.OriginalKey(engine.ItemKey("plain"))
+	if err != nil || original != "plain" {
+		t.Fatalf("plain expected, %q given", original)
+	}
+
+	_, err = engine.OriginalKey("testing:hash:unknown")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+
+	// The data of a key which can't be mapped back isn't stored
+	client.setErr = errors.New("server error")
+
+	err = engine.Put("unmapped key", []byte("hello"), time.Now().Add(time.Hour))
+	if err != client.setErr {
+		t.Fatalf("%s expected, %v given", client.setErr, err)
+	}
+
+	if engine.Exists("unmapped key") {
+		t.Fatal("the data shouldn't have been stored")
+	}
+}
+
+func TestMemcacheEngine_Put(t *testing.T) {
+	client := newMockClient()
+	engine := NewMemcacheStore("testing", client, time.Minute)
+
+	expires := time.Now().Add(time.Hour)
+
+	err := engine.PutTagged("key", []byte("hello"), expires, []string{"all"})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// Only the entry and the generation of its tag are stored
+	if len(client.items) != 2 {
+		t.Fatalf("the entry should be stored in a single item, %d items given", len(client.items))
+	}
+
+	data, err := engine.Get("key")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("hello expected, %s given", data)
+	}
+
+	if engine.IsExpired("key") {
+		t.Fatal("key shouldn't have expired")
+	}
+
+	client.Set(&memcache.Item{Key: "testing:legacy", Value: []byte("hello")})
+
+	if !engine.Exists("legacy") || !engine.IsExpired("legacy") {
+		t.Fatal("items without an expiry time should exist, expired")
+	}
+}
+
+func TestMemcacheEngine_PutConcurrent(t *testing.T) {
+	client := newMockClient()
+	engine := NewMemcacheStore("testing", client, time.Minute)
+	other := NewMemcacheStore("testing", client, time.Minute)
+
+	expires := time.Now().Add(time.Hour)
+
+	// Another process stores the key while it is being written, both when it
+	// exists and when it doesn't
+	for _, existing := range []bool{true, false} {
+		engine.Expire("key")
+		if existing {
+			engine.Put("key", []byte("previous"), expires)
+		}
+
+		client.afterGet = func(key string) {
+			if key == "testing:key" {
+				client.afterGet = nil
+				other.Put("key", []byte("winner"), expires)
+			}
+		}
+
+		err := engine.Put("key", []byte("loser"), expires)
+		if err != ErrConcurrentUpdate {
+			t.Fatalf("%s expected, %v given", ErrConcurrentUpdate, err)
+		}
+
+		data, err := engine.Get("key")
+		if err != nil || string(data) != "winner" {
+			t.Fatalf("the write of the other process should be kept, %s given", data)
+		}
+	}
+
+	// Without a concurrent write the key is replaced
+	err := engine.Put("key", []byte("hello"), expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	data, _ := engine.Get("key")
+	if string(data) != "hello" {
+		t.Fatalf("hello expected, %s given", data)
+	}
+}
+
+func TestMemcacheEngine_Lock(t *testing.T) {
+	client := newMockClient()
+	engine := NewMemcacheStore("testing", client, time.Minute)
+	other := NewMemcacheStore("testing", client, time.Minute)
+
+	err := engine.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = other.Lock("key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("%s expected, %v given", common.ErrKeyAlreadyLocked, err)
+	}
+
+	if !other.IsLocked("key") {
+		t.Fatal("the lock should be seen by other processes")
+	}
+
+	err = engine.Unlock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.IsLocked("key") {
+		t.Fatal("key should have been unlocked")
+	}
+
+	// The lock expires, and another process takes it
+	engine.Lock("key")
+	client.Delete("testing:lock:key")
+	other.Lock("key")
+
+	err = engine.Unlock("key")
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("%s expected, %v given", common.ErrLockNotHeld, err)
+	}
+
+	if !other.IsLocked("key") {
+		t.Fatal("the lock of the other process should have been kept")
+	}
+}
+
+func TestMemcacheEngine_ExpireTag(t *testing.T) {
+	client := newMockClient()
+	engine := NewMemcacheStore("test", client, time.Minute)
+
+	// Tags nothing was stored against can be expired
+	err := engine.ExpireTag("none")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	engine.PutTagged("first", []byte("1"), expires, []string{"all", "odd"})
+	engine.PutTagged("second", []byte("2"), expires, []string{"all"})
+
+	err = engine.ExpireTag("odd")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.Exists("first") || !engine.Exists("second") {
+		t.Fatal("only the keys carrying the tag should have been expired")
+	}
+
+	// Keys stored after the tag was expired carry its new generation
+	engine.PutTagged("first", []byte("1"), expires, []string{"all", "odd"})
+	if !engine.Exists("first") {
+		t.Fatal("the key should have been stored against the new generation")
+	}
+
+	// An evicted generation invalidates the keys carrying it
+	client.Delete(engine.itemKey(tagPrefix + "all"))
+
+	if engine.Exists("first") || engine.Exists("second") {
+		t.Fatal("keys carrying an evicted tag should be invalid")
+	}
+}
@@ -0,0 +1,69 @@
+package memcache
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/rainycape/memcache"
+)
+
+// entryFlags marks items holding an encoded entry, rather than the bare data
+// written by earlier versions alongside a separate expiry item
+const entryFlags = 1
+
+// entryHeaderLength is the length of the expiry time and tags length which
+// start an encoded entry
+const entryHeaderLength = 12
+
+// entry is the content of an item, stored in a single item so that writing it
+// is atomic
+type entry struct {
+	data    []byte
+	expires time.Time
+	// tags holds the tag generations of the entry, one "generation tag" per
+	// line
+	tags string
+}
+
+// encodeEntry returns the item storing the entry: its expiry time in Unix
+// seconds and the length of its tags, both big endian, followed by its tags
+// and its data
+func encodeEntry(key string, e entry, expiration int32) *memcache.Item {
+	value := make([]byte, entryHeaderLength+len(e.tags)+len(e.data))
+	binary.BigEndian.PutUint64(value, uint64(e.expires.Unix()))
+	binary.BigEndian.PutUint32(value[8:], uint32(len(e.tags)))
+	copy(value[entryHeaderLength:], e.tags)
+	copy(value[entryHeaderLength+len(e.tags):], e.data)
+
+	return &memcache.Item{
+		Key:        key,
+		Value:      value,
+		Flags:      entryFlags,
+		Expiration: expiration,
+	}
+}
+
+// decodeEntry returns the entry stored in the item. Items written by earlier
+// versions hold only the data, so are treated as expired.
+func decodeEntry(item *memcache.Item) (entry, error) {
+	if item.Flags != entryFlags {
+		return entry{data: item.Value, expires: time.Unix(0, 0)}, nil
+	}
+
+	if len(item.Value) < entryHeaderLength {
+		return entry{}, common.ErrInvalidData
+	}
+
+	expires := int64(binary.BigEndian.Uint64(item.Value))
+	tagsLength := int(binary.BigEndian.Uint32(item.Value[8:]))
+	if len(item.Value) < entryHeaderLength+tagsLength {
+		return entry{}, common.ErrInvalidData
+	}
+
+	return entry{
+		data:    item.Value[entryHeaderLength+tagsLength:],
+		expires: time.Unix(expires, 0),
+		tags:    string(item.Value[entryHeaderLength : entryHeaderLength+tagsLength]),
+	}, nil
+}
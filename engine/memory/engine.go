@@ -1,34 +1,171 @@
 package memory
 
 import (
+	"container/heap"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fresh8/go-cache/engine/common"
 )
 
-// Engine is the default memory storage engine
+// Engine is the default memory storage engine. Keys are spread over a number
+// of shards, each with its own lock, so that concurrent operations on
+// different keys rarely contend.
+//
+// Like the other engines, an entry stays available once it has expired, so
+// that stale data can be served while it is regenerated, until cleanupTimeout
+// after it was stored.
 type Engine struct {
-	store      map[string][]byte
-	expire     map[string]time.Time
-	locks      map[string]bool
-	expirePoll time.Duration
+	// evictions is updated atomically, and kept first for 64-bit alignment
+	evictions uint64
+
+	shards         []*shard
+	expirePoll     time.Duration
+	cleanupTimeout time.Duration
+
+	// done is closed by Close to stop the background goroutines
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+
+	// Snapshot file, see the Snapshot option
+	snapshotPath     string
+	snapshotInterval time.Duration
+	snapshotLock     sync.Mutex
+
+	maxEntries int
+	maxBytes   int64
+	policy     Policy
+	onEvict    func(key string, data []byte)
+
+	copyOnRead  bool
+	copyOnWrite bool
+
+	// The tag to keys index spans shards, so it is guarded separately. When
+	// both are needed, a shard lock is always taken before tagsLock.
+	tagsLock sync.Mutex
+	tags     map[string]map[string]struct{}
 }
 
-var (
-	storeLock sync.RWMutex
-	// TODO: Better name needed =|
-	locksLock sync.RWMutex
-)
+// Option configures optional behaviour of the memory engine
+type Option func(*Engine)
+
+// deleteBatchSize is the number of keys removed per lock acquisition when
+// deleting by prefix or pattern
+const deleteBatchSize = 1000
+
+// DefaultShards is the number of shards used unless configured with Shards
+const DefaultShards = 32
+
+// Shards sets the number of shards the keys are spread over
+func Shards(n int) Option {
+	return func(e *Engine) {
+		if n < 1 {
+			n = 1
+		}
+
+		e.shards = make([]*shard, n)
+	}
+}
+
+// MaxEntries bounds the number of entries held. Once full, entries are evicted
+// according to the eviction policy. The limit is split evenly over the shards,
+// so small limits are best combined with few shards.
+func MaxEntries(n int) Option {
+	return func(e *Engine) {
+		e.maxEntries = n
+	}
+}
+
+// MaxBytes bounds the total size of the entries held, i.e. their keys and data
+// plus a small fixed overhead per entry. Once full, entries are evicted
+// according to the eviction policy. The limit is split evenly over the shards.
+func MaxBytes(n int64) Option {
+	return func(e *Engine) {
+		e.maxBytes = n
+	}
+}
+
+// EvictionPolicy sets how entries are chosen for eviction once a bounded
+// engine is full, LRU by default
+func EvictionPolicy(policy Policy) Option {
+	return func(e *Engine) {
+		e.policy = policy
+	}
+}
+
+// OnEvict sets a function called with each entry evicted to respect the
+// limits. It isn't called for entries that expire or are removed.
+func OnEvict(fn func(key string, data []byte)) Option {
+	return func(e *Engine) {
+		e.onEvict = fn
+	}
+}
+
+// CopyOnRead sets whether Get returns a copy of the stored data, true by
+// default. Without copies reads don't allocate, but callers must not modify the
+// data returned.
+func CopyOnRead(enabled bool) Option {
+	return func(e *Engine) {
+		e.copyOnRead = enabled
+	}
+}
 
-// NewMemoryStore creates a new standard in memory store
-func NewMemoryStore(expirePoll time.Duration) *Engine {
+// CopyOnWrite sets whether Put stores a copy of the data given, true by
+// default. Without copies writes don't allocate, but callers must not modify
+// the data once stored.
+func CopyOnWrite(enabled bool) Option {
+	return func(e *Engine) {
+		e.copyOnWrite = enabled
+	}
+}
+
+// Stats describes the contents of the memory engine
+type Stats struct {
+	// Entries is the number of entries held, including stale ones
+	Entries int
+	// Bytes is the accounted size of the entries held, including per entry
+	// overhead, as limited by MaxBytes
+	Bytes int64
+	// Evictions is the number of entries evicted to respect the limits
+	Evictions uint64
+}
+
+// NewMemoryStore creates a new standard in memory store. Entries are removed
+// cleanupTimeout after they are stored, or as soon as they expire if
+// cleanupTimeout is 0, and the store is checked for such entries every
+// expirePoll.
+func NewMemoryStore(expirePoll time.Duration, cleanupTimeout time.Duration, opts ...Option) *Engine {
 	e := &Engine{
-		store:      make(map[string][]byte),
-		locks:      make(map[string]bool),
-		expire:     make(map[string]time.Time),
-		expirePoll: expirePoll,
+		shards:         make([]*shard, DefaultShards),
+		tags:           make(map[string]map[string]struct{}),
+		expirePoll:     expirePoll,
+		cleanupTimeout: cleanupTimeout,
+		done:           make(chan struct{}),
+		copyOnRead:     true,
+		copyOnWrite:    true,
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	maxEntries := perShard(int64(e.maxEntries), len(e.shards))
+	maxBytes := perShard(e.maxBytes, len(e.shards))
+	for i := range e.shards {
+		e.shards[i] = newShard(int(maxEntries), maxBytes, e.policy)
+	}
+
+	if e.snapshotPath != "" {
+		// A missing or unreadable snapshot leaves the store empty, as the
+		// cache can always be regenerated
+		e.restoreSnapshot()
+		e.snapshotPeriodically()
 	}
+
 	//Start cleanup poll
 	e.cleanupExpiredKeys()
 	return e
@@ -36,121 +173,525 @@ func NewMemoryStore(expirePoll time.Duration) *Engine {
 
 // Exists checks to see if a key exists in the store
 func (e *Engine) Exists(key string) bool {
-	storeLock.RLock()
-	defer storeLock.RUnlock()
+	s := e.shard(key)
+	s.RLock()
+	defer s.RUnlock()
 
-	_, ok := e.store[key]
-	return ok
+	return s.live(key, time.Now())
 }
 
 // Get retrieves data from the store based on key, if it exists, else it returns an error
 func (e *Engine) Get(key string) (data []byte, err error) {
-	if !e.Exists(key) {
-		err = common.ErrNonExistentKey
+	s := e.shard(key)
+
+	// A bounded shard records the access, which needs the write lock
+	if s.evictor != nil {
+		s.Lock()
+		defer s.Unlock()
+		s.evictor.access(key)
+	} else {
+		s.RLock()
+		defer s.RUnlock()
 	}
 
-	storeLock.RLock()
-	defer storeLock.RUnlock()
+	if !s.live(key, time.Now()) {
+		return nil, common.ErrNonExistentKey
+	}
 
-	data = e.store[key]
+	data = e.readData(s.store[key])
 
 	return
 }
 
 // Put stores data against a key, else it returns an error
 func (e *Engine) Put(key string, data []byte, expiry time.Time) error {
-	storeLock.Lock()
-	defer storeLock.Unlock()
+	return e.PutTagged(key, data, expiry, nil)
+}
 
-	e.store[key] = data
-	e.expire[key] = expiry
+// PutTagged stores data against a key and associates it with the given tags,
+// replacing any tags previously held by the key
+func (e *Engine) PutTagged(key string, data []byte, expiry time.Time, tags []string) error {
+	if e.copyOnWrite {
+		data = copyBytes(data)
+	}
 
+	e.put(key, data, expiry, e.hardExpiry(expiry), tags)
 	return nil
 }
 
-// IsExpired checks to see if the key has expired
-func (e *Engine) IsExpired(key string) bool {
-	if !e.Exists(key) {
-		return true
+// put stores an entry, evicting entries as needed to respect the limits
+func (e *Engine) put(key string, data []byte, expiry time.Time, hardExpiry time.Time, tags []string) {
+	s := e.shard(key)
+	s.Lock()
+
+	old, exists := s.store[key]
+	if exists {
+		s.bytes -= entrySize(key, old)
 	}
+	s.bytes += entrySize(key, data)
+
+	s.store[key] = data
+	s.expire[key] = expiry
+	s.hardExpire[key] = hardExpiry
+
+	e.untag(s, key)
+	e.tag(s, key, tags)
+
+	var evicted []eviction
+	if s.evictor != nil {
+		if exists {
+			s.evictor.access(key)
+		} else {
+			for _, k := range s.evictor.add(key) {
+				evicted = append(evicted, e.evict(s, k))
+			}
+		}
 
-	storeLock.RLock()
-	defer storeLock.RUnlock()
+		for s.over() {
+			k, ok := s.evictor.victim()
+			if !ok {
+				break
+			}
+			evicted = append(evicted, e.evict(s, k))
+		}
+	}
+
+	s.Unlock()
+
+	// The callback runs outside the shard lock, so it may use the engine
+	if e.onEvict != nil {
+		for _, ev := range evicted {
+			e.onEvict(ev.key, ev.data)
+		}
+	}
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	s := e.shard(key)
+	s.RLock()
+	defer s.RUnlock()
 
-	if time.Now().After(e.expire[key]) {
-		go e.Expire(key)
+	now := time.Now()
+	if !s.live(key, now) {
 		return true
 	}
 
-	return false
+	return now.After(s.expire[key])
 }
 
 // Expire marks the key as expired, and removes it from the storage engine
 func (e *Engine) Expire(key string) error {
-	if !e.Exists(key) {
+	s := e.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.store[key]; !ok {
 		return common.ErrNonExistentKey
 	}
 
-	storeLock.Lock()
-	defer storeLock.Unlock()
+	e.remove(s, key)
+
+	return nil
+}
 
-	delete(e.store, key)
-	delete(e.expire, key)
-	e.Unlock(key)
+// ExpireTag removes every key carrying the given tag from the storage engine
+func (e *Engine) ExpireTag(tag string) error {
+	e.tagsLock.Lock()
+	keys := make([]string, 0, len(e.tags[tag]))
+	for key := range e.tags[tag] {
+		keys = append(keys, key)
+	}
+	e.tagsLock.Unlock()
+
+	for _, key := range keys {
+		s := e.shard(key)
+		s.Lock()
+		if _, ok := s.store[key]; ok {
+			e.remove(s, key)
+		}
+		s.Unlock()
+	}
 
 	return nil
 }
 
+// DeletePrefix removes every key starting with the prefix from the storage engine
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.deleteWhere(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}, progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the storage engine
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	return e.deleteWhere(func(key string) bool {
+		return common.MatchGlob(pattern, key)
+	}, progress)
+}
+
+// Scan returns up to count keys starting with prefix, in key order. The cursor
+// is the last key returned by the previous page.
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	keys, next := e.scan(cursor, prefix, count)
+	return keys, next, nil
+}
+
+// ScanEntries returns up to count entries whose key starts with prefix, in key
+// order. The cursor is the last key returned by the previous page.
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
+	keys, next := e.scan(cursor, prefix, count)
+
+	now := time.Now()
+	entries := make([]common.Entry, 0, len(keys))
+	for _, key := range keys {
+		s := e.shard(key)
+		s.RLock()
+		// The key may have been removed or hard expired since it was scanned
+		if s.live(key, now) {
+			entries = append(entries, common.Entry{
+				Key:     key,
+				Data:    e.readData(s.store[key]),
+				Expires: s.expire[key],
+				Locked:  s.locks[key],
+			})
+		}
+		s.RUnlock()
+	}
+
+	return entries, next, nil
+}
+
+// Evictions returns the number of entries evicted to respect the limits
+func (e *Engine) Evictions() uint64 {
+	return atomic.LoadUint64(&e.evictions)
+}
+
+// Stats returns the number and size of the entries held, and the number of
+// entries evicted so far
+func (e *Engine) Stats() Stats {
+	stats := Stats{
+		Evictions: e.Evictions(),
+	}
+
+	for _, s := range e.shards {
+		s.RLock()
+		stats.Entries += len(s.store)
+		stats.Bytes += s.bytes
+		s.RUnlock()
+	}
+
+	return stats
+}
+
 // IsLocked checks to see if the key has been locked
 func (e *Engine) IsLocked(key string) bool {
-	locksLock.RLock()
-	defer locksLock.RUnlock()
+	s := e.shard(key)
+	s.RLock()
+	defer s.RUnlock()
 
-	_, ok := e.locks[key]
+	_, ok := s.locks[key]
 
 	return ok
 }
 
 // Lock sets a lock against the given key
 func (e *Engine) Lock(key string) error {
-	if e.IsLocked(key) {
+	s := e.shard(key)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.locks[key]; ok {
 		return common.ErrKeyAlreadyLocked
 	}
 
-	locksLock.Lock()
-	defer locksLock.Unlock()
-
-	e.locks[key] = true
+	s.locks[key] = true
 
 	return nil
 }
 
 // Unlock removes the lock from a given key, if it doesn't exist it returns an error
 func (e *Engine) Unlock(key string) error {
-	locksLock.Lock()
-	defer locksLock.Unlock()
+	s := e.shard(key)
+	s.Lock()
+	defer s.Unlock()
 
-	_, ok := e.locks[key]
+	_, ok := s.locks[key]
 	if !ok {
 		return common.ErrNonExistentKey
 	}
 
-	delete(e.locks, key)
+	delete(s.locks, key)
 
 	return nil
 }
 
+// shard returns the shard holding the key
+func (e *Engine) shard(key string) *shard {
+	if len(e.shards) == 1 {
+		return e.shards[0]
+	}
+
+	return e.shards[hashKey(key)%uint32(len(e.shards))]
+}
+
+// remove deletes the key, its lock and its tags, the shard lock must be held
+func (e *Engine) remove(s *shard, key string) {
+	e.removeEntry(s, key)
+	delete(s.locks, key)
+}
+
+// removeEntry deletes the key and its tags but leaves any lock, the shard lock
+// must be held
+func (e *Engine) removeEntry(s *shard, key string) {
+	if data, ok := s.store[key]; ok {
+		s.bytes -= entrySize(key, data)
+	}
+	if s.evictor != nil {
+		s.evictor.remove(key)
+	}
+
+	delete(s.store, key)
+	delete(s.expire, key)
+	delete(s.hardExpire, key)
+	e.untag(s, key)
+}
+
+// eviction is an entry evicted to respect the limits
+type eviction struct {
+	key  string
+	data []byte
+}
+
+// evict removes the key to respect the limits, the shard lock must be held.
+// Locks are left alone, as they may be held by a regeneration in progress.
+func (e *Engine) evict(s *shard, key string) eviction {
+	ev := eviction{key: key, data: s.store[key]}
+	e.removeEntry(s, key)
+	atomic.AddUint64(&e.evictions, 1)
+
+	return ev
+}
+
+// hardExpiry returns when an entry stored now with the given expiry is removed
+func (e *Engine) hardExpiry(expires time.Time) time.Time {
+	if e.cleanupTimeout <= 0 {
+		return expires
+	}
+
+	return time.Now().Add(e.cleanupTimeout)
+}
+
+// readData returns the stored data as it should be handed to callers
+func (e *Engine) readData(data []byte) []byte {
+	if e.copyOnRead {
+		return copyBytes(data)
+	}
+
+	return data
+}
+
+// copyBytes copies data, keeping nil as nil
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+
+	return append([]byte{}, data...)
+}
+
+// perShard splits a limit evenly over the shards, rounding up
+func perShard(limit int64, shards int) int64 {
+	if limit <= 0 {
+		return 0
+	}
+
+	return (limit + int64(shards) - 1) / int64(shards)
+}
+
+// scan finds the page of keys following the cursor across all shards. Only
+// the count+1 smallest keys are kept while walking the shards, the extra key
+// telling whether there is a further page, so a page costs O(n log count)
+// rather than sorting every key following the cursor.
+func (e *Engine) scan(cursor string, prefix string, count int) ([]string, string) {
+	now := time.Now()
+
+	var keys keyHeap
+	for _, s := range e.shards {
+		s.RLock()
+		for key := range s.store {
+			if key <= cursor || !strings.HasPrefix(key, prefix) || !s.live(key, now) {
+				continue
+			}
+
+			if count <= 0 || len(keys) <= count {
+				heap.Push(&keys, key)
+			} else if key < keys[0] {
+				keys[0] = key
+				heap.Fix(&keys, 0)
+			}
+		}
+		s.RUnlock()
+	}
+	sort.Strings(keys)
+
+	if count <= 0 || len(keys) <= count {
+		return keys, ""
+	}
+
+	keys = keys[:count]
+	return keys, keys[count-1]
+}
+
+// keyHeap is a max-heap of keys, holding the smallest keys found by a scan
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(string))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return key
+}
+
+// deleteWhere walks each shard and removes matching keys in batches, so that
+// large deletions don't hold a shard lock for their whole duration
+func (e *Engine) deleteWhere(match func(string) bool, progress func(int)) (int, error) {
+	deleted := 0
+
+	for _, s := range e.shards {
+		var keys []string
+
+		s.RLock()
+		for key := range s.store {
+			if match(key) {
+				keys = append(keys, key)
+			}
+		}
+		s.RUnlock()
+
+		for len(keys) > 0 {
+			batch := keys
+			if len(batch) > deleteBatchSize {
+				batch = batch[:deleteBatchSize]
+			}
+			keys = keys[len(batch):]
+
+			n := 0
+			s.Lock()
+			for _, key := range batch {
+				if _, ok := s.store[key]; ok {
+					e.remove(s, key)
+					n++
+				}
+			}
+			s.Unlock()
+
+			if n == 0 {
+				continue
+			}
+
+			deleted += n
+			if progress != nil {
+				progress(deleted)
+			}
+		}
+	}
+
+	return deleted, nil
+}
+
+// tag adds the key to the tag index, the shard lock must be held
+func (e *Engine) tag(s *shard, key string, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	// Copied, as the caller may reuse the slice
+	s.keyTags[key] = append([]string(nil), tags...)
+
+	e.tagsLock.Lock()
+	defer e.tagsLock.Unlock()
+
+	for _, tag := range tags {
+		if _, ok := e.tags[tag]; !ok {
+			e.tags[tag] = make(map[string]struct{})
+		}
+		e.tags[tag][key] = struct{}{}
+	}
+}
+
+// untag removes the key from the tag index, the shard lock must be held
+func (e *Engine) untag(s *shard, key string) {
+	tags, ok := s.keyTags[key]
+	if !ok {
+		return
+	}
+	delete(s.keyTags, key)
+
+	e.tagsLock.Lock()
+	defer e.tagsLock.Unlock()
+
+	for _, tag := range tags {
+		delete(e.tags[tag], key)
+		if len(e.tags[tag]) == 0 {
+			delete(e.tags, tag)
+		}
+	}
+}
+
+// Close stops the expiry sweeper, and writes a final snapshot if configured
+// with the Snapshot option. The engine can still be used, but expired keys are
+// no longer removed in the background.
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+
+		if e.snapshotPath != "" {
+			e.closeErr = e.SaveSnapshot(e.snapshotPath)
+		}
+	})
+
+	return e.closeErr
+}
+
 //Polls the keys to see if they have expired
-//re-checks after a period of time
+//re-checks after a period of time, until the engine is closed
 func (e *Engine) cleanupExpiredKeys() {
+	ticker := time.NewTicker(e.expirePoll)
+
 	go func() {
-		for range time.Tick(e.expirePoll) {
-			storeLock.RLock()
-			for k := range e.expire {
-				//If the key has expired it will be cleared by this call
-				e.IsExpired(k)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.removeExpired()
+			case <-e.done:
+				return
 			}
-			storeLock.RUnlock()
 		}
 	}()
 }
+
+// removeExpired removes every hard expired key
+func (e *Engine) removeExpired() {
+	for _, s := range e.shards {
+		now := time.Now()
+
+		s.Lock()
+		for k, expiry := range s.hardExpire {
+			if now.After(expiry) {
+				e.remove(s, k)
+			}
+		}
+		s.Unlock()
+	}
+}
@@ -2,44 +2,73 @@ package memory
 
 import (
 	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/fresh8/go-cache/engine/common"
 )
 
+// storeLen returns the number of entries held across all shards
+func (e *Engine) storeLen() (n int) {
+	for _, s := range e.shards {
+		n += len(s.store)
+	}
+	return
+}
+
+// locksLen returns the number of locks held across all shards
+func (e *Engine) locksLen() (n int) {
+	for _, s := range e.shards {
+		n += len(s.locks)
+	}
+	return
+}
+
+// expireLen returns the number of expiry times held across all shards
+func (e *Engine) expireLen() (n int) {
+	for _, s := range e.shards {
+		n += len(s.expire)
+	}
+	return
+}
+
 func TestInMemory_NewMemoryStore(t *testing.T) {
-	memStore := NewMemoryStore(time.Second * 60)
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
 
-	if len(memStore.store) > 0 {
-		t.Fatalf("store length should be 0 on initialisation, %d given", len(memStore.store))
+	if memStore.storeLen() > 0 {
+		t.Fatalf("store length should be 0 on initialisation, %d given", memStore.storeLen())
 	}
 
-	if len(memStore.locks) > 0 {
-		t.Fatalf("locks length should be 0 on initialisation, %d given", len(memStore.locks))
+	if memStore.locksLen() > 0 {
+		t.Fatalf("locks length should be 0 on initialisation, %d given", memStore.locksLen())
 	}
 
-	if len(memStore.expire) > 0 {
-		t.Fatalf("expire length should be 0 on initialisation, %d given", len(memStore.expire))
+	if memStore.expireLen() > 0 {
+		t.Fatalf("expire length should be 0 on initialisation, %d given", memStore.expireLen())
 	}
 }
 
 func TestInMemory_Exists(t *testing.T) {
 	content := []byte("hello")
 
-	memStore := NewMemoryStore(time.Second * 60)
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
 
 	if memStore.Exists("existing") {
 		t.Fatal("key does not exist, marked as existing")
 	}
 
-	memStore.store["existing"] = content
+	memStore.shard("existing").store["existing"] = content
+	memStore.shard("existing").hardExpire["existing"] = time.Now().Add(time.Hour)
 
 	if !memStore.Exists("existing") {
 		t.Fatal("key exist, marked as non-existent")
 	}
 
-	delete(memStore.store, "existing")
+	delete(memStore.shard("existing").store, "existing")
 
 	if memStore.Exists("existing") {
 		t.Fatal("key does not exist, marked as existing")
@@ -49,8 +78,9 @@ func TestInMemory_Exists(t *testing.T) {
 func TestInMemory_Get(t *testing.T) {
 	content := []byte("hello")
 
-	memStore := NewMemoryStore(time.Second * 60)
-	memStore.store["existing"] = content
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+	memStore.shard("existing").store["existing"] = content
+	memStore.shard("existing").hardExpire["existing"] = time.Now().Add(time.Hour)
 
 	_, err := memStore.Get("non-existent")
 	if err != common.ErrNonExistentKey {
@@ -67,7 +97,7 @@ func TestInMemory_Get(t *testing.T) {
 	}
 
 	newContent := append(content, []byte("existing")...)
-	memStore.store["existing"] = newContent
+	memStore.shard("existing").store["existing"] = newContent
 	data, err = memStore.Get("existing")
 	if err != nil {
 		t.Fatalf("no error expected, %s given", err)
@@ -81,14 +111,14 @@ func TestInMemory_Get(t *testing.T) {
 func TestInMemory_Put(t *testing.T) {
 	content := []byte("hello")
 
-	memStore := NewMemoryStore(time.Second * 60)
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
 
 	err := memStore.Put("new-key", content, time.Now().Add(1*time.Hour))
 	if err != nil {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	data, ok := memStore.store["new-key"]
+	data, ok := memStore.shard("new-key").store["new-key"]
 	if !ok {
 		t.Fatal("key has not been set in internal store")
 	}
@@ -99,19 +129,19 @@ func TestInMemory_Put(t *testing.T) {
 }
 
 func TestInMemory_IsLocked(t *testing.T) {
-	memStore := NewMemoryStore(time.Second * 60)
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
 
 	if memStore.IsLocked("not-locked") {
 		t.Fatal("newly initialised store should contain no locks")
 	}
 
-	memStore.locks["locked-key"] = true
+	memStore.shard("locked-key").locks["locked-key"] = true
 
 	if !memStore.IsLocked("locked-key") {
 		t.Fatal("key should be locked")
 	}
 
-	delete(memStore.locks, "locked-key")
+	delete(memStore.shard("locked-key").locks, "locked-key")
 
 	if memStore.IsLocked("locked-key") {
 		t.Fatal("key lock should have been released")
@@ -119,10 +149,10 @@ func TestInMemory_IsLocked(t *testing.T) {
 }
 
 func TestInMemory_Lock(t *testing.T) {
-	memStore := NewMemoryStore(time.Second * 60)
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
 
-	if len(memStore.locks) != 0 {
-		t.Fatalf("locks length should be 0 on initialisation, %d given", len(memStore.locks))
+	if memStore.locksLen() != 0 {
+		t.Fatalf("locks length should be 0 on initialisation, %d given", memStore.locksLen())
 	}
 
 	err := memStore.Lock("lock-me")
@@ -130,8 +160,8 @@ func TestInMemory_Lock(t *testing.T) {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if len(memStore.locks) != 1 {
-		t.Fatalf("locks length should be 1 after single lock run, %d given", len(memStore.locks))
+	if memStore.locksLen() != 1 {
+		t.Fatalf("locks length should be 1 after single lock run, %d given", memStore.locksLen())
 	}
 
 	err = memStore.Lock("lock-me")
@@ -144,16 +174,16 @@ func TestInMemory_Lock(t *testing.T) {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if len(memStore.locks) != 2 {
-		t.Fatalf("locks length should be 2 after double lock run, %d given", len(memStore.locks))
+	if memStore.locksLen() != 2 {
+		t.Fatalf("locks length should be 2 after double lock run, %d given", memStore.locksLen())
 	}
 }
 
 func TestInMemory_Unlock(t *testing.T) {
-	memStore := NewMemoryStore(time.Second * 60)
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
 
-	if len(memStore.locks) != 0 {
-		t.Fatalf("locks length should be 0 on initialisation, %d given", len(memStore.locks))
+	if memStore.locksLen() != 0 {
+		t.Fatalf("locks length should be 0 on initialisation, %d given", memStore.locksLen())
 	}
 
 	err := memStore.Unlock("locked-key")
@@ -161,10 +191,10 @@ func TestInMemory_Unlock(t *testing.T) {
 		t.Fatalf("key does not exist, should return error")
 	}
 
-	memStore.locks["locked-key"] = true
+	memStore.shard("locked-key").locks["locked-key"] = true
 
-	if len(memStore.locks) != 1 {
-		t.Fatalf("locks length should be 1, %d given", len(memStore.locks))
+	if memStore.locksLen() != 1 {
+		t.Fatalf("locks length should be 1, %d given", memStore.locksLen())
 	}
 
 	err = memStore.Unlock("locked-key")
@@ -172,14 +202,14 @@ func TestInMemory_Unlock(t *testing.T) {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if len(memStore.locks) != 0 {
-		t.Fatalf("locks length should be 0 after unlock, %d given", len(memStore.locks))
+	if memStore.locksLen() != 0 {
+		t.Fatalf("locks length should be 0 after unlock, %d given", memStore.locksLen())
 	}
 }
 
 func TestInMemory_IsExpired(t *testing.T) {
 	content := []byte("hello")
-	memStore := NewMemoryStore(time.Second * 10)
+	memStore := NewMemoryStore(time.Second*10, time.Hour)
 
 	// Check if key has expired
 	if !memStore.IsExpired("existing") {
@@ -197,7 +227,7 @@ func TestInMemory_IsExpired(t *testing.T) {
 	}
 
 	// Force expiry
-	memStore.expire["existing"] = time.Now()
+	memStore.shard("existing").expire["existing"] = time.Now()
 
 	// Wait until the cleanup poll has passed
 	time.After(time.Second * 10)
@@ -206,58 +236,101 @@ func TestInMemory_IsExpired(t *testing.T) {
 	if !memStore.IsExpired("existing") {
 		t.Fatal("memory store should return true if the key has expired")
 	}
+
+	// Expired keys are kept as stale data until cleaned up
+	if !memStore.Exists("existing") {
+		t.Fatal("expired key should exist until cleaned up")
+	}
+}
+
+func TestInMemory_CleanupTimeout(t *testing.T) {
+	content := []byte("hello")
+	memStore := NewMemoryStore(time.Millisecond*10, time.Millisecond*30)
+
+	err := memStore.Put("existing", content, time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !memStore.IsExpired("existing") {
+		t.Fatal("memory store should return true if the key has expired")
+	}
+
+	data, err := memStore.Get("existing")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(data, content) != 0 {
+		t.Fatalf("stale data should be returned, %s expected, %s given", content, data)
+	}
+
+	// Wait until the cleanup timeout and a poll have passed
+	time.Sleep(time.Millisecond * 60)
+
+	if memStore.Exists("existing") {
+		t.Fatal("key should not exist after the cleanup timeout")
+	}
+
+	if memStore.storeLen() != 0 {
+		t.Fatalf("store length should be 0 after cleanup, %d given", memStore.storeLen())
+	}
+
+	_, err = memStore.Get("existing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
 }
 
 func TestInMemory_Expire(t *testing.T) {
 	content := []byte("hello")
 
-	memStore := NewMemoryStore(time.Second * 60)
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
 
 	err := memStore.Expire("existing")
 	if err != common.ErrNonExistentKey {
 		t.Fatalf("key does not exist, should return error")
 	}
 
-	memStore.store["existing"] = content
-	memStore.locks["existing"] = true
+	memStore.shard("existing").store["existing"] = content
+	memStore.shard("existing").locks["existing"] = true
 
 	err = memStore.Expire("existing")
 	if err != nil {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if len(memStore.store) != 0 {
-		t.Fatalf("store length should be 0 after expiring, %d given", len(memStore.store))
+	if memStore.storeLen() != 0 {
+		t.Fatalf("store length should be 0 after expiring, %d given", memStore.storeLen())
 	}
 
-	if len(memStore.locks) != 0 {
-		t.Fatalf("locks length should be 0 after expiring, %d given", len(memStore.locks))
+	if memStore.locksLen() != 0 {
+		t.Fatalf("locks length should be 0 after expiring, %d given", memStore.locksLen())
 	}
 
-	if len(memStore.expire) != 0 {
-		t.Fatalf("expire length should be 0 after expiring, %d given", len(memStore.expire))
+	if memStore.expireLen() != 0 {
+		t.Fatalf("expire length should be 0 after expiring, %d given", memStore.expireLen())
 	}
 }
 
 func TestInMemory_PollExpire(t *testing.T) {
 	content := []byte("hello")
 
-	memStore := NewMemoryStore(time.Second * 1)
+	memStore := NewMemoryStore(time.Second*1, time.Hour)
 
 	err := memStore.Expire("existing")
 	if err != common.ErrNonExistentKey {
 		t.Fatalf("key does not exist, should return error")
 	}
 
-	storeLock.Lock()
-	locksLock.Lock()
+	s := memStore.shard("existing")
+	s.Lock()
 
-	memStore.store["existing"] = content
-	memStore.locks["existing"] = true
-	memStore.expire["existing"] = time.Now()
+	s.store["existing"] = content
+	s.locks["existing"] = true
+	s.expire["existing"] = time.Now()
 
-	storeLock.Unlock()
-	locksLock.Unlock()
+	s.Unlock()
 
 	// Wait until the cleanup poll has passed
 	time.After(time.Second * 1)
@@ -267,15 +340,528 @@ func TestInMemory_PollExpire(t *testing.T) {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if len(memStore.store) != 0 {
-		t.Fatalf("store length should be 0 after expiring, %d given", len(memStore.store))
+	if memStore.storeLen() != 0 {
+		t.Fatalf("store length should be 0 after expiring, %d given", memStore.storeLen())
+	}
+
+	if memStore.locksLen() != 0 {
+		t.Fatalf("locks length should be 0 after expiring, %d given", memStore.locksLen())
+	}
+
+	if memStore.expireLen() != 0 {
+		t.Fatalf("expire length should be 0 after expiring, %d given", memStore.expireLen())
+	}
+}
+
+func TestInMemory_Close(t *testing.T) {
+	memStore := NewMemoryStore(time.Millisecond*10, 0)
+
+	err := memStore.Close()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	memStore.Put("existing", []byte("hello"), time.Now().Add(-time.Second))
+
+	// Wait for several polls, which should no longer run
+	time.Sleep(time.Millisecond * 50)
+
+	if memStore.storeLen() != 1 {
+		t.Fatal("expired keys should not be removed once the engine is closed")
+	}
+
+	// Closing twice is harmless
+	err = memStore.Close()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+}
+
+func TestInMemory_PutTagged(t *testing.T) {
+	content := []byte("hello")
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+
+	tags := []string{"product:1", "page"}
+
+	err := memStore.PutTagged("tagged-key", content, time.Now().Add(1*time.Hour), tags)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// Reusing the slice leaves the stored tags alone
+	tags[0] = "product:2"
+	if memStore.shard("tagged-key").keyTags["tagged-key"][0] != "product:1" {
+		t.Fatalf("product:1 expected, %s given", memStore.shard("tagged-key").keyTags["tagged-key"][0])
+	}
+
+	if _, ok := memStore.tags["product:1"]["tagged-key"]; !ok {
+		t.Fatal("key has not been added to the tag index")
+	}
+
+	if len(memStore.shard("tagged-key").keyTags["tagged-key"]) != 2 {
+		t.Fatalf("key should carry 2 tags, %d given", len(memStore.shard("tagged-key").keyTags["tagged-key"]))
+	}
+
+	// Re-putting the key without tags should drop it from the index
+	err = memStore.Put("tagged-key", content, time.Now().Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(memStore.tags) != 0 {
+		t.Fatalf("tags length should be 0 after untagged put, %d given", len(memStore.tags))
+	}
+
+	if len(memStore.shard("tagged-key").keyTags) != 0 {
+		t.Fatalf("key tags length should be 0 after untagged put, %d given", len(memStore.shard("tagged-key").keyTags))
+	}
+}
+
+func TestInMemory_ExpireTag(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+
+	memStore.PutTagged("page-1", content, expires, []string{"product:1"})
+	memStore.PutTagged("page-2", content, expires, []string{"product:1", "product:2"})
+	memStore.PutTagged("page-3", content, expires, []string{"product:2"})
+	memStore.Lock("page-1")
+
+	err := memStore.ExpireTag("product:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if memStore.Exists("page-1") || memStore.Exists("page-2") {
+		t.Fatal("tagged keys should have been expired")
+	}
+
+	if !memStore.Exists("page-3") {
+		t.Fatal("key without the expired tag should still exist")
+	}
+
+	if memStore.IsLocked("page-1") {
+		t.Fatal("lock should have been released on expiry")
+	}
+
+	if len(memStore.tags["product:2"]) != 1 {
+		t.Fatalf("product:2 tag should hold 1 key, %d given", len(memStore.tags["product:2"]))
+	}
+
+	err = memStore.ExpireTag("unknown")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+}
+
+func TestInMemory_DeletePrefix(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	// A single shard makes the batches deterministic
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(1))
+
+	for i := 0; i < deleteBatchSize+10; i++ {
+		memStore.Put(fmt.Sprintf("search:%d", i), content, expires)
+	}
+	memStore.Put("product:1", content, expires)
+
+	var calls []int
+	deleted, err := memStore.DeletePrefix("search:", func(n int) {
+		calls = append(calls, n)
+	})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if deleted != deleteBatchSize+10 {
+		t.Fatalf("%d keys should have been deleted, %d given", deleteBatchSize+10, deleted)
+	}
+
+	if len(calls) != 2 || calls[1] != deleted {
+		t.Fatalf("progress should be reported per batch, %v given", calls)
+	}
+
+	if memStore.storeLen() != 1 || !memStore.Exists("product:1") {
+		t.Fatal("keys outside the prefix should still exist")
+	}
+}
+
+func TestInMemory_DeleteMatching(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+	memStore.Put("product:1:page", content, expires)
+	memStore.Put("product:2:page", content, expires)
+	memStore.Put("product:2:image", content, expires)
+
+	deleted, err := memStore.DeleteMatching("product:*:page", nil)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if deleted != 2 {
+		t.Fatalf("2 keys should have been deleted, %d given", deleted)
+	}
+
+	if !memStore.Exists("product:2:image") {
+		t.Fatal("keys not matching the pattern should still exist")
+	}
+}
+
+func TestInMemory_Scan(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+	memStore.Put("search:c", content, expires)
+	memStore.Put("search:a", content, expires)
+	memStore.Put("search:b", content, expires)
+	memStore.Put("product:1", content, expires)
+
+	keys, cursor, err := memStore.Scan("", "search:", 2)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(keys) != 2 || keys[0] != "search:a" || keys[1] != "search:b" {
+		t.Fatalf("first page should hold search:a and search:b, %v given", keys)
+	}
+
+	if cursor != "search:b" {
+		t.Fatalf("cursor should be the last key returned, %s given", cursor)
+	}
+
+	keys, cursor, err = memStore.Scan(cursor, "search:", 2)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(keys) != 1 || keys[0] != "search:c" {
+		t.Fatalf("second page should hold search:c, %v given", keys)
+	}
+
+	if cursor != "" {
+		t.Fatalf("cursor should be empty once the scan is complete, %s given", cursor)
+	}
+}
+
+func TestInMemory_ScanPages(t *testing.T) {
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(8))
+
+	var expected []string
+	for i := 0; i < 500; i++ {
+		key := strconv.Itoa(i * 7919 % 1000)
+		memStore.Put(key, []byte("hello"), time.Now().Add(time.Hour))
+		expected = append(expected, key)
+	}
+	sort.Strings(expected)
+
+	var keys []string
+	cursor := ""
+	for {
+		page, next, _ := memStore.Scan(cursor, "", 7)
+		if len(page) > 7 {
+			t.Fatalf("pages should hold at most 7 keys, %d given", len(page))
+		}
+
+		keys = append(keys, page...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Fatalf("every key should be returned once in order, %v given", keys)
+	}
+}
+
+func TestInMemory_ScanEntries(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+	memStore.Put("search:a", content, expires)
+	memStore.Lock("search:a")
+
+	// Hard expired entries are left out, as with Get
+	memStore.cleanupTimeout = time.Nanosecond
+	memStore.Put("search:b", content, time.Now().Add(-time.Minute))
+	memStore.cleanupTimeout = time.Hour
+	time.Sleep(time.Millisecond)
+
+	entries, cursor, err := memStore.ScanEntries("", "", 10)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if cursor != "" {
+		t.Fatalf("cursor should be empty once the scan is complete, %s given", cursor)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("1 entry expected, %d given", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Key != "search:a" || bytes.Compare(entry.Data, content) != 0 || !entry.Expires.Equal(expires) || !entry.Locked {
+		t.Fatalf("entry does not match stored data, %+v given", entry)
+	}
+}
+
+func TestInMemory_MaxEntries(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	var evicted []string
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(1), MaxEntries(2), OnEvict(func(key string, data []byte) {
+		evicted = append(evicted, key)
+	}))
+
+	memStore.Put("a", content, expires)
+	memStore.Put("b", content, expires)
+	memStore.Get("a")
+	memStore.Put("c", content, expires)
+
+	if memStore.storeLen() != 2 {
+		t.Fatalf("store length should be 2, %d given", memStore.storeLen())
 	}
 
-	if len(memStore.locks) != 0 {
-		t.Fatalf("locks length should be 0 after expiring, %d given", len(memStore.locks))
+	if memStore.Exists("b") || !memStore.Exists("a") || !memStore.Exists("c") {
+		t.Fatal("the least recently used key should have been evicted")
 	}
 
-	if len(memStore.expire) != 0 {
-		t.Fatalf("expire length should be 0 after expiring, %d given", len(memStore.expire))
+	if len(evicted) != 1 || evicted[0] != "b" {
+		t.Fatalf("eviction callback should have been called for b, %v given", evicted)
 	}
+
+	if memStore.Evictions() != 1 {
+		t.Fatalf("1 eviction expected, %d given", memStore.Evictions())
+	}
+}
+
+func TestInMemory_MaxEntriesKeepsLocks(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(1), MaxEntries(1))
+	memStore.Lock("a")
+	memStore.Put("a", content, expires)
+	memStore.Put("b", content, expires)
+
+	if memStore.Exists("a") {
+		t.Fatal("a should have been evicted")
+	}
+
+	if !memStore.IsLocked("a") {
+		t.Fatal("eviction should not release a lock")
+	}
+}
+
+func TestInMemory_MaxBytes(t *testing.T) {
+	expires := time.Now().Add(1 * time.Hour)
+
+	// Room for two entries with a 1 byte key and 9 bytes of data
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(1), MaxBytes(2*(entryOverhead+10)))
+	memStore.Put("a", make([]byte, 9), expires)
+	memStore.Put("b", make([]byte, 9), expires)
+
+	if memStore.storeLen() != 2 {
+		t.Fatalf("store length should be 2, %d given", memStore.storeLen())
+	}
+
+	memStore.Put("c", make([]byte, 9), expires)
+
+	if memStore.storeLen() != 2 || memStore.Exists("a") {
+		t.Fatal("a should have been evicted to make room for c")
+	}
+
+	// Replacing an entry accounts for its new size
+	memStore.Put("c", make([]byte, entryOverhead+19), expires)
+
+	if memStore.storeLen() != 1 || !memStore.Exists("c") {
+		t.Fatal("b should have been evicted to make room for the larger c")
+	}
+}
+
+func TestInMemory_EvictionPolicyLFU(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(1), MaxEntries(2), EvictionPolicy(LFU))
+	memStore.Put("a", content, expires)
+	memStore.Put("b", content, expires)
+	memStore.Get("a")
+	memStore.Get("a")
+	memStore.Get("b")
+	memStore.Put("c", content, expires)
+
+	if memStore.Exists("c") || !memStore.Exists("a") || !memStore.Exists("b") {
+		t.Fatal("the least frequently used key should have been evicted")
+	}
+}
+
+func TestInMemory_EvictionPolicyTinyLFU(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(1), MaxEntries(100), EvictionPolicy(TinyLFU))
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("hot:%d", i)
+		memStore.Put(key, content, expires)
+		for j := 0; j < 5; j++ {
+			memStore.Get(key)
+		}
+	}
+
+	// A scan of keys used once should not flush out the frequently used keys
+	for i := 0; i < 200; i++ {
+		memStore.Put(fmt.Sprintf("cold:%d", i), content, expires)
+	}
+
+	if memStore.storeLen() != 100 {
+		t.Fatalf("store length should be 100, %d given", memStore.storeLen())
+	}
+
+	for i := 0; i < 99; i++ {
+		if !memStore.Exists(fmt.Sprintf("hot:%d", i)) {
+			t.Fatalf("hot:%d should not have been evicted", i)
+		}
+	}
+
+	if memStore.Evictions() != 200 {
+		t.Fatalf("200 evictions expected, %d given", memStore.Evictions())
+	}
+}
+
+func TestInMemory_Copy(t *testing.T) {
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+
+	content := []byte("hello")
+	memStore.Put("existing", content, expires)
+	content[0] = 'j'
+
+	data, _ := memStore.Get("existing")
+	if string(data) != "hello" {
+		t.Fatalf("modifying data after Put should not change the store, %s given", data)
+	}
+
+	data[0] = 'j'
+
+	data, _ = memStore.Get("existing")
+	if string(data) != "hello" {
+		t.Fatalf("modifying data returned by Get should not change the store, %s given", data)
+	}
+
+	memStore = NewMemoryStore(time.Second*60, time.Hour, CopyOnRead(false), CopyOnWrite(false))
+
+	content = []byte("hello")
+	memStore.Put("existing", content, expires)
+	content[0] = 'j'
+
+	data, _ = memStore.Get("existing")
+	if string(data) != "jello" {
+		t.Fatalf("data should be shared without copies, %s given", data)
+	}
+}
+
+func TestInMemory_Stats(t *testing.T) {
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(1), MaxEntries(2))
+	memStore.Put("a", []byte("hello"), expires)
+	memStore.Put("b", []byte("hello"), expires)
+	memStore.Put("c", []byte("hello"), expires)
+	memStore.Put("c", []byte("hi"), expires)
+
+	stats := memStore.Stats()
+
+	if stats.Entries != 2 {
+		t.Fatalf("2 entries expected, %d given", stats.Entries)
+	}
+
+	if expected := int64(1+5+entryOverhead) + int64(1+2+entryOverhead); stats.Bytes != expected {
+		t.Fatalf("%d bytes expected, %d given", expected, stats.Bytes)
+	}
+
+	if stats.Evictions != 1 {
+		t.Fatalf("1 eviction expected, %d given", stats.Evictions)
+	}
+
+	memStore.Expire("b")
+	memStore.Expire("c")
+
+	if stats = memStore.Stats(); stats.Entries != 0 || stats.Bytes != 0 {
+		t.Fatalf("an empty store should hold no bytes, %+v given", stats)
+	}
+}
+
+// benchmarkParallel runs op concurrently against a pre-filled store, once with
+// a single shard to show the cost of a global lock, and once with the default
+func benchmarkParallel(b *testing.B, op func(e *Engine, key string, i int)) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			memStore := NewMemoryStore(time.Second*60, time.Hour, Shards(shards))
+			for _, key := range keys {
+				memStore.Put(key, content, expires)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					op(memStore, keys[i%len(keys)], i)
+					i++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkInMemory_ParallelGet(b *testing.B) {
+	benchmarkParallel(b, func(e *Engine, key string, i int) {
+		e.Get(key)
+	})
+}
+
+func BenchmarkInMemory_ParallelPut(b *testing.B) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	benchmarkParallel(b, func(e *Engine, key string, i int) {
+		e.Put(key, content, expires)
+	})
+}
+
+func BenchmarkInMemory_ParallelMixed(b *testing.B) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	// Roughly the cacher's access pattern, mostly reads with some writes
+	benchmarkParallel(b, func(e *Engine, key string, i int) {
+		if i%10 == 0 {
+			e.Put(key, content, expires)
+			return
+		}
+
+		if e.Exists(key) {
+			e.Get(key)
+			e.IsExpired(key)
+		}
+	})
 }
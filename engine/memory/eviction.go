@@ -0,0 +1,381 @@
+package memory
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// Policy selects how keys are chosen for eviction once a bounded memory
+// engine is full
+type Policy int
+
+// Eviction policies
+const (
+	// LRU evicts the least recently used key
+	LRU Policy = iota
+	// LFU evicts the least frequently used key, and the least recently used
+	// of those on a tie
+	LFU
+	// TinyLFU keeps new keys in a small LRU window, and only admits them to
+	// the main LRU space if they are estimated to be used more frequently
+	// than the key they would replace (W-TinyLFU)
+	TinyLFU
+)
+
+// evictor tracks key usage within a shard and picks keys to evict. It is only
+// used while the shard lock is held.
+type evictor interface {
+	// add records a new key, returning any keys evicted to admit it
+	add(key string) []string
+	// access records a read or update of a key
+	access(key string)
+	// remove forgets a key removed other than by eviction
+	remove(key string)
+	// victim removes and returns the next key to evict
+	victim() (string, bool)
+}
+
+func newEvictor(policy Policy, capacity int, full func() bool) evictor {
+	switch policy {
+	case LFU:
+		return newLFU()
+	case TinyLFU:
+		return newTinyLFU(capacity, full)
+	}
+
+	return newLRU()
+}
+
+// lru evicts the least recently used key
+type lru struct {
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{
+		order: list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (l *lru) add(key string) []string {
+	l.items[key] = l.order.PushFront(key)
+	return nil
+}
+
+func (l *lru) access(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+func (l *lru) remove(key string) {
+	if el, ok := l.items[key]; ok {
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+func (l *lru) victim() (string, bool) {
+	el := l.order.Back()
+	if el == nil {
+		return "", false
+	}
+
+	key := el.Value.(string)
+	l.remove(key)
+
+	return key, true
+}
+
+func (l *lru) len() int {
+	return l.order.Len()
+}
+
+func (l *lru) oldest() (string, bool) {
+	el := l.order.Back()
+	if el == nil {
+		return "", false
+	}
+
+	return el.Value.(string), true
+}
+
+// lfu evicts the least frequently used key, using a min-heap ordered by use
+// count and then by last use
+type lfu struct {
+	heap  lfuHeap
+	items map[string]*lfuItem
+	tick  uint64
+}
+
+type lfuItem struct {
+	key   string
+	count uint64
+	tick  uint64
+	index int
+}
+
+func newLFU() *lfu {
+	return &lfu{
+		items: make(map[string]*lfuItem),
+	}
+}
+
+func (l *lfu) add(key string) []string {
+	l.tick++
+	item := &lfuItem{key: key, count: 1, tick: l.tick}
+	l.items[key] = item
+	heap.Push(&l.heap, item)
+	return nil
+}
+
+func (l *lfu) access(key string) {
+	if item, ok := l.items[key]; ok {
+		l.tick++
+		item.count++
+		item.tick = l.tick
+		heap.Fix(&l.heap, item.index)
+	}
+}
+
+func (l *lfu) remove(key string) {
+	if item, ok := l.items[key]; ok {
+		heap.Remove(&l.heap, item.index)
+		delete(l.items, key)
+	}
+}
+
+func (l *lfu) victim() (string, bool) {
+	if len(l.heap) == 0 {
+		return "", false
+	}
+
+	item := heap.Pop(&l.heap).(*lfuItem)
+	delete(l.items, item.key)
+
+	return item.key, true
+}
+
+type lfuHeap []*lfuItem
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count == h[j].count {
+		return h[i].tick < h[j].tick
+	}
+	return h[i].count < h[j].count
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	item := x.(*lfuItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// tinyLFU is a W-TinyLFU policy. New keys enter a small LRU window. Keys
+// leaving the window are admitted to the main LRU space while there is room,
+// and once full only if their estimated use frequency beats that of the main
+// space's victim, otherwise they are evicted.
+type tinyLFU struct {
+	window *lru
+	main   *lru
+	sketch *sketch
+	full   func() bool
+
+	// windowSize is the fixed window capacity, or 0 to size it from the
+	// number of keys held when the capacity isn't known
+	windowSize int
+}
+
+// windowPercent is the share of the keys held in the admission window
+const windowPercent = 1
+
+func newTinyLFU(capacity int, full func() bool) *tinyLFU {
+	t := &tinyLFU{
+		window: newLRU(),
+		main:   newLRU(),
+		sketch: newSketch(capacity),
+		full:   full,
+	}
+
+	if capacity > 0 {
+		t.windowSize = capacity * windowPercent / 100
+		if t.windowSize < 1 {
+			t.windowSize = 1
+		}
+	}
+
+	return t
+}
+
+func (t *tinyLFU) add(key string) []string {
+	t.sketch.increment(key)
+	t.window.add(key)
+
+	var evicted []string
+	for t.window.len() > t.windowLimit() {
+		candidate, _ := t.window.victim()
+
+		if !t.full() {
+			t.main.add(candidate)
+			continue
+		}
+
+		victim, ok := t.main.oldest()
+		if !ok || t.sketch.estimate(candidate) > t.sketch.estimate(victim) {
+			if ok {
+				t.main.remove(victim)
+				evicted = append(evicted, victim)
+			}
+			t.main.add(candidate)
+			continue
+		}
+
+		evicted = append(evicted, candidate)
+	}
+
+	return evicted
+}
+
+func (t *tinyLFU) access(key string) {
+	// Misses are counted too, so that keys requested often are admitted
+	t.sketch.increment(key)
+	t.window.access(key)
+	t.main.access(key)
+}
+
+func (t *tinyLFU) remove(key string) {
+	t.window.remove(key)
+	t.main.remove(key)
+}
+
+func (t *tinyLFU) victim() (string, bool) {
+	if key, ok := t.main.victim(); ok {
+		return key, true
+	}
+
+	return t.window.victim()
+}
+
+func (t *tinyLFU) windowLimit() int {
+	if t.windowSize > 0 {
+		return t.windowSize
+	}
+
+	limit := (t.window.len() + t.main.len()) * windowPercent / 100
+	if limit < 1 {
+		limit = 1
+	}
+
+	return limit
+}
+
+// sketch is a count-min sketch estimating how often keys have been used.
+// Counters saturate at 15 and are halved periodically, so the estimates
+// favour recent use.
+type sketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+const (
+	sketchDepth    = 4
+	sketchMax      = 15
+	sketchMinWidth = 64
+
+	// sketchWidthFactor is the number of counters per row for each key
+	sketchWidthFactor = 8
+)
+
+func newSketch(capacity int) *sketch {
+	if capacity < sketchMinWidth {
+		capacity = sketchMinWidth
+	}
+
+	// A few counters per key keeps collisions from inflating the estimates
+	width := sketchMinWidth
+	for width < capacity*sketchWidthFactor {
+		width *= 2
+	}
+
+	s := &sketch{
+		mask:    uint64(width - 1),
+		resetAt: capacity * 10,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+
+	return s
+}
+
+func (s *sketch) increment(key string) {
+	h := hashKey64(key)
+	for i := range s.rows {
+		idx := s.index(h, i)
+		if s.rows[i][idx] < sketchMax {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	h := hashKey64(key)
+
+	min := uint8(sketchMax)
+	for i := range s.rows {
+		if v := s.rows[i][s.index(h, i)]; v < min {
+			min = v
+		}
+	}
+
+	return min
+}
+
+func (s *sketch) index(h uint64, row int) uint64 {
+	// Double hashing gives a different index per row from a single hash
+	return (h + uint64(row)*(h>>32|1)) & s.mask
+}
+
+func (s *sketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
+
+// hashKey64 hashes the key with 64-bit FNV-1a, without allocating
+func hashKey64(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+
+	return hash
+}
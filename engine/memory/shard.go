@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"sync"
+	"time"
+)
+
+// shard holds a subset of the keys of the engine, guarded by its own lock
+type shard struct {
+	sync.RWMutex
+
+	store   map[string][]byte
+	expire  map[string]time.Time
+	locks   map[string]bool
+	keyTags map[string][]string
+
+	// hardExpire is when each key is removed, expire being when it goes stale
+	hardExpire map[string]time.Time
+
+	// bytes is the size of the entries held, see entrySize
+	bytes int64
+
+	// Limits of a bounded shard, zero when unlimited. evictor is nil unless
+	// the shard is bounded.
+	maxEntries int
+	maxBytes   int64
+	evictor    evictor
+}
+
+func newShard(maxEntries int, maxBytes int64, policy Policy) *shard {
+	s := &shard{
+		store:      make(map[string][]byte),
+		expire:     make(map[string]time.Time),
+		locks:      make(map[string]bool),
+		keyTags:    make(map[string][]string),
+		hardExpire: make(map[string]time.Time),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+
+	if maxEntries > 0 || maxBytes > 0 {
+		s.evictor = newEvictor(policy, maxEntries, s.over)
+	}
+
+	return s
+}
+
+// live reports whether the key is held and not yet hard expired
+func (s *shard) live(key string, now time.Time) bool {
+	if _, ok := s.store[key]; !ok {
+		return false
+	}
+
+	return now.Before(s.hardExpire[key])
+}
+
+// over reports whether the shard holds more than its limits allow
+func (s *shard) over() bool {
+	return (s.maxEntries > 0 && len(s.store) > s.maxEntries) ||
+		(s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
+// entryOverhead approximates the memory used to hold an entry besides its key
+// and data, i.e. its slots in the maps of the shard along with the string,
+// slice and time headers they hold
+const entryOverhead = 160
+
+// entrySize is the number of bytes accounted for an entry
+func entrySize(key string, data []byte) int64 {
+	return int64(len(key)+len(data)) + entryOverhead
+}
+
+// hashKey hashes the key with 32-bit FNV-1a, without allocating
+func hashKey(key string) uint32 {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+
+	return hash
+}
@@ -0,0 +1,397 @@
+package memory
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A snapshot is made up of
+//
+//     magic      "GCMS"
+//     version    uint16, big endian
+//     count      uvarint, the number of entries
+//     entries    count times
+//         key          uvarint length, bytes
+//         data         uvarint length, bytes
+//         expires      varint unix seconds, uvarint nanoseconds
+//         hard expiry  varint unix seconds, uvarint nanoseconds
+//         tags         uvarint count, then uvarint length, bytes for each
+//     checksum   uint32 CRC-32 (IEEE) of everything before it, big endian
+//
+// Locks are not part of a snapshot, as they only make sense to the process
+// holding them.
+
+const (
+	snapshotMagic   = "GCMS"
+	snapshotVersion = 1
+
+	// maxSnapshotField bounds lengths read from a snapshot whose size isn't
+	// known, which are otherwise bounded by the bytes left to read
+	maxSnapshotField = 1 << 31
+
+	// snapshotChunk is the largest allocation made ahead of reading a field of
+	// a snapshot whose size isn't known, so that a corrupt length can only
+	// cause allocations as large as the snapshot itself
+	snapshotChunk = 1 << 20
+)
+
+var (
+	// ErrInvalidSnapshot is returned when reading a snapshot which is corrupt,
+	// truncated or not a snapshot at all
+	ErrInvalidSnapshot = errors.New("invalid memory snapshot")
+
+	// ErrSnapshotVersion is returned when reading a snapshot written in a
+	// format this version doesn't understand
+	ErrSnapshotVersion = errors.New("unsupported memory snapshot version")
+)
+
+// Snapshot restores the store from the file at path when the engine is
+// created, skipping entries which hard expired in the meantime, and saves the
+// store to it every interval (if above 0) and when the engine is closed
+func Snapshot(path string, interval time.Duration) Option {
+	return func(e *Engine) {
+		e.snapshotPath = path
+		e.snapshotInterval = interval
+	}
+}
+
+// snapshotEntry is an entry as written to a snapshot
+type snapshotEntry struct {
+	key        string
+	data       []byte
+	expires    time.Time
+	hardExpire time.Time
+	tags       []string
+}
+
+// SaveSnapshot writes a snapshot of the store to the file at path. The
+// snapshot is written to a temporary file first, so the file at path is
+// always a complete snapshot.
+func (e *Engine) SaveSnapshot(path string) error {
+	e.snapshotLock.Lock()
+	defer e.snapshotLock.Unlock()
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	err = e.WriteSnapshot(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
+
+// WriteSnapshot writes a snapshot of the store to w
+func (e *Engine) WriteSnapshot(w io.Writer) error {
+	now := time.Now()
+
+	var entries []snapshotEntry
+	for _, s := range e.shards {
+		s.RLock()
+		for key, data := range s.store {
+			if !s.live(key, now) {
+				continue
+			}
+
+			entries = append(entries, snapshotEntry{
+				key:        key,
+				data:       data,
+				expires:    s.expire[key],
+				hardExpire: s.hardExpire[key],
+				tags:       s.keyTags[key],
+			})
+		}
+		s.RUnlock()
+	}
+
+	bw := bufio.NewWriter(w)
+	sw := &snapshotWriter{w: bw, crc: crc32.NewIEEE()}
+
+	sw.write([]byte(snapshotMagic))
+	sw.write([]byte{snapshotVersion >> 8, snapshotVersion & 0xff})
+	sw.uvarint(uint64(len(entries)))
+
+	for _, entry := range entries {
+		sw.bytes([]byte(entry.key))
+		sw.bytes(entry.data)
+		sw.time(entry.expires)
+		sw.time(entry.hardExpire)
+		sw.uvarint(uint64(len(entry.tags)))
+		for _, tag := range entry.tags {
+			sw.bytes([]byte(tag))
+		}
+	}
+
+	if sw.err != nil {
+		return sw.err
+	}
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], sw.crc.Sum32())
+	if _, err := bw.Write(checksum[:]); err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// ReadSnapshot adds the entries of the snapshot read from r to the store,
+// skipping those which have hard expired. Nothing is added unless the whole
+// snapshot is valid.
+func (e *Engine) ReadSnapshot(r io.Reader) error {
+	br := bufio.NewReader(r)
+	sr := &snapshotReader{r: br, crc: crc32.NewIEEE(), remaining: snapshotSize(r)}
+
+	magic := sr.read(len(snapshotMagic))
+	if sr.err == nil && string(magic) != snapshotMagic {
+		return ErrInvalidSnapshot
+	}
+
+	version := sr.read(2)
+	if sr.err == nil && int(version[0])<<8|int(version[1]) != snapshotVersion {
+		return ErrSnapshotVersion
+	}
+
+	count := sr.uvarint()
+
+	var entries []snapshotEntry
+	for i := uint64(0); i < count && sr.err == nil; i++ {
+		entry := snapshotEntry{
+			key:        string(sr.bytes()),
+			data:       sr.bytes(),
+			expires:    sr.time(),
+			hardExpire: sr.time(),
+		}
+
+		tags := sr.uvarint()
+		for j := uint64(0); j < tags && sr.err == nil; j++ {
+			entry.tags = append(entry.tags, string(sr.bytes()))
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if sr.err != nil {
+		return ErrInvalidSnapshot
+	}
+
+	var checksum [4]byte
+	if _, err := io.ReadFull(br, checksum[:]); err != nil || binary.BigEndian.Uint32(checksum[:]) != sr.crc.Sum32() {
+		return ErrInvalidSnapshot
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if !now.Before(entry.hardExpire) {
+			continue
+		}
+
+		e.put(entry.key, entry.data, entry.expires, entry.hardExpire, entry.tags)
+	}
+
+	return nil
+}
+
+// restoreSnapshot reads the snapshot file, if there is one
+func (e *Engine) restoreSnapshot() error {
+	f, err := os.Open(e.snapshotPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return e.ReadSnapshot(f)
+}
+
+// snapshotSize returns the number of bytes left to read from r, or -1 if it
+// isn't known
+func snapshotSize(r io.Reader) int64 {
+	switch r := r.(type) {
+	case interface {
+		Len() int
+	}:
+		return int64(r.Len())
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+
+		return info.Size() - offset
+	}
+
+	return -1
+}
+
+// snapshotPeriodically saves a snapshot every interval until the engine is
+// closed. Failures are retried at the next interval.
+func (e *Engine) snapshotPeriodically() {
+	if e.snapshotInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.snapshotInterval)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.SaveSnapshot(e.snapshotPath)
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// snapshotWriter writes snapshot fields, keeping the first error and a
+// checksum of everything written
+type snapshotWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (w *snapshotWriter) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+
+	w.crc.Write(p)
+	_, w.err = w.w.Write(p)
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.buf[:], v)
+	w.write(w.buf[:n])
+}
+
+func (w *snapshotWriter) varint(v int64) {
+	n := binary.PutVarint(w.buf[:], v)
+	w.write(w.buf[:n])
+}
+
+func (w *snapshotWriter) bytes(p []byte) {
+	w.uvarint(uint64(len(p)))
+	w.write(p)
+}
+
+func (w *snapshotWriter) time(t time.Time) {
+	w.varint(t.Unix())
+	w.uvarint(uint64(t.Nanosecond()))
+}
+
+// snapshotReader reads snapshot fields, keeping the first error and a
+// checksum of everything read. Lengths are checked against the bytes left to
+// read, if known.
+type snapshotReader struct {
+	r         *bufio.Reader
+	crc       hash.Hash32
+	remaining int64
+	err       error
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+		r.remaining--
+	}
+
+	return b, err
+}
+
+func (r *snapshotReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+
+	if r.remaining >= 0 && int64(n) > r.remaining {
+		r.err = ErrInvalidSnapshot
+		return nil
+	}
+
+	var p []byte
+	if r.remaining >= 0 || n <= snapshotChunk {
+		p = make([]byte, n)
+		_, r.err = io.ReadFull(r.r, p)
+	} else {
+		// The buffer grows with the data actually read
+		p, r.err = ioutil.ReadAll(io.LimitReader(r.r, int64(n)))
+		if r.err == nil && len(p) < n {
+			r.err = io.ErrUnexpectedEOF
+		}
+	}
+
+	r.crc.Write(p)
+	r.remaining -= int64(len(p))
+
+	return p
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	var v uint64
+	v, r.err = binary.ReadUvarint(r)
+
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	var v int64
+	v, r.err = binary.ReadVarint(r)
+
+	return v
+}
+
+func (r *snapshotReader) bytes() []byte {
+	n := r.uvarint()
+	if n > maxSnapshotField {
+		r.err = ErrInvalidSnapshot
+		return nil
+	}
+
+	return r.read(int(n))
+}
+
+func (r *snapshotReader) time() time.Time {
+	sec := r.varint()
+	nsec := r.uvarint()
+
+	return time.Unix(sec, int64(nsec))
+}
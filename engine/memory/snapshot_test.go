@@ -0,0 +1,183 @@
+package memory
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestInMemory_Snapshot(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+	memStore.Put("fresh", content, expires)
+	memStore.Put("stale", content, time.Now().Add(-time.Minute))
+	memStore.PutTagged("tagged", content, expires, []string{"product:1"})
+
+	var buf bytes.Buffer
+	err := memStore.WriteSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	restored := NewMemoryStore(time.Second*60, time.Hour)
+	err = restored.ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if restored.storeLen() != 3 {
+		t.Fatalf("3 entries should have been restored, %d given", restored.storeLen())
+	}
+
+	data, err := restored.Get("fresh")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(data, content) != 0 {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+
+	if restored.IsExpired("fresh") || !restored.IsExpired("stale") {
+		t.Fatal("expiry times should have been restored")
+	}
+
+	restored.ExpireTag("product:1")
+
+	if restored.Exists("tagged") {
+		t.Fatal("tags should have been restored")
+	}
+}
+
+func TestInMemory_SnapshotSkipsHardExpired(t *testing.T) {
+	memStore := NewMemoryStore(time.Second*60, time.Millisecond*20)
+	memStore.Put("existing", []byte("hello"), time.Now().Add(-time.Minute))
+
+	var buf bytes.Buffer
+	err := memStore.WriteSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// Wait until the entry has hard expired
+	time.Sleep(time.Millisecond * 30)
+
+	restored := NewMemoryStore(time.Second*60, time.Hour)
+	err = restored.ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if restored.storeLen() != 0 {
+		t.Fatalf("hard expired entries should not be restored, %d given", restored.storeLen())
+	}
+}
+
+func TestInMemory_SnapshotInvalid(t *testing.T) {
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+	memStore.Put("existing", []byte("hello"), time.Now().Add(time.Hour))
+
+	var buf bytes.Buffer
+	memStore.WriteSnapshot(&buf)
+	snapshot := buf.Bytes()
+
+	corrupt := append([]byte(nil), snapshot...)
+	corrupt[len(corrupt)-6] ^= 0xff
+
+	restored := NewMemoryStore(time.Second*60, time.Hour)
+
+	err := restored.ReadSnapshot(bytes.NewReader(corrupt))
+	if err != ErrInvalidSnapshot {
+		t.Fatalf("%s expected, %v given", ErrInvalidSnapshot, err)
+	}
+
+	err = restored.ReadSnapshot(bytes.NewReader(snapshot[:len(snapshot)-1]))
+	if err != ErrInvalidSnapshot {
+		t.Fatalf("%s expected, %v given", ErrInvalidSnapshot, err)
+	}
+
+	future := append([]byte(nil), snapshot...)
+	future[len(snapshotMagic)+1]++
+
+	err = restored.ReadSnapshot(bytes.NewReader(future))
+	if err != ErrSnapshotVersion {
+		t.Fatalf("%s expected, %v given", ErrSnapshotVersion, err)
+	}
+
+	if restored.storeLen() != 0 {
+		t.Fatalf("nothing should be restored from an invalid snapshot, %d given", restored.storeLen())
+	}
+}
+
+func TestInMemory_SnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-cache-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.snapshot")
+
+	memStore := NewMemoryStore(time.Second*60, time.Hour, Snapshot(path, 0))
+	memStore.Put("existing", []byte("hello"), time.Now().Add(time.Hour))
+
+	err = memStore.Close()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	restored := NewMemoryStore(time.Second*60, time.Hour, Snapshot(path, 0))
+	defer restored.Close()
+
+	if !restored.Exists("existing") {
+		t.Fatal("entries should be restored from the snapshot file")
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("temporary snapshot files should not be left behind, %d files given", len(files))
+	}
+}
+
+func TestInMemory_SnapshotCorruptLength(t *testing.T) {
+	memStore := NewMemoryStore(time.Second*60, time.Hour)
+	memStore.Put("existing", []byte("hello"), time.Now().Add(time.Hour))
+
+	var buf bytes.Buffer
+	memStore.WriteSnapshot(&buf)
+	snapshot := buf.Bytes()
+
+	// The key length follows the magic, version and count of 1, replace it
+	// with a length of 1 GiB
+	header := len(snapshotMagic) + 3
+	corrupt := append([]byte(nil), snapshot[:header]...)
+	corrupt = append(corrupt, 0x80, 0x80, 0x80, 0x80, 0x04)
+	corrupt = append(corrupt, snapshot[header+1:]...)
+
+	readers := map[string]io.Reader{
+		"known size":   bytes.NewReader(corrupt),
+		"unknown size": struct{ io.Reader }{bytes.NewReader(corrupt)},
+	}
+
+	for name, r := range readers {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+
+		err := NewMemoryStore(time.Second*60, time.Hour).ReadSnapshot(r)
+		if err != ErrInvalidSnapshot {
+			t.Fatalf("%s: %s expected, %v given", name, ErrInvalidSnapshot, err)
+		}
+
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+			t.Fatalf("%s: the corrupt length shouldn't be allocated, %d bytes allocated", name, allocated)
+		}
+	}
+}
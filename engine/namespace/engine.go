@@ -0,0 +1,309 @@
+package namespace
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// Engine wraps another storage engine, embedding a version number in every
+// namespaced key. A namespace is the part of a key before the first separator,
+// e.g. "search" for "search:shoes". Bumping the version of a namespace makes
+// every key stored under the old version unreachable, and those keys are left
+// to age out via the cleanup timeout of the wrapped engine.
+//
+// Every operation on a namespaced key reads the namespace version from the
+// wrapped engine first. Keys without a separator are passed through unchanged.
+//
+// Versions are started and bumped while holding the lock of the version key
+// in the wrapped engine, so concurrent callers agree on a single version.
+type Engine struct {
+	engine          common.Engine
+	separator       string
+	refreshInterval time.Duration
+
+	// When the version of each namespace was last stored by this engine
+	refreshedLock sync.Mutex
+	refreshed     map[string]time.Time
+}
+
+// Option configures optional behaviour of the namespace engine
+type Option func(*Engine)
+
+// RefreshInterval sets how often the version key of a namespace in use is
+// stored again, so that the wrapped engine doesn't remove it after its cleanup
+// timeout and invalidate the namespace. It must be shorter than the cleanup
+// timeout, and is a minute by default.
+func RefreshInterval(interval time.Duration) Option {
+	return func(e *Engine) {
+		e.refreshInterval = interval
+	}
+}
+
+const versionPrefix = "nsversion"
+
+// Version keys are never regenerated, so their soft expiry is pushed far into
+// the future. They are kept from being removed by the engine's cleanup timeout
+// by storing them again every refreshInterval while they are read.
+var versionExpiry = 100 * 365 * 24 * time.Hour
+
+const (
+	// defaultRefreshInterval is the refresh interval unless configured
+	defaultRefreshInterval = time.Minute
+
+	// versionLockAttempts is the number of attempts at locking a version key
+	// held by another caller, versionLockWait apart
+	versionLockAttempts = 50
+	versionLockWait     = 10 * time.Millisecond
+)
+
+// NewNamespaceStore creates a new namespaced store on top of the given engine
+func NewNamespaceStore(engine common.Engine, separator string, opts ...Option) *Engine {
+	e := &Engine{
+		engine:          engine,
+		separator:       separator,
+		refreshInterval: defaultRefreshInterval,
+		refreshed:       make(map[string]time.Time),
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e
+}
+
+// Exists checks to see if a key exists in the store
+func (e *Engine) Exists(key string) bool {
+	k, err := e.key(key)
+	if err != nil {
+		return false
+	}
+
+	return e.engine.Exists(k)
+}
+
+// Get retrieves data from the store based on key, if it exists, else it returns an error
+func (e *Engine) Get(key string) ([]byte, error) {
+	k, err := e.key(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return e.engine.Get(k)
+}
+
+// Put stores data against a key, else it returns an error
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	k, err := e.key(key)
+	if err != nil {
+		return err
+	}
+
+	return e.engine.Put(k, data, expires)
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	k, err := e.key(key)
+	if err != nil {
+		return false
+	}
+
+	return e.engine.IsExpired(k)
+}
+
+// Expire marks the key as expired, and removes it from the storage engine
+func (e *Engine) Expire(key string) error {
+	k, err := e.key(key)
+	if err != nil {
+		return err
+	}
+
+	return e.engine.Expire(k)
+}
+
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	k, err := e.key(key)
+	if err != nil {
+		return false
+	}
+
+	return e.engine.IsLocked(k)
+}
+
+// Lock sets a lock against the given key
+func (e *Engine) Lock(key string) error {
+	k, err := e.key(key)
+	if err != nil {
+		return err
+	}
+
+	return e.engine.Lock(k)
+}
+
+// Unlock removes the lock from a given key, if it doesn't exist it returns an error
+func (e *Engine) Unlock(key string) error {
+	k, err := e.key(key)
+	if err != nil {
+		return err
+	}
+
+	return e.engine.Unlock(k)
+}
+
+// InvalidateNamespace bumps the version of the namespace, so every key
+// currently stored within it becomes unreachable
+func (e *Engine) InvalidateNamespace(namespace string) error {
+	_, err := e.newVersion(namespace, true)
+	return err
+}
+
+// Close closes the wrapped engine, if it can be closed
+func (e *Engine) Close() error {
+	if closer, ok := e.engine.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// key returns the versioned key for the given key
+func (e *Engine) key(key string) (string, error) {
+	if e.separator == "" {
+		return key, nil
+	}
+
+	i := strings.Index(key, e.separator)
+	if i < 0 {
+		return key, nil
+	}
+
+	namespace := key[:i]
+
+	version, err := e.version(namespace)
+	if err != nil {
+		return "", err
+	}
+
+	return namespace + e.separator + version + e.separator + key[i+len(e.separator):], nil
+}
+
+// version returns the current version of the namespace, starting a new
+// version if there isn't one
+func (e *Engine) version(namespace string) (string, error) {
+	k := e.versionKey(namespace)
+
+	data, err := e.engine.Get(k)
+	if err != nil && err != common.ErrNonExistentKey {
+		return "", err
+	}
+
+	if len(data) == 0 {
+		return e.newVersion(namespace, false)
+	}
+
+	if e.refreshDue(namespace) {
+		e.refresh(namespace, data)
+	}
+
+	return string(data), nil
+}
+
+// newVersion starts a new version for the namespace, holding the lock of its
+// version key. Unless replace is set, a version started by another caller
+// since the version was read is kept and returned instead.
+//
+// Versions are based on the current time rather than a counter, so a version
+// key that has been cleaned up never brings back keys from an older version.
+func (e *Engine) newVersion(namespace string, replace bool) (string, error) {
+	k := e.versionKey(namespace)
+
+	err := e.lockVersion(k)
+	if err != nil {
+		return "", err
+	}
+	defer e.engine.Unlock(k)
+
+	if !replace {
+		data, err := e.engine.Get(k)
+		if err != nil && err != common.ErrNonExistentKey {
+			return "", err
+		}
+
+		if len(data) > 0 {
+			return string(data), nil
+		}
+	}
+
+	version := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	err = e.engine.Put(k, []byte(version), time.Now().Add(versionExpiry))
+	if err != nil {
+		return "", err
+	}
+
+	e.markRefreshed(namespace)
+
+	return version, nil
+}
+
+// refresh stores the version of the namespace again, restarting the cleanup
+// timeout of the wrapped engine, unless the version changed since it was read.
+// Failures are left for the next refresh.
+func (e *Engine) refresh(namespace string, version []byte) {
+	k := e.versionKey(namespace)
+
+	// Another caller is writing the version
+	if e.engine.Lock(k) != nil {
+		return
+	}
+	defer e.engine.Unlock(k)
+
+	data, err := e.engine.Get(k)
+	if err != nil || string(data) != string(version) {
+		return
+	}
+
+	if e.engine.Put(k, version, time.Now().Add(versionExpiry)) == nil {
+		e.markRefreshed(namespace)
+	}
+}
+
+// lockVersion locks a version key, waiting for other callers holding it
+func (e *Engine) lockVersion(k string) error {
+	for attempt := 1; ; attempt++ {
+		err := e.engine.Lock(k)
+		if err != common.ErrKeyAlreadyLocked || attempt == versionLockAttempts {
+			return err
+		}
+
+		time.Sleep(versionLockWait)
+	}
+}
+
+// refreshDue reports whether the version of the namespace hasn't been stored
+// by this engine for refreshInterval
+func (e *Engine) refreshDue(namespace string) bool {
+	e.refreshedLock.Lock()
+	defer e.refreshedLock.Unlock()
+
+	return time.Since(e.refreshed[namespace]) >= e.refreshInterval
+}
+
+// markRefreshed records that the version of the namespace was just stored
+func (e *Engine) markRefreshed(namespace string) {
+	e.refreshedLock.Lock()
+	e.refreshed[namespace] = time.Now()
+	e.refreshedLock.Unlock()
+}
+
+// helper function for namespace version keys
+func (e *Engine) versionKey(namespace string) string {
+	return versionPrefix + e.separator + namespace
+}
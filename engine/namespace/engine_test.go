@@ -0,0 +1,189 @@
+package namespace
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/fresh8/go-cache/engine/memory"
+)
+
+func TestNamespace_Key(t *testing.T) {
+	memStore := memory.NewMemoryStore(time.Second*60, time.Hour)
+	nsStore := NewNamespaceStore(memStore, ":")
+
+	key, err := nsStore.key("plain")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if key != "plain" {
+		t.Fatalf("keys without a namespace should be unchanged, %s given", key)
+	}
+
+	key, err = nsStore.key("search:shoes:red")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	version, err := memStore.Get("nsversion:search")
+	if err != nil {
+		t.Fatalf("namespace version should have been stored, %s given", err)
+	}
+
+	expected := "search:" + string(version) + ":shoes:red"
+	if key != expected {
+		t.Fatalf("%s expected, %s given", expected, key)
+	}
+}
+
+func TestNamespace_PutGet(t *testing.T) {
+	content := []byte("hello")
+
+	nsStore := NewNamespaceStore(memory.NewMemoryStore(time.Second*60, time.Hour), ":")
+
+	err := nsStore.Put("search:shoes", content, time.Now().Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !nsStore.Exists("search:shoes") {
+		t.Fatal("key exists, marked as non-existent")
+	}
+
+	data, err := nsStore.Get("search:shoes")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(data, content) != 0 {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+
+	if nsStore.IsExpired("search:shoes") {
+		t.Fatal("key should not have expired")
+	}
+}
+
+func TestNamespace_InvalidateNamespace(t *testing.T) {
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	nsStore := NewNamespaceStore(memory.NewMemoryStore(time.Second*60, time.Hour), ":")
+
+	nsStore.Put("search:shoes", content, expires)
+	nsStore.Put("search:hats", content, expires)
+	nsStore.Put("product:1", content, expires)
+	nsStore.Lock("search:shoes")
+
+	err := nsStore.InvalidateNamespace("search")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if nsStore.Exists("search:shoes") || nsStore.Exists("search:hats") {
+		t.Fatal("keys in an invalidated namespace should not exist")
+	}
+
+	if nsStore.IsLocked("search:shoes") {
+		t.Fatal("locks in an invalidated namespace should not be held")
+	}
+
+	_, err = nsStore.Get("search:shoes")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existing key error expected, %s given", err)
+	}
+
+	if !nsStore.Exists("product:1") {
+		t.Fatal("keys in other namespaces should still exist")
+	}
+
+	err = nsStore.Put("search:shoes", content, expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !nsStore.Exists("search:shoes") {
+		t.Fatal("key stored after invalidation should exist")
+	}
+}
+
+func TestNamespace_VersionError(t *testing.T) {
+	failure := errors.New("timeout")
+	puts := 0
+
+	nsStore := NewNamespaceStore(&common.EngineMock{
+		GetFunc: func(key string) ([]byte, error) { return nil, failure },
+		PutFunc: func(key string, data []byte, expires time.Time) error {
+			puts++
+			return nil
+		},
+		LockFunc:   func(key string) error { return nil },
+		UnlockFunc: func(key string) error { return nil },
+	}, ":")
+
+	_, err := nsStore.Get("search:shoes")
+	if err != failure {
+		t.Fatalf("%s expected, %v given", failure, err)
+	}
+
+	if puts != 0 {
+		t.Fatal("a new version shouldn't be started when the version can't be read")
+	}
+}
+
+func TestNamespace_VersionRefresh(t *testing.T) {
+	memStore := memory.NewMemoryStore(time.Hour, 50*time.Millisecond)
+	nsStore := NewNamespaceStore(memStore, ":", RefreshInterval(10*time.Millisecond))
+
+	nsStore.Put("search:shoes", []byte("hello"), time.Now().Add(time.Hour))
+
+	version, err := memStore.Get("nsversion:search")
+	if err != nil {
+		t.Fatalf("namespace version should have been stored, %s given", err)
+	}
+
+	// Keep reading the namespace for longer than the cleanup timeout
+	for i := 0; i < 15; i++ {
+		nsStore.Exists("search:shoes")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	current, err := memStore.Get("nsversion:search")
+	if err != nil || !bytes.Equal(current, version) {
+		t.Fatalf("the version in use should have been kept, %s given", current)
+	}
+}
+
+// racingEngine starts a version for the namespace the first time its version
+// is read, as another caller would between the read and the write
+type racingEngine struct {
+	*memory.Engine
+	raced bool
+}
+
+func (e *racingEngine) Get(key string) ([]byte, error) {
+	if key == "nsversion:search" && !e.raced {
+		e.raced = true
+		e.Engine.Put(key, []byte("winner"), time.Now().Add(time.Hour))
+		return nil, common.ErrNonExistentKey
+	}
+
+	return e.Engine.Get(key)
+}
+
+func TestNamespace_VersionRace(t *testing.T) {
+	engine := &racingEngine{Engine: memory.NewMemoryStore(time.Second*60, time.Hour)}
+	nsStore := NewNamespaceStore(engine, ":")
+
+	key, err := nsStore.key("search:shoes")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if key != "search:winner:shoes" {
+		t.Fatalf("the version started by the other caller should be used, %s given", key)
+	}
+}
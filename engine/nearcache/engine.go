@@ -0,0 +1,272 @@
+// Package nearcache keeps a local in-memory copy of the hot entries of a
+// remote engine, such as redisring or rediscluster, dropping them as soon as
+// an Invalidator reports that they changed remotely.
+package nearcache
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/fresh8/go-cache/engine/memory"
+)
+
+// Engine serves reads of fresh entries from a local copy, and everything else
+// from the remote engine. Locks are always taken and checked remotely, as are
+// expired entries, so that only one process regenerates them.
+type Engine struct {
+	remote      common.Engine
+	fetcher     common.Fetcher
+	local       *memory.Engine
+	invalidator Invalidator
+	ttl         time.Duration
+
+	// Keys being loaded from the remote engine, which are only copied locally
+	// if they weren't invalidated while loading
+	loadsLock sync.Mutex
+	loads     map[string]*load
+}
+
+type load struct {
+	n           int
+	invalidated bool
+}
+
+// New creates a near cache in front of the remote engine, which must implement
+// common.Fetcher. Local copies are kept for at most ttl, bounding how stale
+// they can get should invalidations be lost. The options configure the local
+// memory engine, such as memory.MaxEntries to bound its size.
+func New(remote common.Engine, invalidator Invalidator, ttl time.Duration, opts ...memory.Option) (*Engine, error) {
+	fetcher, ok := remote.(common.Fetcher)
+	if !ok {
+		return nil, common.ErrNotSupported
+	}
+
+	e := &Engine{
+		remote:      remote,
+		fetcher:     fetcher,
+		local:       memory.NewMemoryStore(ttl, ttl, opts...),
+		invalidator: invalidator,
+		ttl:         ttl,
+		loads:       make(map[string]*load),
+	}
+
+	err := invalidator.Subscribe(e.invalidate)
+	if err != nil {
+		e.local.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// Exists checks to see if a key exists locally or in the remote engine
+func (e *Engine) Exists(key string) bool {
+	return e.local.Exists(key) || e.remote.Exists(key)
+}
+
+// Get retrieves data from the local copy, or from the remote engine, copying
+// it locally
+func (e *Engine) Get(key string) ([]byte, error) {
+	entry, err := e.Fetch(key)
+	return entry.Data, err
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state.
+// Fresh entries are served from the local copy, with a zero expiry time and
+// unlocked, as the lock only matters once the entry has expired.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	if !e.local.IsExpired(key) {
+		data, err := e.local.Get(key)
+		if err == nil {
+			return common.Entry{Key: key, Data: data}, nil
+		}
+	}
+
+	e.loadsLock.Lock()
+	l := e.loads[key]
+	if l == nil {
+		l = &load{}
+		e.loads[key] = l
+	}
+	l.n++
+	e.loadsLock.Unlock()
+
+	entry, err := e.fetcher.Fetch(key)
+
+	e.loadsLock.Lock()
+	defer e.loadsLock.Unlock()
+
+	l.n--
+	if l.n == 0 {
+		delete(e.loads, key)
+	}
+
+	if err == nil && !l.invalidated {
+		expires := entry.Expires
+		if expires.IsZero() {
+			expires = time.Now().Add(e.ttl)
+		}
+
+		e.local.Put(key, entry.Data, expires)
+	}
+
+	return entry, err
+}
+
+// Put stores data against a key in the remote engine, and invalidates the
+// local copies
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	err := e.remote.Put(key, data, expires)
+	e.Invalidate(key)
+
+	return err
+}
+
+// PutTagged stores data against a key in the remote engine, adding it to the
+// set of each tag, and invalidates the local copies
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	tagger, ok := e.remote.(common.Tagger)
+	if !ok {
+		return common.ErrNotSupported
+	}
+
+	err := tagger.PutTagged(key, data, expires, tags)
+	e.Invalidate(key)
+
+	return err
+}
+
+// IsExpired checks to see if the key has expired, locally if there is a local
+// copy
+func (e *Engine) IsExpired(key string) bool {
+	if e.local.Exists(key) {
+		return e.local.IsExpired(key)
+	}
+
+	return e.remote.IsExpired(key)
+}
+
+// Expire removes the key from the remote engine, and invalidates the local
+// copies
+func (e *Engine) Expire(key string) error {
+	err := e.remote.Expire(key)
+	e.Invalidate(key)
+
+	return err
+}
+
+// ExpireTag removes every key carrying the tag from the remote engine. Local
+// copies don't know their tags, so they are all invalidated.
+func (e *Engine) ExpireTag(tag string) error {
+	tagger, ok := e.remote.(common.Tagger)
+	if !ok {
+		return common.ErrNotSupported
+	}
+
+	err := tagger.ExpireTag(tag)
+	e.Invalidate("")
+
+	return err
+}
+
+// DeletePrefix removes every key starting with the prefix from the remote
+// engine, and invalidates every local copy
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.DeleteMatching(common.EscapeGlob(prefix)+"*", progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the remote
+// engine, and invalidates every local copy
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	deleter, ok := e.remote.(common.PrefixDeleter)
+	if !ok {
+		return 0, common.ErrNotSupported
+	}
+
+	deleted, err := deleter.DeleteMatching(pattern, progress)
+	e.Invalidate("")
+
+	return deleted, err
+}
+
+// Scan returns a page of keys from the remote engine
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	scanner, ok := e.remote.(common.Scanner)
+	if !ok {
+		return nil, "", common.ErrNotSupported
+	}
+
+	return scanner.Scan(cursor, prefix, count)
+}
+
+// ScanEntries returns a page of entries from the remote engine
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
+	scanner, ok := e.remote.(common.Scanner)
+	if !ok {
+		return nil, "", common.ErrNotSupported
+	}
+
+	return scanner.ScanEntries(cursor, prefix, count)
+}
+
+// Lock sets a lock against a given key in the remote engine
+func (e *Engine) Lock(key string) error {
+	return e.remote.Lock(key)
+}
+
+// Unlock removes the lock from a given key in the remote engine
+func (e *Engine) Unlock(key string) error {
+	return e.remote.Unlock(key)
+}
+
+// IsLocked checks to see if the key has been locked in the remote engine
+func (e *Engine) IsLocked(key string) bool {
+	return e.remote.IsLocked(key)
+}
+
+// Invalidate drops the local copy of a key, or every local copy given "", and
+// tells the other near caches to do the same
+func (e *Engine) Invalidate(key string) error {
+	e.invalidate(key)
+
+	return e.invalidator.Invalidate(key)
+}
+
+// Close stops listening for invalidations, and closes the local copy and the
+// remote engine, if it can be closed
+func (e *Engine) Close() error {
+	err := e.invalidator.Close()
+	e.local.Close()
+
+	if closer, ok := e.remote.(io.Closer); ok {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// invalidate drops the local copy of a key, or every local copy given "",
+// making sure loads in progress don't copy stale data back
+func (e *Engine) invalidate(key string) {
+	e.loadsLock.Lock()
+	defer e.loadsLock.Unlock()
+
+	if key == "" {
+		for _, l := range e.loads {
+			l.invalidated = true
+		}
+
+		e.local.DeleteMatching("*", nil)
+		return
+	}
+
+	if l := e.loads[key]; l != nil {
+		l.invalidated = true
+	}
+
+	e.local.Expire(key)
+}
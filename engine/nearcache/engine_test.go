@@ -0,0 +1,151 @@
+package nearcache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/fresh8/go-cache/engine/redisring"
+	"github.com/go-redis/redis"
+)
+
+// countingEngine counts the fetches reaching the remote engine
+type countingEngine struct {
+	*redisring.Engine
+	fetches int
+}
+
+func (c *countingEngine) Fetch(key string) (common.Entry, error) {
+	c.fetches++
+	return c.Engine.Fetch(key)
+}
+
+// fakeInvalidator passes invalidations on to every near cache sharing it
+type fakeInvalidator struct {
+	fns []func(key string)
+}
+
+func (f *fakeInvalidator) Subscribe(fn func(key string)) error {
+	f.fns = append(f.fns, fn)
+	return nil
+}
+
+func (f *fakeInvalidator) Invalidate(key string) error {
+	for _, fn := range f.fns {
+		fn(key)
+	}
+	return nil
+}
+
+func (f *fakeInvalidator) Close() error {
+	return nil
+}
+
+func newTestStore(t *testing.T) (*miniredis.Miniredis, *countingEngine, *fakeInvalidator, *Engine) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ring := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"shard0": server.Addr()}})
+	remoteEngine, err := redisring.NewRedisRingStore("testing", ring, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	remote := &countingEngine{Engine: remoteEngine}
+	invalidator := &fakeInvalidator{}
+
+	engine, err := New(remote, invalidator, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, remote, invalidator, engine
+}
+
+func TestNearCache_Fetch(t *testing.T) {
+	server, remote, _, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	err := engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		data, err := engine.Get("key")
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("hello expected, %s given", data)
+		}
+	}
+
+	if remote.fetches != 1 {
+		t.Fatalf("only the first get should reach the remote engine, %d fetches given", remote.fetches)
+	}
+
+	_, err = engine.Get("missing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestNearCache_Invalidate(t *testing.T) {
+	server, remote, invalidator, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	other, err := New(remote, invalidator, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	engine.Put("key", []byte("first"), time.Now().Add(time.Hour))
+	other.Get("key")
+
+	engine.Put("key", []byte("second"), time.Now().Add(time.Hour))
+
+	data, _ := other.Get("key")
+	if string(data) != "second" {
+		t.Fatalf("the local copy should have been invalidated, %s given", data)
+	}
+
+	engine.Get("key")
+	fetches := remote.fetches
+
+	invalidator.Invalidate(flushMessage)
+
+	engine.Get("key")
+	other.Get("key")
+
+	if remote.fetches != fetches+2 {
+		t.Fatal("every local copy should have been invalidated")
+	}
+}
+
+func TestNearCache_InvalidateWhileLoading(t *testing.T) {
+	server, _, _, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+
+	engine.loads["key"] = &load{n: 1}
+	engine.invalidate("key")
+
+	engine.Fetch("key")
+
+	if engine.local.Exists("key") {
+		t.Fatal("data loaded while invalidated shouldn't be copied locally")
+	}
+}
+
+func TestNearCache_NotSupported(t *testing.T) {
+	_, err := New(&common.EngineMock{}, &fakeInvalidator{}, time.Minute)
+	if err != common.ErrNotSupported {
+		t.Fatalf("%s expected, %v given", common.ErrNotSupported, err)
+	}
+}
@@ -0,0 +1,129 @@
+package nearcache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Invalidator tells near caches when entries change remotely
+type Invalidator interface {
+	// Subscribe starts calling fn with the key of each entry changed
+	// remotely, or with "" when every local copy must be dropped, such as
+	// when invalidations may have been missed
+	Subscribe(fn func(key string)) error
+	// Invalidate tells the other near caches that the entry of the key, or
+	// every entry given "", changed
+	Invalidate(key string) error
+	// Close stops listening for invalidations
+	Close() error
+}
+
+// flushMessage is published to invalidate every entry, as no key is empty
+const flushMessage = ""
+
+// PubSubClient is the part of the go-redis clients used by PubSub, which
+// *redis.Client, *redis.Ring and *redis.ClusterClient all implement
+type PubSubClient interface {
+	Publish(channel string, message interface{}) *redis.IntCmd
+	Subscribe(channels ...string) *redis.PubSub
+}
+
+// PubSub invalidates near caches by publishing the changed keys on a channel
+// which every near cache subscribes to. It works with any Redis version, but
+// only changes made through a near cache are seen.
+type PubSub struct {
+	client  PubSubClient
+	channel string
+
+	pubsub *redis.PubSub
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// retryInterval is the time waited before receiving again after an error
+const retryInterval = 100 * time.Millisecond
+
+// NewPubSub creates an invalidator publishing on the channel
+func NewPubSub(client PubSubClient, channel string) *PubSub {
+	return &PubSub{
+		client:  client,
+		channel: channel,
+		done:    make(chan struct{}),
+	}
+}
+
+// Subscribe starts listening for changed keys
+func (p *PubSub) Subscribe(fn func(key string)) error {
+	p.pubsub = p.client.Subscribe(p.channel)
+
+	// Wait for the subscription, so no invalidation published from now on
+	// is missed
+	_, err := p.pubsub.ReceiveTimeout(5 * time.Second)
+	if err != nil {
+		p.pubsub.Close()
+		return err
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		for {
+			msg, err := p.pubsub.Receive()
+
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+
+			p.handle(msg, err, fn)
+
+			if err != nil {
+				// go-redis reconnects on the next receive
+				select {
+				case <-p.done:
+					return
+				case <-time.After(retryInterval):
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// handle passes on a changed key. Anything else means the connection was
+// lost and resubscribed, missing invalidations in the meantime.
+func (p *PubSub) handle(msg interface{}, err error, fn func(key string)) {
+	if m, ok := msg.(*redis.Message); ok && err == nil {
+		fn(m.Payload)
+		return
+	}
+
+	if _, ok := msg.(*redis.Pong); ok {
+		return
+	}
+
+	fn(flushMessage)
+}
+
+// Invalidate publishes the key
+func (p *PubSub) Invalidate(key string) error {
+	return p.client.Publish(p.channel, key).Err()
+}
+
+// Close stops listening for changed keys
+func (p *PubSub) Close() error {
+	if p.pubsub == nil {
+		return nil
+	}
+
+	close(p.done)
+	err := p.pubsub.Close()
+	p.wg.Wait()
+
+	return err
+}
@@ -0,0 +1,23 @@
+package nearcache
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+func TestPubSub_Handle(t *testing.T) {
+	var keys []string
+	fn := func(key string) { keys = append(keys, key) }
+
+	pubsub := NewPubSub(nil, "invalidations")
+
+	pubsub.handle(&redis.Message{Channel: "invalidations", Payload: "key"}, nil, fn)
+	pubsub.handle(&redis.Pong{}, nil, fn)
+	pubsub.handle(nil, errors.New("connection reset"), fn)
+
+	if len(keys) != 2 || keys[0] != "key" || keys[1] != flushMessage {
+		t.Fatalf("the key then a flush expected, %q given", keys)
+	}
+}
@@ -0,0 +1,194 @@
+package nearcache
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// ErrClosed is returned when subscribing once the invalidator is closed
+var ErrClosed = errors.New("invalidator closed")
+
+// invalidateChannel is the channel Redis publishes tracking invalidations on
+const invalidateChannel = "__redis__:invalidate"
+
+// Tracking invalidates near caches using the client side caching support of
+// Redis 6 and later. The server broadcasts every change to a key starting with
+// the prefix, whoever made it, so no invalidation needs to be published.
+//
+// Invalidations are received over a connection of its own, which redirects its
+// tracking to itself and subscribes to them, as the RESP2 protocol requires.
+// go-redis can't parse these messages, so the connection is made with redigo.
+// Only the hash tagged keys used by redisring and rediscluster are understood,
+// and as tracking is per server, the dial function should connect to a single
+// Redis server holding every key.
+type Tracking struct {
+	dial   func() (redigo.Conn, error)
+	prefix string
+
+	connLock sync.Mutex
+	conn     redigo.Conn
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewTracking creates an invalidator for the keys of engines created with the
+// given prefix
+func NewTracking(dial func() (redigo.Conn, error), prefix string) *Tracking {
+	return &Tracking{
+		dial:   dial,
+		prefix: prefix + ":",
+		done:   make(chan struct{}),
+	}
+}
+
+// Subscribe connects and starts listening for changed keys, reconnecting if
+// the connection is lost
+func (t *Tracking) Subscribe(fn func(key string)) error {
+	conn, err := t.connect()
+	if err != nil {
+		return err
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		for {
+			reply, err := conn.Receive()
+			if err == nil {
+				t.handle(reply, fn)
+				continue
+			}
+
+			conn.Close()
+
+			// Invalidations are missed until tracking is enabled again
+			fn(flushMessage)
+
+			for {
+				select {
+				case <-t.done:
+					return
+				case <-time.After(retryInterval):
+				}
+
+				conn, err = t.connect()
+				if err == nil {
+					break
+				}
+			}
+
+			// Changes made while reconnecting weren't tracked
+			fn(flushMessage)
+		}
+	}()
+
+	return nil
+}
+
+// connect opens a connection tracking the keys with the prefix, and
+// subscribed to their invalidations
+func (t *Tracking) connect() (redigo.Conn, error) {
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := redigo.Int64(conn.Do("CLIENT", "ID"))
+	if err == nil {
+		_, err = conn.Do("CLIENT", "TRACKING", "on", "REDIRECT", id, "BCAST", "PREFIX", t.prefix)
+	}
+	if err == nil {
+		_, err = conn.Do("SUBSCRIBE", invalidateChannel)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	t.connLock.Lock()
+	defer t.connLock.Unlock()
+
+	select {
+	case <-t.done:
+		conn.Close()
+		return nil, ErrClosed
+	default:
+	}
+
+	t.conn = conn
+	return conn, nil
+}
+
+// handle passes on the keys of an invalidation message. A message without
+// keys means the server flushed its data, or lost track of the keys.
+func (t *Tracking) handle(reply interface{}, fn func(key string)) {
+	values, err := redigo.Values(reply, nil)
+	if err != nil || len(values) != 3 {
+		return
+	}
+
+	kind, _ := redigo.String(values[0], nil)
+	channel, _ := redigo.String(values[1], nil)
+	if kind != "message" || channel != invalidateChannel {
+		return
+	}
+
+	if values[2] == nil {
+		fn(flushMessage)
+		return
+	}
+
+	keys, err := redigo.Strings(values[2], nil)
+	if err != nil {
+		fn(flushMessage)
+		return
+	}
+
+	for _, k := range keys {
+		if key, ok := t.cacheKey(k); ok {
+			fn(key)
+		}
+	}
+}
+
+// cacheKey returns the cache key of a data, expiry or lock key, found in its
+// hash tag
+func (t *Tracking) cacheKey(k string) (string, bool) {
+	if !strings.HasPrefix(k, t.prefix) {
+		return "", false
+	}
+	k = k[len(t.prefix):]
+
+	start := strings.IndexByte(k, '{')
+	end := strings.LastIndexByte(k, '}')
+	if start < 0 || end <= start {
+		return "", false
+	}
+
+	return k[start+1 : end], true
+}
+
+// Invalidate does nothing, as the server reports changes itself
+func (t *Tracking) Invalidate(key string) error {
+	return nil
+}
+
+// Close stops listening for changed keys
+func (t *Tracking) Close() error {
+	t.connLock.Lock()
+	close(t.done)
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.connLock.Unlock()
+
+	t.wg.Wait()
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package nearcache
+
+import (
+	"testing"
+
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+)
+
+func TestTracking_Handle(t *testing.T) {
+	var keys []string
+	fn := func(key string) { keys = append(keys, key) }
+
+	tracking := NewTracking(nil, "testing")
+
+	tracking.handle([]interface{}{
+		[]byte("message"),
+		[]byte(invalidateChannel),
+		[]interface{}{
+			[]byte("testing:{key:1}"),
+			[]byte("testing:expire:{key:2}"),
+			[]byte("testing:tag:all"),
+			[]byte("other:{key:3}"),
+		},
+	}, fn)
+
+	if len(keys) != 2 || keys[0] != "key:1" || keys[1] != "key:2" {
+		t.Fatalf("the keys of the entries expected, %q given", keys)
+	}
+
+	keys = nil
+	tracking.handle([]interface{}{[]byte("message"), []byte(invalidateChannel), nil}, fn)
+	tracking.handle([]interface{}{[]byte("subscribe"), []byte(invalidateChannel), int64(1)}, fn)
+
+	if len(keys) != 1 || keys[0] != flushMessage {
+		t.Fatalf("a flush expected, %q given", keys)
+	}
+}
+
+func TestTracking_Closed(t *testing.T) {
+	tracking := NewTracking(func() (redigo.Conn, error) {
+		conn := redigomock.NewConn()
+		conn.GenericCommand("CLIENT").Expect(int64(1))
+		conn.GenericCommand("SUBSCRIBE").Expect("OK")
+		return conn, nil
+	}, "testing")
+
+	tracking.Close()
+
+	err := tracking.Subscribe(func(key string) {})
+	if err != ErrClosed {
+		t.Fatalf("%s expected, %v given", ErrClosed, err)
+	}
+}
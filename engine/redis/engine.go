@@ -1,6 +1,10 @@
 package redis
 
 import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/fresh8/go-cache/engine/common"
@@ -13,29 +17,71 @@ type pl interface {
 
 // Engine is the default Redis storage engine
 type Engine struct {
-	prefix string
-	pool   pl
+	prefix   string
+	pool     pl
+	readPool pl
 
 	cleanupTimeout time.Duration
+	layout         Layout
+
+	// Tokens of the locks held by this engine, so that only the holder of a
+	// lock can write while it is held, or release it
+	tokensLock sync.Mutex
+	tokens     map[string]string
 }
 
 var (
 	expirePrefix = "expire:"
 	lockPrefix   = "lock:"
+	tagPrefix    = "tag:"
+
+	// scanCount is the number of keys requested per SCAN iteration
+	scanCount = 1000
 )
 
+// Option configures optional behaviour of the Redis engine
+type Option func(*Engine)
+
+// StorageLayout sets the way entries are stored, KeysLayout by default
+func StorageLayout(layout Layout) Option {
+	return func(e *Engine) {
+		e.layout = layout
+	}
+}
+
+// ReadPool routes reads (Exists, Get, Fetch, IsExpired and IsLocked) to another
+// pool, such as one of replicas, while writes use the main pool. Reads from
+// replicas may lag behind writes, so a key may be regenerated twice or its
+// stale data served for a little longer.
+func ReadPool(pool pl) Option {
+	return func(e *Engine) {
+		e.readPool = pool
+	}
+}
+
 // NewRedisStore creates a new standard Redis-backed store
-func NewRedisStore(prefix string, pool pl, cleanupTimeout time.Duration) *Engine {
-	return &Engine{
+func NewRedisStore(prefix string, pool pl, cleanupTimeout time.Duration, opts ...Option) *Engine {
+	e := &Engine{
 		prefix:         prefix + ":",
 		pool:           pool,
 		cleanupTimeout: cleanupTimeout,
+		tokens:         make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		opt(e)
 	}
+
+	return e
 }
 
 // Exists checks to see if a key exists in the store
 func (e *Engine) Exists(key string) bool {
-	conn := e.pool.Get()
+	if e.layout == HashLayout {
+		return e.hashExists(key)
+	}
+
+	conn := e.reader().Get()
 	defer conn.Close()
 
 	exists, err := redigo.Bool(conn.Do("EXISTS", e.prefix+key))
@@ -49,7 +95,11 @@ func (e *Engine) Exists(key string) bool {
 
 // Get retrieves data from the store based on key, if it exists, else it returns an error
 func (e *Engine) Get(key string) (data []byte, err error) {
-	conn := e.pool.Get()
+	if e.layout == HashLayout {
+		return e.hashGet(key)
+	}
+
+	conn := e.reader().Get()
 	defer conn.Close()
 
 	data, err = redigo.Bytes(conn.Do("GET", e.prefix+key))
@@ -62,72 +112,440 @@ func (e *Engine) Get(key string) (data []byte, err error) {
 
 // Put stores data against a key, else it returns an error
 func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	return e.PutTagged(key, data, expires, nil)
+}
+
+// PutTagged stores data against a key and adds the key to the set of each tag.
+// While this engine holds the lock on the key, nothing is stored unless the
+// lock is still held, in which case common.ErrLockNotHeld is returned.
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	if e.layout == HashLayout {
+		return e.hashPutTagged(key, data, expires, tags)
+	}
+
+	conn := e.pool.Get()
+	defer conn.Close()
+
+	args := []interface{}{
+		3 + len(tags),
+		e.prefix + key,
+		e.prefix + expirePrefix + key,
+		e.prefix + lockPrefix + key,
+	}
+	for _, tag := range tags {
+		args = append(args, e.prefix+tagPrefix+tag)
+	}
+	args = append(args, data, expires.Unix(), e.ttl(), e.token(key), key)
+
+	stored, err := redigo.Bool(putScript.Do(conn, args...))
+	if err != nil {
+		return err
+	}
+
+	if !stored {
+		return common.ErrLockNotHeld
+	}
+
+	return nil
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state,
+// atomically and in a single round trip. If the key doesn't exist
+// common.ErrNonExistentKey is returned, along with the lock state.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	if e.layout == HashLayout {
+		return e.hashFetch(key)
+	}
+
+	conn := e.reader().Get()
+	defer conn.Close()
+
+	entry := common.Entry{Key: key}
+
+	values, err := redigo.Values(fetchScript.Do(conn,
+		e.prefix+key,
+		e.prefix+expirePrefix+key,
+		e.prefix+lockPrefix+key,
+	))
+	if err != nil {
+		return entry, err
+	}
+
+	if len(values) != 3 {
+		return entry, common.ErrInvalidData
+	}
+
+	entry.Locked, err = redigo.Bool(values[2], nil)
+	if err != nil {
+		return entry, err
+	}
+
+	expires, err := redigo.Int64(values[1], nil)
+	if err == nil {
+		entry.Expires = time.Unix(expires, 0)
+	} else if err != redigo.ErrNil {
+		return entry, err
+	}
+
+	entry.Data, err = redigo.Bytes(values[0], nil)
+	if err == redigo.ErrNil {
+		return entry, common.ErrNonExistentKey
+	}
+
+	return entry, err
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	if e.layout == HashLayout {
+		return e.hashIsExpired(key)
+	}
+
+	conn := e.reader().Get()
+	defer conn.Close()
+
+	expiryTime, err := redigo.Int64(conn.Do("GET", e.prefix+expirePrefix+key))
+	// TODO: Handle this error properly
+	if err != nil {
+		return false
+	}
+
+	return time.Now().Unix() > expiryTime
+}
+
+// Expire marks the key as expired, and removes it from the storage engine
+func (e *Engine) Expire(key string) error {
 	conn := e.pool.Get()
 	defer conn.Close()
 
 	// Pipeline commands
 	conn.Send("MULTI")
-	conn.Send("SETEX", e.prefix+key, e.cleanupTimeout.Seconds(), data)
-	conn.Send("SETEX", e.prefix+expirePrefix+key, e.cleanupTimeout.Seconds(), expires.Unix())
+	for _, k := range e.entryKeys(key) {
+		conn.Send("DEL", k)
+	}
 	_, err := conn.Do("EXEC")
 
 	return err
 }
 
-// IsExpired checks to see if the key has expired
-func (e *Engine) IsExpired(key string) bool {
-	if e.Exists(expirePrefix + key) {
-		conn := e.pool.Get()
-		defer conn.Close()
+// ExpireTag removes every key in the set of the given tag from the storage engine
+func (e *Engine) ExpireTag(tag string) error {
+	conn := e.pool.Get()
+	defer conn.Close()
 
-		expiryTime, err := redigo.Int64(conn.Do("GET", e.prefix+expirePrefix+key))
-		// TODO: Handle this error properly
+	keys, err := redigo.Strings(conn.Do("SMEMBERS", e.prefix+tagPrefix+tag))
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Pipeline commands, only removing the members read so that keys tagged
+	// in the meantime are kept in the set
+	conn.Send("MULTI")
+	for _, key := range keys {
+		for _, k := range e.entryKeys(key) {
+			conn.Send("DEL", k)
+		}
+		conn.Send("SREM", e.prefix+tagPrefix+tag, key)
+	}
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// DeletePrefix removes every key starting with the prefix from the storage engine
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.DeleteMatching(common.EscapeGlob(prefix)+"*", progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the storage
+// engine, using SCAN to walk the keyspace and UNLINK to free memory in the background
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	conn := e.pool.Get()
+	defer conn.Close()
+
+	match := common.EscapeGlob(e.prefix) + pattern
+	cursor := 0
+	deleted := 0
+
+	for {
+		values, err := redigo.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", scanCount))
 		if err != nil {
-			return false
+			return deleted, err
 		}
 
-		if time.Now().Unix() > expiryTime {
-			return true
+		cursor, err = redigo.Int(values[0], nil)
+		if err != nil {
+			return deleted, err
+		}
+
+		keys, err := redigo.Strings(values[1], nil)
+		if err != nil {
+			return deleted, err
+		}
+
+		var args []interface{}
+		n := 0
+		for _, k := range keys {
+			key := strings.TrimPrefix(k, e.prefix)
+			if isCompanionKey(key) {
+				continue
+			}
+
+			args = append(args, e.entryKeys(key)...)
+			n++
+		}
+
+		if n > 0 {
+			_, err = conn.Do("UNLINK", args...)
+			if err != nil {
+				return deleted, err
+			}
+
+			deleted += n
+			if progress != nil {
+				progress(deleted)
+			}
+		}
+
+		if cursor == 0 {
+			return deleted, nil
 		}
 	}
+}
+
+// Scan returns a page of keys starting with prefix, skipping the companion
+// expiry, lock and tag keys. The cursor is the Redis SCAN cursor.
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	conn := e.pool.Get()
+	defer conn.Close()
 
-	return false
+	return e.scan(conn, cursor, prefix, count)
 }
 
-// Expire marks the key as expired, and removes it from the storage engine
-func (e *Engine) Expire(key string) error {
+// ScanEntries returns a page of entries whose key starts with prefix, along
+// with their expiry and lock status. The cursor is the Redis SCAN cursor.
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
 	conn := e.pool.Get()
 	defer conn.Close()
 
+	keys, next, err := e.scan(conn, cursor, prefix, count)
+	if err != nil || len(keys) == 0 {
+		return nil, next, err
+	}
+
+	if e.layout == HashLayout {
+		return e.hashEntries(conn, keys, next)
+	}
+
 	// Pipeline commands
 	conn.Send("MULTI")
-	conn.Send("DEL", e.prefix+key)
-	conn.Send("DEL", e.prefix+expirePrefix+key)
-	conn.Send("DEL", e.prefix+lockPrefix+key)
-	_, err := conn.Do("EXEC")
+	for _, key := range keys {
+		conn.Send("GET", e.prefix+key)
+		conn.Send("GET", e.prefix+expirePrefix+key)
+		conn.Send("EXISTS", e.prefix+lockPrefix+key)
+	}
+	values, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, next, err
+	}
 
-	return err
+	entries := make([]common.Entry, 0, len(keys))
+	for i, key := range keys {
+		data, err := redigo.Bytes(values[i*3], nil)
+		if err == redigo.ErrNil {
+			// The key has been removed since it was scanned
+			continue
+		}
+		if err != nil {
+			return nil, next, err
+		}
+
+		entry := common.Entry{
+			Key:  key,
+			Data: data,
+		}
+
+		expires, err := redigo.Int64(values[i*3+1], nil)
+		if err == nil {
+			entry.Expires = time.Unix(expires, 0)
+		}
+
+		entry.Locked, _ = redigo.Bool(values[i*3+2], nil)
+
+		entries = append(entries, entry)
+	}
+
+	return entries, next, nil
+}
+
+// scan runs a single SCAN iteration, returning the data keys found without
+// the engine prefix
+func (e *Engine) scan(conn redigo.Conn, cursor string, prefix string, count int) ([]string, string, error) {
+	if cursor == "" {
+		cursor = "0"
+	}
+
+	match := common.EscapeGlob(e.prefix+prefix) + "*"
+	values, err := redigo.Values(conn.Do("SCAN", cursor, "MATCH", match, "COUNT", count))
+	if err != nil {
+		return nil, "", err
+	}
+
+	next, err := redigo.Int64(values[0], nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	found, err := redigo.Strings(values[1], nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var keys []string
+	for _, k := range found {
+		key := strings.TrimPrefix(k, e.prefix)
+		if !isCompanionKey(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	if next == 0 {
+		return keys, "", nil
+	}
+
+	return keys, strconv.FormatInt(next, 10), nil
 }
 
 // IsLocked checks to see if the key has been locked
 func (e *Engine) IsLocked(key string) bool {
+	if e.layout == HashLayout {
+		return e.hashIsLocked(key)
+	}
+
 	return e.Exists(lockPrefix + key)
 }
 
-// Lock sets a lock against the given key
+// Lock sets a lock against the given key, if it is already locked it returns
+// common.ErrKeyAlreadyLocked. The lock expires after the cleanup timeout.
 func (e *Engine) Lock(key string) error {
+	if e.layout == HashLayout {
+		return e.hashLock(key)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
 	conn := e.pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("SETEX", e.prefix+lockPrefix+key, e.cleanupTimeout.Seconds(), []byte("1"))
-	return err
+	// SET NX is atomic, so doesn't need a script
+	_, err = redigo.String(conn.Do("SET", e.prefix+lockPrefix+key, token, "NX", "EX", e.ttl()))
+	if err == redigo.ErrNil {
+		return common.ErrKeyAlreadyLocked
+	}
+	if err != nil {
+		return err
+	}
+
+	e.tokensLock.Lock()
+	e.tokens[key] = token
+	e.tokensLock.Unlock()
+
+	return nil
 }
 
-// Unlock removes the lock from a given key, if it doesn't exist it returns an error
+// Unlock removes the lock from a given key. If this engine doesn't hold the
+// lock it returns common.ErrNonExistentKey, and if the lock expired or was
+// taken by another process since it returns common.ErrLockNotHeld.
 func (e *Engine) Unlock(key string) error {
+	e.tokensLock.Lock()
+	token, ok := e.tokens[key]
+	delete(e.tokens, key)
+	e.tokensLock.Unlock()
+
+	if !ok {
+		return common.ErrNonExistentKey
+	}
+
 	conn := e.pool.Get()
 	defer conn.Close()
 
-	_, err := conn.Do("DEL", e.prefix+lockPrefix+key)
-	return err
+	var removed bool
+	var err error
+	if e.layout == HashLayout {
+		removed, err = redigo.Bool(hashUnlockScript.Do(conn, e.prefix+key, token))
+	} else {
+		removed, err = redigo.Bool(unlockScript.Do(conn, e.prefix+lockPrefix+key, token))
+	}
+	if err != nil {
+		return err
+	}
+
+	if !removed {
+		return common.ErrLockNotHeld
+	}
+
+	return nil
+}
+
+// reader returns the pool used for reads
+func (e *Engine) reader() pl {
+	if e.readPool != nil {
+		return e.readPool
+	}
+
+	return e.pool
+}
+
+// entryKeys returns the Redis keys holding the entry of a key
+func (e *Engine) entryKeys(key string) []interface{} {
+	if e.layout == HashLayout {
+		return []interface{}{e.prefix + key}
+	}
+
+	return []interface{}{e.prefix + key, e.prefix + expirePrefix + key, e.prefix + lockPrefix + key}
+}
+
+// token returns the token of the lock held by this engine on the key, or ""
+func (e *Engine) token(key string) string {
+	e.tokensLock.Lock()
+	defer e.tokensLock.Unlock()
+
+	return e.tokens[key]
+}
+
+// ttl returns the cleanup timeout in whole seconds, as used for key expiry
+func (e *Engine) ttl() int64 {
+	ttl := int64(e.cleanupTimeout / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	return ttl
+}
+
+// Close closes the connection pools, if they can be closed
+func (e *Engine) Close() error {
+	if closer, ok := e.readPool.(io.Closer); ok {
+		closer.Close()
+	}
+
+	if closer, ok := e.pool.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// isCompanionKey checks if the key holds metadata for another key, rather than data
+func isCompanionKey(key string) bool {
+	return strings.HasPrefix(key, expirePrefix) ||
+		strings.HasPrefix(key, lockPrefix) ||
+		strings.HasPrefix(key, tagPrefix)
 }
@@ -3,9 +3,11 @@ package redis
 import (
 	"bytes"
 	"fmt"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis"
 	"github.com/fresh8/go-cache/engine/common"
 	redigo "github.com/garyburd/redigo/redis"
 	"github.com/rafaeljusto/redigomock"
@@ -19,6 +21,23 @@ func (m mockPool) Get() redigo.Conn {
 	return m.conn
 }
 
+// newTestStore starts a miniredis server, and returns it with an engine using it
+func newTestStore(t *testing.T, opts ...Option) (*miniredis.Miniredis, *Engine) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := server.Addr()
+	pool := &redigo.Pool{
+		Dial: func() (redigo.Conn, error) {
+			return redigo.Dial("tcp", addr)
+		},
+	}
+
+	return server, NewRedisStore("testing", pool, 1*time.Minute, opts...)
+}
+
 func TestRedisEngine_Exists(t *testing.T) {
 	fakeConn := redigomock.NewConn()
 	engine := NewRedisStore("testing", &mockPool{
@@ -84,45 +103,66 @@ func TestRedisEngine_Get(t *testing.T) {
 }
 
 func TestRedisEngine_Put(t *testing.T) {
-	fakeConn := redigomock.NewConn()
-	cleanupTimeout := 1 * time.Minute
-	engine := NewRedisStore("testing", &mockPool{
-		conn: fakeConn,
-	}, cleanupTimeout)
+	server, engine := newTestStore(t)
+	defer server.Close()
 
 	content := []byte("hello")
 	expires := time.Now().Add(1 * time.Hour)
 
-	expectedErr := fmt.Errorf("random error")
-	cmd := fakeConn.Command("MULTI")
-	cmd1 := fakeConn.Command("SETEX", "testing:new-key", cleanupTimeout.Seconds(), content)
-	cmd2 := fakeConn.Command("SETEX", "testing:expire:new-key", cleanupTimeout.Seconds(), expires.Unix())
-	cmd3 := fakeConn.Command("EXEC").Expect([]interface{}{"OK", "OK"}).ExpectError(expectedErr)
-
-	err := engine.Put("new-key", []byte("hello"), expires)
+	err := engine.Put("new-key", content, expires)
 	if err != nil {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if fakeConn.Stats(cmd) != 1 {
-		t.Fatal("multi command was not used")
+	data, _ := server.Get("testing:new-key")
+	if data != string(content) {
+		t.Fatalf("%s expected, %s given", content, data)
 	}
 
-	if fakeConn.Stats(cmd1) != 1 {
-		t.Fatal("setex command was not used")
+	expiry, _ := server.Get("testing:expire:new-key")
+	if expiry != strconv.FormatInt(expires.Unix(), 10) {
+		t.Fatalf("%d expected, %s given", expires.Unix(), expiry)
 	}
 
-	if fakeConn.Stats(cmd2) != 1 {
-		t.Fatal("setex command was not used")
+	if server.TTL("testing:new-key") != time.Minute || server.TTL("testing:expire:new-key") != time.Minute {
+		t.Fatal("keys should expire after the cleanup timeout")
 	}
 
-	if fakeConn.Stats(cmd3) != 1 {
-		t.Fatal("exec command was not used")
+	server.Close()
+
+	err = engine.Put("new-key", content, expires)
+	if err == nil {
+		t.Fatal("error expected, none given")
 	}
+}
 
-	err = engine.Put("new-key", []byte("hello"), expires)
-	if err != expectedErr {
-		t.Fatalf("random error expected, %s given", err)
+func TestRedisEngine_PutWhileLocked(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+
+	expires := time.Now().Add(1 * time.Hour)
+
+	err := engine.Lock("locked-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = engine.Put("locked-key", []byte("hello"), expires)
+	if err != nil {
+		t.Fatalf("no error expected while holding the lock, %s given", err)
+	}
+
+	// Another process takes the lock once it has expired
+	server.Set("testing:lock:locked-key", "other-token")
+
+	err = engine.Put("locked-key", []byte("stale"), expires)
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("lock not held error expected, %v given", err)
+	}
+
+	data, _ := server.Get("testing:locked-key")
+	if data != "hello" {
+		t.Fatalf("data should not be written without the lock, %s given", data)
 	}
 }
 
@@ -132,45 +172,35 @@ func TestRedisEngine_IsExpired(t *testing.T) {
 		conn: fakeConn,
 	}, 1*time.Minute)
 
-	cmd1 := fakeConn.Command("EXISTS", "testing:expire:non-existing").Expect([]byte("false"))
+	cmd1 := fakeConn.Command("GET", "testing:expire:non-existing").ExpectError(redigo.ErrNil)
 	if engine.IsExpired("non-existing") {
 		t.Fatal("key does not exist, marked as existing")
 	}
 
 	if fakeConn.Stats(cmd1) != 1 {
-		t.Fatal("exists command was not used")
+		t.Fatal("get command was not used")
 	}
 
 	fakeConn.Clear()
 
-	cmd2 := fakeConn.Command("EXISTS", "testing:expire:existing-2").Expect([]byte("true"))
-	cmd3 := fakeConn.Command("GET", "testing:expire:existing-2").Expect(time.Now().Add(1 * time.Minute).Unix())
+	cmd2 := fakeConn.Command("GET", "testing:expire:existing-2").Expect(time.Now().Add(1 * time.Minute).Unix())
 	if engine.IsExpired("existing-2") {
 		t.Fatal("key exist, marked as non-existent")
 	}
 
 	if fakeConn.Stats(cmd2) != 1 {
-		t.Fatal("exists command was not used")
-	}
-
-	if fakeConn.Stats(cmd3) != 1 {
 		t.Fatal("get command was not used")
 	}
 
 	fakeConn.Clear()
 
 	expectedErr := fmt.Errorf("random error")
-	cmd4 := fakeConn.Command("EXISTS", "testing:expire:existing").Expect([]byte("true")).Expect([]byte("true"))
-	cmd5 := fakeConn.Command("GET", "testing:expire:existing").Expect(time.Now().Add(-1 * time.Minute).Unix()).ExpectError(expectedErr)
+	cmd3 := fakeConn.Command("GET", "testing:expire:existing").Expect(time.Now().Add(-1 * time.Minute).Unix()).ExpectError(expectedErr)
 	if !engine.IsExpired("existing") {
 		t.Fatal("key exist, marked as non-existent")
 	}
 
-	if fakeConn.Stats(cmd4) != 1 {
-		t.Fatal("exists command was not used")
-	}
-
-	if fakeConn.Stats(cmd5) != 1 {
+	if fakeConn.Stats(cmd3) != 1 {
 		t.Fatal("get command was not used")
 	}
 
@@ -178,15 +208,50 @@ func TestRedisEngine_IsExpired(t *testing.T) {
 		t.Fatal("get should have thrown an error, returning false")
 	}
 
-	if fakeConn.Stats(cmd4) != 2 {
-		t.Fatal("exists command was not used")
+	if fakeConn.Stats(cmd3) != 2 {
+		t.Fatal("get command was not used")
 	}
+}
 
-	fakeConn.Clear()
+func TestRedisEngine_Fetch(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
 
-	fakeConn.Command("EXISTS", "testing:expire:existing").ExpectError(expectedErr)
-	if engine.IsExpired("existing") {
-		t.Fatal("error for existing should return false")
+	_, err := engine.Fetch("non-existing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existing key error expected, %v given", err)
+	}
+
+	engine.Lock("non-existing")
+
+	entry, err := engine.Fetch("non-existing")
+	if err != common.ErrNonExistentKey || !entry.Locked {
+		t.Fatalf("lock state should be returned for non-existing keys, %+v given", entry)
+	}
+
+	content := []byte("hello")
+	expires := time.Unix(time.Now().Add(1*time.Hour).Unix(), 0)
+	engine.Put("existing", content, expires)
+
+	entry, err = engine.Fetch("existing")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(entry.Data, content) != 0 || !entry.Expires.Equal(expires) || entry.Locked {
+		t.Fatalf("entry does not match stored data, %+v given", entry)
+	}
+
+	// Data kept without an expiry key, e.g. written by an older version
+	server.Set("testing:legacy", "hello")
+
+	entry, err = engine.Fetch("legacy")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !entry.Expires.IsZero() {
+		t.Fatalf("expiry should be zero without an expiry key, %s given", entry.Expires)
 	}
 }
 
@@ -269,50 +334,313 @@ func TestRedisEngine_IsLocked(t *testing.T) {
 }
 
 func TestRedisEngine_Lock(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+
+	err := engine.Lock("lock-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !server.Exists("testing:lock:lock-key") {
+		t.Fatal("lock key should have been set")
+	}
+
+	if server.TTL("testing:lock:lock-key") != time.Minute {
+		t.Fatal("lock should expire after the cleanup timeout")
+	}
+
+	err = engine.Lock("lock-key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("already locked error expected, %v given", err)
+	}
+
+	server.Close()
+
+	err = engine.Lock("other-key")
+	if err == nil {
+		t.Fatal("error expected, none given")
+	}
+}
+
+func TestRedisEngine_Unlock(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+
+	err := engine.Unlock("del-key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected without holding the lock, %v given", err)
+	}
+
+	engine.Lock("del-key")
+
+	err = engine.Unlock("del-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if server.Exists("testing:lock:del-key") {
+		t.Fatal("lock key should have been removed")
+	}
+
+	// A lock taken by another process once ours expired is left alone
+	engine.Lock("del-key")
+	server.Set("testing:lock:del-key", "other-token")
+
+	err = engine.Unlock("del-key")
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("lock not held error expected, %v given", err)
+	}
+
+	if !server.Exists("testing:lock:del-key") {
+		t.Fatal("lock held by another process should not be removed")
+	}
+}
+
+func TestRedisEngine_PutTagged(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	err := engine.PutTagged("new-key", content, expires, []string{"product:1", "product:2"})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	for _, tag := range []string{"testing:tag:product:1", "testing:tag:product:2"} {
+		members, err := server.Members(tag)
+		if err != nil || len(members) != 1 || members[0] != "new-key" {
+			t.Fatalf("key should have been added to %s, %v given", tag, members)
+		}
+
+		if server.TTL(tag) != time.Minute {
+			t.Fatalf("%s should expire after the cleanup timeout", tag)
+		}
+	}
+
+	data, _ := server.Get("testing:new-key")
+	if data != string(content) {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+}
+
+func TestRedisEngine_ExpireTag(t *testing.T) {
 	fakeConn := redigomock.NewConn()
-	cleanupTimeout := 1 * time.Minute
 	engine := NewRedisStore("testing", &mockPool{
 		conn: fakeConn,
-	}, cleanupTimeout)
+	}, 1*time.Minute)
 
-	expectedErr := fmt.Errorf("random error")
-	cmd1 := fakeConn.Command("SETEX", "testing:lock:lock-key", cleanupTimeout.Seconds(), []byte("1")).Expect("OK").ExpectError(expectedErr)
+	cmd := fakeConn.Command("SMEMBERS", "testing:tag:empty").Expect([]interface{}{})
 
-	err := engine.Lock("lock-key")
+	err := engine.ExpireTag("empty")
 	if err != nil {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if fakeConn.Stats(cmd1) != 1 {
-		t.Fatal("set command was not used")
+	if fakeConn.Stats(cmd) != 1 {
+		t.Fatal("smembers command was not used")
 	}
 
-	err = engine.Lock("lock-key")
+	fakeConn.Clear()
+
+	cmd = fakeConn.Command("SMEMBERS", "testing:tag:product:1").Expect([]interface{}{[]byte("page-1")})
+	cmd1 := fakeConn.Command("MULTI")
+	cmd2 := fakeConn.Command("DEL", "testing:page-1")
+	cmd3 := fakeConn.Command("DEL", "testing:expire:page-1")
+	cmd4 := fakeConn.Command("DEL", "testing:lock:page-1")
+	cmd5 := fakeConn.Command("SREM", "testing:tag:product:1", "page-1")
+	cmd6 := fakeConn.Command("EXEC").Expect([]interface{}{int64(1), int64(1), int64(0), int64(1)})
+
+	err = engine.ExpireTag("product:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	for _, c := range []*redigomock.Cmd{cmd, cmd1, cmd2, cmd3, cmd4, cmd5, cmd6} {
+		if fakeConn.Stats(c) != 1 {
+			t.Fatalf("%s command was not used", c.Name)
+		}
+	}
+
+	fakeConn.Clear()
+
+	expectedErr := fmt.Errorf("random error")
+	fakeConn.Command("SMEMBERS", "testing:tag:product:1").ExpectError(expectedErr)
+
+	err = engine.ExpireTag("product:1")
 	if err != expectedErr {
 		t.Fatalf("random error expected, %s given", err)
 	}
 }
 
-func TestRedisEngine_Unlock(t *testing.T) {
+func TestRedisEngine_DeletePrefix(t *testing.T) {
 	fakeConn := redigomock.NewConn()
 	engine := NewRedisStore("testing", &mockPool{
 		conn: fakeConn,
 	}, 1*time.Minute)
 
-	expectedErr := fmt.Errorf("random error")
-	cmd1 := fakeConn.Command("DEL", "testing:lock:del-key").Expect("OK").ExpectError(expectedErr)
+	cmd1 := fakeConn.Command("SCAN", 0, "MATCH", "testing:search\\*:*", "COUNT", scanCount).Expect([]interface{}{
+		[]byte("12"),
+		[]interface{}{[]byte("testing:search*:shoes"), []byte("testing:search*:hats")},
+	})
+	cmd2 := fakeConn.Command("UNLINK",
+		"testing:search*:shoes", "testing:expire:search*:shoes", "testing:lock:search*:shoes",
+		"testing:search*:hats", "testing:expire:search*:hats", "testing:lock:search*:hats",
+	).Expect(int64(4))
+	cmd3 := fakeConn.Command("SCAN", 12, "MATCH", "testing:search\\*:*", "COUNT", scanCount).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{},
+	})
+
+	var calls []int
+	deleted, err := engine.DeletePrefix("search*:", func(n int) {
+		calls = append(calls, n)
+	})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
 
-	err := engine.Unlock("del-key")
+	if deleted != 2 {
+		t.Fatalf("2 keys should have been deleted, %d given", deleted)
+	}
+
+	if len(calls) != 1 || calls[0] != 2 {
+		t.Fatalf("progress should be reported once, %v given", calls)
+	}
+
+	if fakeConn.Stats(cmd1) != 1 || fakeConn.Stats(cmd3) != 1 {
+		t.Fatal("scan command was not used")
+	}
+
+	if fakeConn.Stats(cmd2) != 1 {
+		t.Fatal("unlink command was not used")
+	}
+}
+
+func TestRedisEngine_DeleteMatching(t *testing.T) {
+	fakeConn := redigomock.NewConn()
+	engine := NewRedisStore("testing", &mockPool{
+		conn: fakeConn,
+	}, 1*time.Minute)
+
+	fakeConn.Command("SCAN", 0, "MATCH", "testing:*", "COUNT", scanCount).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("testing:expire:page"), []byte("testing:lock:page"), []byte("testing:page")},
+	})
+	cmd := fakeConn.Command("UNLINK", "testing:page", "testing:expire:page", "testing:lock:page").Expect(int64(3))
+
+	deleted, err := engine.DeleteMatching("*", nil)
 	if err != nil {
 		t.Fatalf("no error expected, %s given", err)
 	}
 
-	if fakeConn.Stats(cmd1) != 1 {
-		t.Fatal("del command was not used")
+	if deleted != 1 {
+		t.Fatalf("companion keys should not be counted, %d given", deleted)
 	}
 
-	err = engine.Unlock("del-key")
+	if fakeConn.Stats(cmd) != 1 {
+		t.Fatal("unlink command was not used")
+	}
+
+	fakeConn.Clear()
+
+	expectedErr := fmt.Errorf("random error")
+	fakeConn.Command("SCAN", 0, "MATCH", "testing:*", "COUNT", scanCount).ExpectError(expectedErr)
+
+	_, err = engine.DeleteMatching("*", nil)
 	if err != expectedErr {
 		t.Fatalf("random error expected, %s given", err)
 	}
 }
+
+func TestRedisEngine_Scan(t *testing.T) {
+	fakeConn := redigomock.NewConn()
+	engine := NewRedisStore("testing", &mockPool{
+		conn: fakeConn,
+	}, 1*time.Minute)
+
+	cmd1 := fakeConn.Command("SCAN", "0", "MATCH", "testing:search:*", "COUNT", 2).Expect([]interface{}{
+		[]byte("7"),
+		[]interface{}{[]byte("testing:search:a"), []byte("testing:expire:search:a")},
+	})
+	cmd2 := fakeConn.Command("SCAN", "7", "MATCH", "testing:search:*", "COUNT", 2).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("testing:search:b")},
+	})
+
+	keys, cursor, err := engine.Scan("", "search:", 2)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(keys) != 1 || keys[0] != "search:a" {
+		t.Fatalf("companion keys should be skipped, %v given", keys)
+	}
+
+	if cursor != "7" {
+		t.Fatalf("cursor 7 expected, %s given", cursor)
+	}
+
+	keys, cursor, err = engine.Scan(cursor, "search:", 2)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(keys) != 1 || keys[0] != "search:b" {
+		t.Fatalf("search:b expected, %v given", keys)
+	}
+
+	if cursor != "" {
+		t.Fatalf("cursor should be empty once the scan is complete, %s given", cursor)
+	}
+
+	if fakeConn.Stats(cmd1) != 1 || fakeConn.Stats(cmd2) != 1 {
+		t.Fatal("scan command was not used")
+	}
+}
+
+func TestRedisEngine_ScanEntries(t *testing.T) {
+	fakeConn := redigomock.NewConn()
+	engine := NewRedisStore("testing", &mockPool{
+		conn: fakeConn,
+	}, 1*time.Minute)
+
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour).Unix()
+
+	fakeConn.Command("SCAN", "0", "MATCH", "testing:*", "COUNT", 10).Expect([]interface{}{
+		[]byte("0"),
+		[]interface{}{[]byte("testing:a"), []byte("testing:gone")},
+	})
+	fakeConn.Command("MULTI")
+	fakeConn.Command("GET", "testing:a")
+	fakeConn.Command("GET", "testing:expire:a")
+	fakeConn.Command("EXISTS", "testing:lock:a")
+	fakeConn.Command("GET", "testing:gone")
+	fakeConn.Command("GET", "testing:expire:gone")
+	fakeConn.Command("EXISTS", "testing:lock:gone")
+	fakeConn.Command("EXEC").Expect([]interface{}{
+		content, []byte(strconv.FormatInt(expires, 10)), int64(1),
+		nil, nil, int64(0),
+	})
+
+	entries, cursor, err := engine.ScanEntries("", "", 10)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if cursor != "" {
+		t.Fatalf("cursor should be empty once the scan is complete, %s given", cursor)
+	}
+
+	if len(entries) != 1 {
+		t.Fatalf("removed keys should be skipped, %d entries given", len(entries))
+	}
+
+	entry := entries[0]
+	if entry.Key != "a" || bytes.Compare(entry.Data, content) != 0 || entry.Expires.Unix() != expires || !entry.Locked {
+		t.Fatalf("entry does not match stored data, %+v given", entry)
+	}
+}
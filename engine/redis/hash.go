@@ -0,0 +1,398 @@
+package redis
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// Layout is the way entries are stored in Redis
+type Layout int
+
+// Storage layouts
+const (
+	// KeysLayout stores each entry as up to three keys, holding the data, the
+	// expiry time and the lock. This is the default.
+	KeysLayout Layout = iota
+	// HashLayout stores each entry as a single hash, with data, expires,
+	// locked and stored_at fields, expiring as a whole after the cleanup
+	// timeout. Locks are held as "<deadline>:<token>" in the locked field.
+	HashLayout
+)
+
+// Hash fields of an entry stored with HashLayout
+const (
+	dataField     = "data"
+	expiresField  = "expires"
+	lockedField   = "locked"
+	storedAtField = "stored_at"
+)
+
+var (
+	// hashPutScript stores the data and expiry time of an entry hash, and
+	// adds the key to the set of each tag. Given a lock token, nothing is
+	// stored unless the lock is still held with that token. An entry stored
+	// with KeysLayout is replaced. Returns 1 if stored, else 0.
+	//
+	// KEYS: entry, tag sets...
+	// ARGV: data, expires, stored at, ttl, lock token or "", key
+	hashPutScript = redigo.NewScript(-1, `
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) == "string" then
+	redis.call("DEL", KEYS[1])
+end
+
+if ARGV[5] ~= "" then
+	local locked = redis.call("HGET", KEYS[1], "locked")
+	if not locked or string.match(locked, "^%d+:(.*)$") ~= ARGV[5] then
+		return 0
+	end
+end
+
+redis.call("HMSET", KEYS[1], "data", ARGV[1], "expires", ARGV[2], "stored_at", ARGV[3])
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+for i = 2, #KEYS do
+	redis.call("SADD", KEYS[i], ARGV[6])
+	redis.call("EXPIRE", KEYS[i], ARGV[4])
+end
+
+return 1
+`)
+
+	// hashReadScript reads the data, expires and locked fields of an entry
+	// hash. An entry stored with KeysLayout is reported as missing.
+	//
+	// KEYS: entry
+	hashReadScript = redigo.NewScript(1, `
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) ~= "hash" then
+	return {false, false, false}
+end
+
+return redis.call("HMGET", KEYS[1], "data", "expires", "locked")
+`)
+
+	// hashLockScript locks an entry hash unless it is locked already, making
+	// sure the hash lives at least as long as the lock. An entry stored with
+	// KeysLayout is removed. Returns 1 if locked, else 0.
+	//
+	// KEYS: entry
+	// ARGV: lock token, now, lock deadline, ttl
+	hashLockScript = redigo.NewScript(1, `
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) == "string" then
+	redis.call("DEL", KEYS[1])
+end
+
+local locked = redis.call("HGET", KEYS[1], "locked")
+if locked and tonumber(string.match(locked, "^(%d+):")) > tonumber(ARGV[2]) then
+	return 0
+end
+
+redis.call("HSET", KEYS[1], "locked", ARGV[3] .. ":" .. ARGV[1])
+if redis.call("TTL", KEYS[1]) < tonumber(ARGV[4]) then
+	redis.call("EXPIRE", KEYS[1], ARGV[4])
+end
+
+return 1
+`)
+
+	// hashUnlockScript removes the lock of an entry hash if it is held with
+	// the given token. Returns 1 if removed, else 0.
+	//
+	// KEYS: entry
+	// ARGV: lock token
+	hashUnlockScript = redigo.NewScript(1, `
+local locked = redis.call("HGET", KEYS[1], "locked")
+if locked and string.match(locked, "^%d+:(.*)$") == ARGV[1] then
+	redis.call("HDEL", KEYS[1], "locked")
+	return 1
+end
+
+return 0
+`)
+
+	// migrateScript converts an entry stored with KeysLayout into an entry
+	// hash, keeping its remaining time to live. Locks aren't carried over.
+	// Returns 1 if converted, else 0.
+	//
+	// KEYS: data, expire, lock
+	// ARGV: stored at
+	migrateScript = redigo.NewScript(3, `
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) ~= "string" then
+	return 0
+end
+
+local data = redis.call("GET", KEYS[1])
+local expires = redis.call("GET", KEYS[2])
+local ttl = redis.call("PTTL", KEYS[1])
+
+redis.call("DEL", KEYS[1], KEYS[2], KEYS[3])
+redis.call("HMSET", KEYS[1], "data", data, "stored_at", ARGV[1])
+if expires then
+	redis.call("HSET", KEYS[1], "expires", expires)
+end
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+
+return 1
+`)
+)
+
+func (e *Engine) hashExists(key string) bool {
+	conn := e.reader().Get()
+	defer conn.Close()
+
+	exists, err := redigo.Bool(conn.Do("HEXISTS", e.prefix+key, dataField))
+	if err != nil {
+		return false
+	}
+
+	return exists
+}
+
+func (e *Engine) hashGet(key string) ([]byte, error) {
+	conn := e.reader().Get()
+	defer conn.Close()
+
+	values, err := redigo.Values(hashReadScript.Do(conn, e.prefix+key))
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := hashEntry(key, values, time.Now())
+
+	return entry.Data, err
+}
+
+func (e *Engine) hashPutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	conn := e.pool.Get()
+	defer conn.Close()
+
+	args := []interface{}{1 + len(tags), e.prefix + key}
+	for _, tag := range tags {
+		args = append(args, e.prefix+tagPrefix+tag)
+	}
+	args = append(args, data, expires.Unix(), time.Now().Unix(), e.ttl(), e.token(key), key)
+
+	stored, err := redigo.Bool(hashPutScript.Do(conn, args...))
+	if err != nil {
+		return err
+	}
+
+	if !stored {
+		return common.ErrLockNotHeld
+	}
+
+	return nil
+}
+
+func (e *Engine) hashFetch(key string) (common.Entry, error) {
+	conn := e.reader().Get()
+	defer conn.Close()
+
+	values, err := redigo.Values(hashReadScript.Do(conn, e.prefix+key))
+	if err != nil {
+		return common.Entry{Key: key}, err
+	}
+
+	return hashEntry(key, values, time.Now())
+}
+
+func (e *Engine) hashIsExpired(key string) bool {
+	conn := e.reader().Get()
+	defer conn.Close()
+
+	expiryTime, err := redigo.Int64(conn.Do("HGET", e.prefix+key, expiresField))
+	if err != nil {
+		return false
+	}
+
+	return time.Now().Unix() > expiryTime
+}
+
+func (e *Engine) hashIsLocked(key string) bool {
+	conn := e.reader().Get()
+	defer conn.Close()
+
+	locked, err := redigo.String(conn.Do("HGET", e.prefix+key, lockedField))
+	if err != nil {
+		return false
+	}
+
+	return lockHeld(locked, time.Now())
+}
+
+func (e *Engine) hashLock(key string) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	conn := e.pool.Get()
+	defer conn.Close()
+
+	now := time.Now()
+	locked, err := redigo.Bool(hashLockScript.Do(conn,
+		e.prefix+key,
+		token,
+		now.Unix(),
+		now.Add(e.cleanupTimeout).Unix(),
+		e.ttl(),
+	))
+	if err != nil {
+		return err
+	}
+
+	if !locked {
+		return common.ErrKeyAlreadyLocked
+	}
+
+	e.tokensLock.Lock()
+	e.tokens[key] = token
+	e.tokensLock.Unlock()
+
+	return nil
+}
+
+// MigrateToHashLayout converts every entry stored with KeysLayout into an
+// entry hash, keeping its remaining time to live, and returns the number of
+// entries converted. Locks aren't carried over. The progress function, if not
+// nil, is called after each batch with the running total.
+//
+// Until converted, old entries are reported as missing by engines using
+// HashLayout, and are replaced when stored again or locked, so migrating is
+// optional.
+func (e *Engine) MigrateToHashLayout(progress func(int)) (int, error) {
+	conn := e.pool.Get()
+	defer conn.Close()
+
+	cursor := ""
+	migrated := 0
+
+	for {
+		keys, next, err := e.scan(conn, cursor, "", scanCount)
+		if err != nil {
+			return migrated, err
+		}
+
+		n := 0
+		for _, key := range keys {
+			converted, err := redigo.Bool(migrateScript.Do(conn,
+				e.prefix+key,
+				e.prefix+expirePrefix+key,
+				e.prefix+lockPrefix+key,
+				time.Now().Unix(),
+			))
+			if err != nil {
+				return migrated, err
+			}
+
+			if converted {
+				n++
+			}
+		}
+
+		if n > 0 {
+			migrated += n
+			if progress != nil {
+				progress(migrated)
+			}
+		}
+
+		if next == "" {
+			return migrated, nil
+		}
+		cursor = next
+	}
+}
+
+// hashEntries reads the entry hashes of the keys, skipping those removed since
+// they were scanned
+func (e *Engine) hashEntries(conn redigo.Conn, keys []string, next string) ([]common.Entry, string, error) {
+	// Pipeline commands
+	conn.Send("MULTI")
+	for _, key := range keys {
+		hashReadScript.Send(conn, e.prefix+key)
+	}
+	replies, err := redigo.Values(conn.Do("EXEC"))
+	if err != nil {
+		return nil, next, err
+	}
+
+	now := time.Now()
+	entries := make([]common.Entry, 0, len(keys))
+	for i, key := range keys {
+		values, err := redigo.Values(replies[i], nil)
+		if err != nil {
+			return nil, next, err
+		}
+
+		entry, err := hashEntry(key, values, now)
+		if err == common.ErrNonExistentKey {
+			continue
+		}
+		if err != nil {
+			return nil, next, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, next, nil
+}
+
+// hashEntry builds an entry from the data, expires and locked fields of an
+// entry hash, returning common.ErrNonExistentKey if there is no data
+func hashEntry(key string, values []interface{}, now time.Time) (common.Entry, error) {
+	entry := common.Entry{Key: key}
+
+	if len(values) != 3 {
+		return entry, common.ErrInvalidData
+	}
+
+	locked, err := redigo.String(values[2], nil)
+	if err == nil {
+		entry.Locked = lockHeld(locked, now)
+	} else if err != redigo.ErrNil {
+		return entry, err
+	}
+
+	expires, err := redigo.Int64(values[1], nil)
+	if err == nil {
+		entry.Expires = time.Unix(expires, 0)
+	} else if err != redigo.ErrNil {
+		return entry, err
+	}
+
+	entry.Data, err = redigo.Bytes(values[0], nil)
+	if err == redigo.ErrNil {
+		return entry, common.ErrNonExistentKey
+	}
+
+	return entry, err
+}
+
+// lockHeld checks if a "<deadline>:<token>" lock is held at the given time
+func lockHeld(locked string, now time.Time) bool {
+	i := strings.IndexByte(locked, ':')
+	if i < 0 {
+		return false
+	}
+
+	deadline, err := strconv.ParseInt(locked[:i], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return deadline > now.Unix()
+}
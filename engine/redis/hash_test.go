@@ -0,0 +1,317 @@
+package redis
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+func TestRedisEngine_HashPut(t *testing.T) {
+	server, engine := newTestStore(t, StorageLayout(HashLayout))
+	defer server.Close()
+
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	// An entry left over from the keys layout is replaced
+	server.Set("testing:new-key", "old")
+
+	err := engine.PutTagged("new-key", content, expires, []string{"product:1"})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if server.Type("testing:new-key") != "hash" {
+		t.Fatalf("entry should be stored as a hash, %s given", server.Type("testing:new-key"))
+	}
+
+	if data := server.HGet("testing:new-key", "data"); data != string(content) {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+
+	if expiry := server.HGet("testing:new-key", "expires"); expiry != strconv.FormatInt(expires.Unix(), 10) {
+		t.Fatalf("%d expected, %s given", expires.Unix(), expiry)
+	}
+
+	if server.HGet("testing:new-key", "stored_at") == "" {
+		t.Fatal("the time the entry was stored should be kept")
+	}
+
+	if server.TTL("testing:new-key") != time.Minute {
+		t.Fatal("entry should expire after the cleanup timeout")
+	}
+
+	members, _ := server.Members("testing:tag:product:1")
+	if len(members) != 1 || members[0] != "new-key" {
+		t.Fatalf("key should have been added to the tag, %v given", members)
+	}
+
+	if !engine.Exists("new-key") || engine.IsExpired("new-key") {
+		t.Fatal("entry should exist and be fresh")
+	}
+
+	data, err := engine.Get("new-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(data, content) != 0 {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+
+	_, err = engine.Get("non-existing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+
+	err = engine.ExpireTag("product:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if server.Exists("testing:new-key") {
+		t.Fatal("entry should have been removed with its tag")
+	}
+}
+
+func TestRedisEngine_HashFetch(t *testing.T) {
+	server, engine := newTestStore(t, StorageLayout(HashLayout))
+	defer server.Close()
+
+	expires := time.Now().Add(-1 * time.Minute)
+	engine.Put("existing", []byte("hello"), expires)
+	engine.Lock("existing")
+
+	entry, err := engine.Fetch("existing")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if string(entry.Data) != "hello" || entry.Expires.Unix() != expires.Unix() || !entry.Locked {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	engine.Lock("missing")
+
+	entry, err = engine.Fetch("missing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+
+	if !entry.Locked {
+		t.Fatal("lock state of a missing key should be returned")
+	}
+}
+
+func TestRedisEngine_HashLock(t *testing.T) {
+	server, engine := newTestStore(t, StorageLayout(HashLayout))
+	defer server.Close()
+
+	engine.Put("lock-key", []byte("hello"), time.Now().Add(1*time.Hour))
+
+	err := engine.Lock("lock-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !engine.IsLocked("lock-key") {
+		t.Fatal("key should be locked")
+	}
+
+	err = engine.Lock("lock-key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("already locked error expected, %v given", err)
+	}
+
+	err = engine.Put("lock-key", []byte("updated"), time.Now().Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected while holding the lock, %s given", err)
+	}
+
+	// Another process takes the lock once it has expired
+	deadline := time.Now().Add(time.Minute).Unix()
+	server.HSet("testing:lock-key", "locked", strconv.FormatInt(deadline, 10)+":other-token")
+
+	err = engine.Put("lock-key", []byte("stale"), time.Now().Add(1*time.Hour))
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("lock not held error expected, %v given", err)
+	}
+
+	err = engine.Unlock("lock-key")
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("lock not held error expected, %v given", err)
+	}
+
+	// A lock past its deadline is no longer held
+	server.HSet("testing:lock-key", "locked", "1:other-token")
+
+	if engine.IsLocked("lock-key") {
+		t.Fatal("lock past its deadline should not be held")
+	}
+
+	err = engine.Lock("lock-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = engine.Unlock("lock-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.IsLocked("lock-key") {
+		t.Fatal("key should have been unlocked")
+	}
+
+	if server.HGet("testing:lock-key", "data") != "updated" {
+		t.Fatal("unlocking should keep the entry")
+	}
+}
+
+func TestRedisEngine_HashScanEntries(t *testing.T) {
+	server, engine := newTestStore(t, StorageLayout(HashLayout))
+	defer server.Close()
+
+	engine.Put("product:1", []byte("one"), time.Now().Add(1*time.Hour))
+	engine.Put("product:2", []byte("two"), time.Now().Add(1*time.Hour))
+	engine.Put("user:1", []byte("user"), time.Now().Add(1*time.Hour))
+	engine.Lock("product:2")
+
+	entries, next, err := engine.ScanEntries("", "product:", 100)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if next != "" || len(entries) != 2 {
+		t.Fatalf("2 entries expected in a single page, %d given", len(entries))
+	}
+
+	for _, entry := range entries {
+		if entry.Locked != (entry.Key == "product:2") {
+			t.Fatalf("unexpected lock state for %s", entry.Key)
+		}
+	}
+
+	err = engine.Expire("product:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if server.Exists("testing:product:1") {
+		t.Fatal("entry should have been removed")
+	}
+}
+
+func TestRedisEngine_HashKeysLayoutEntry(t *testing.T) {
+	server, engine := newTestStore(t, StorageLayout(HashLayout))
+	defer server.Close()
+
+	// Entries left over from the keys layout are missing until migrated
+	server.Set("testing:old", "hello")
+	server.Set("testing:expire:old", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+
+	if engine.Exists("old") || engine.IsLocked("old") {
+		t.Fatal("old entry should be missing")
+	}
+
+	_, err := engine.Get("old")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+
+	_, err = engine.Fetch("old")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+
+	entries, _, err := engine.ScanEntries("", "", 10)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("no entries expected, %v given", entries)
+	}
+
+	// and are replaced when locked
+	err = engine.Lock("old")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if server.Type("testing:old") != "hash" || !engine.IsLocked("old") {
+		t.Fatal("old entry should have been replaced by a locked entry hash")
+	}
+
+	err = engine.Put("old", []byte("world"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = engine.Unlock("old")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	data, err := engine.Get("old")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if string(data) != "world" {
+		t.Fatalf("world expected, %s given", data)
+	}
+}
+
+func TestRedisEngine_MigrateToHashLayout(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+
+	expires := time.Now().Add(1 * time.Hour)
+	engine.Put("one", []byte("hello"), expires)
+	engine.Put("two", []byte("world"), expires)
+	engine.Lock("two")
+
+	server.FastForward(30 * time.Second)
+
+	hashEngine := NewRedisStore("testing", engine.pool, time.Minute, StorageLayout(HashLayout))
+
+	if hashEngine.Exists("one") {
+		t.Fatal("entries should be missing until migrated")
+	}
+
+	var progress int
+	migrated, err := hashEngine.MigrateToHashLayout(func(n int) { progress = n })
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if migrated != 2 || progress != 2 {
+		t.Fatalf("2 entries should have been migrated, %d given", migrated)
+	}
+
+	if keys := server.Keys(); len(keys) != 2 {
+		t.Fatalf("companion keys should have been removed, %v given", keys)
+	}
+
+	entry, err := hashEngine.Fetch("two")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if string(entry.Data) != "world" || entry.Expires.Unix() != expires.Unix() || entry.Locked {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	if server.TTL("testing:one") != 30*time.Second {
+		t.Fatalf("the remaining time to live should be kept, %s given", server.TTL("testing:one"))
+	}
+
+	migrated, err = hashEngine.MigrateToHashLayout(nil)
+	if err != nil || migrated != 0 {
+		t.Fatalf("nothing should be migrated twice, %d given", migrated)
+	}
+}
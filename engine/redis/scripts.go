@@ -0,0 +1,68 @@
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+// Scripts run atomically on the server, and are sent with EVALSHA so only
+// their hash is transferred once loaded. redigo falls back to EVAL, which
+// loads the script, when the server doesn't know it yet.
+var (
+	// fetchScript returns the data, expiry time and lock state of a key.
+	//
+	// KEYS: data, expire, lock
+	fetchScript = redigo.NewScript(3, `
+return {
+	redis.call("GET", KEYS[1]),
+	redis.call("GET", KEYS[2]),
+	redis.call("EXISTS", KEYS[3])
+}
+`)
+
+	// putScript stores the data and expiry time of a key, and adds the key to
+	// the set of each tag. Given a lock token, nothing is stored unless the
+	// lock is still held with that token. Returns 1 if stored, else 0.
+	//
+	// KEYS: data, expire, lock, tag sets...
+	// ARGV: data, expires, ttl, lock token or "", key
+	putScript = redigo.NewScript(-1, `
+if ARGV[4] ~= "" and redis.call("GET", KEYS[3]) ~= ARGV[4] then
+	return 0
+end
+
+redis.call("SETEX", KEYS[1], ARGV[3], ARGV[1])
+redis.call("SETEX", KEYS[2], ARGV[3], ARGV[2])
+for i = 4, #KEYS do
+	redis.call("SADD", KEYS[i], ARGV[5])
+	redis.call("EXPIRE", KEYS[i], ARGV[3])
+end
+
+return 1
+`)
+
+	// unlockScript removes a lock if it is held with the given token. Returns
+	// 1 if removed, else 0.
+	//
+	// KEYS: lock
+	// ARGV: lock token
+	unlockScript = redigo.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+
+return 0
+`)
+)
+
+// newToken returns a random lock token, unique to the lock holder
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
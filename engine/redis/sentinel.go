@@ -0,0 +1,295 @@
+package redis
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	redigo "github.com/garyburd/redigo/redis"
+)
+
+var (
+	// ErrNoSentinel is returned when none of the sentinels could be reached
+	ErrNoSentinel = errors.New("no sentinel reachable")
+
+	// errStaleMaster discards pooled connections to a former master
+	errStaleMaster = errors.New("connection to a former master")
+)
+
+// Sentinel discovers the master and replicas of a Redis deployment monitored
+// by Redis Sentinel. The master address is cached, and resolved again when a
+// connection to it fails or a write is refused with a READONLY error, which
+// happens once the master has been demoted by a failover.
+type Sentinel struct {
+	// Addrs are the addresses of the sentinels, tried in order after the one
+	// which answered last
+	Addrs []string
+	// MasterName is the name of the monitored master
+	MasterName string
+
+	// Dial connects to a sentinel or Redis server. Defaults to a TCP
+	// connection with redigo.Dial.
+	Dial func(addr string) (redigo.Conn, error)
+
+	// MaxIdle and IdleTimeout configure the pools created by MasterPool and
+	// ReplicaPool
+	MaxIdle     int
+	IdleTimeout time.Duration
+
+	mu       sync.Mutex
+	master   string
+	answered string
+}
+
+// NewSentinelStore creates a Redis-backed store writing to the master found
+// through the sentinel. Pass ReadPool(sentinel.ReplicaPool()) as an option to
+// route reads to replicas.
+func NewSentinelStore(prefix string, sentinel *Sentinel, cleanupTimeout time.Duration, opts ...Option) *Engine {
+	return NewRedisStore(prefix, sentinel.MasterPool(), cleanupTimeout, opts...)
+}
+
+// MasterAddr returns the address of the current master
+func (s *Sentinel) MasterAddr() (string, error) {
+	s.mu.Lock()
+	master := s.master
+	s.mu.Unlock()
+
+	if master != "" {
+		return master, nil
+	}
+
+	var addr string
+	err := s.query(func(conn redigo.Conn) error {
+		res, err := redigo.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", s.MasterName))
+		if err != nil {
+			return err
+		}
+
+		if len(res) != 2 {
+			return errors.New("master " + s.MasterName + " unknown to sentinel")
+		}
+
+		addr = net.JoinHostPort(res[0], res[1])
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	s.master = addr
+	s.mu.Unlock()
+
+	return addr, nil
+}
+
+// ReplicaAddrs returns the addresses of the replicas of the master which are
+// up and connected
+func (s *Sentinel) ReplicaAddrs() ([]string, error) {
+	var addrs []string
+	err := s.query(func(conn redigo.Conn) error {
+		replicas, err := redigo.Values(conn.Do("SENTINEL", "slaves", s.MasterName))
+		if err != nil {
+			return err
+		}
+
+		addrs = addrs[:0]
+		for _, replica := range replicas {
+			fields, err := redigo.StringMap(replica, nil)
+			if err != nil {
+				return err
+			}
+
+			if !replicaUp(fields["flags"]) {
+				continue
+			}
+
+			addrs = append(addrs, net.JoinHostPort(fields["ip"], fields["port"]))
+		}
+
+		return nil
+	})
+
+	return addrs, err
+}
+
+// Refresh forgets the cached master address, so it is resolved again on the
+// next connection
+func (s *Sentinel) Refresh() {
+	s.mu.Lock()
+	s.master = ""
+	s.mu.Unlock()
+}
+
+// MasterPool returns a pool of connections to the master. Connections made
+// before a failover are discarded as they are borrowed.
+func (s *Sentinel) MasterPool() *redigo.Pool {
+	return &redigo.Pool{
+		MaxIdle:     s.MaxIdle,
+		IdleTimeout: s.IdleTimeout,
+		Dial: func() (redigo.Conn, error) {
+			addr, err := s.MasterAddr()
+			if err != nil {
+				return nil, err
+			}
+
+			conn, err := s.dial(addr)
+			if err != nil {
+				// The master may be gone, so ask again next time
+				s.Refresh()
+				return nil, err
+			}
+
+			return &sentinelConn{Conn: conn, addr: addr, sentinel: s}, nil
+		},
+		TestOnBorrow: func(conn redigo.Conn, _ time.Time) error {
+			c, ok := conn.(*sentinelConn)
+			if !ok {
+				return nil
+			}
+
+			// Resolves the master again after a refresh, and is cached otherwise
+			addr, err := s.MasterAddr()
+			if err != nil {
+				return err
+			}
+
+			if c.addr != addr {
+				return errStaleMaster
+			}
+
+			return nil
+		},
+	}
+}
+
+// ReplicaPool returns a pool of connections to replicas, picked at random for
+// each connection, or to the master if no replica is available
+func (s *Sentinel) ReplicaPool() *redigo.Pool {
+	return &redigo.Pool{
+		MaxIdle:     s.MaxIdle,
+		IdleTimeout: s.IdleTimeout,
+		Dial: func() (redigo.Conn, error) {
+			addrs, err := s.ReplicaAddrs()
+			if err == nil && len(addrs) > 0 {
+				conn, err := s.dial(addrs[rand.Intn(len(addrs))])
+				if err == nil {
+					return conn, nil
+				}
+			}
+
+			addr, err := s.MasterAddr()
+			if err != nil {
+				return nil, err
+			}
+
+			return s.dial(addr)
+		},
+	}
+}
+
+// query runs fn against the first sentinel that answers, which is then asked
+// first next time. Addrs itself is left as is, and mu isn't held while the
+// sentinels are queried.
+func (s *Sentinel) query(fn func(redigo.Conn) error) error {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.Addrs...)
+	answered := s.answered
+	s.mu.Unlock()
+
+	for i, addr := range addrs {
+		if addr == answered {
+			addrs[0], addrs[i] = addrs[i], addrs[0]
+			break
+		}
+	}
+
+	err := ErrNoSentinel
+	for _, addr := range addrs {
+		var conn redigo.Conn
+		conn, err = s.dial(addr)
+		if err != nil {
+			continue
+		}
+
+		err = fn(conn)
+		conn.Close()
+		if err != nil {
+			continue
+		}
+
+		s.mu.Lock()
+		s.answered = addr
+		s.mu.Unlock()
+
+		return nil
+	}
+
+	return err
+}
+
+func (s *Sentinel) dial(addr string) (redigo.Conn, error) {
+	if s.Dial != nil {
+		return s.Dial(addr)
+	}
+
+	return redigo.Dial("tcp", addr)
+}
+
+// replicaUp checks the flags reported by a sentinel for a replica
+func replicaUp(flags string) bool {
+	for _, flag := range strings.Split(flags, ",") {
+		switch flag {
+		case "s_down", "o_down", "disconnected":
+			return false
+		}
+	}
+
+	return true
+}
+
+// sentinelConn is a connection to the master, which notices when the server
+// it is connected to has been demoted
+type sentinelConn struct {
+	redigo.Conn
+	addr     string
+	sentinel *Sentinel
+	err      error
+}
+
+func (c *sentinelConn) Do(commandName string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(commandName, args...)
+	c.check(err)
+
+	return reply, err
+}
+
+func (c *sentinelConn) Receive() (interface{}, error) {
+	reply, err := c.Conn.Receive()
+	c.check(err)
+
+	return reply, err
+}
+
+// Err returns the READONLY error once the server refused a write, so the pool
+// closes the connection rather than reusing it
+func (c *sentinelConn) Err() error {
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.Conn.Err()
+}
+
+func (c *sentinelConn) check(err error) {
+	// Scripts report the error of a refused write within their own
+	if err == nil || !strings.Contains(err.Error(), "READONLY") {
+		return
+	}
+
+	c.err = err
+	c.sentinel.Refresh()
+}
@@ -0,0 +1,237 @@
+package redis
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	redigo "github.com/garyburd/redigo/redis"
+	"github.com/rafaeljusto/redigomock"
+)
+
+// newTestSentinel returns a sentinel whose only reachable sentinel is the
+// returned mock, along with a function pointing it to a master
+func newTestSentinel(t *testing.T) (*Sentinel, *redigomock.Conn, func(*miniredis.Miniredis)) {
+	fakeConn := redigomock.NewConn()
+
+	sentinel := &Sentinel{
+		Addrs:      []string{"down:26379", "sentinel:26379"},
+		MasterName: "mymaster",
+		MaxIdle:    2,
+		Dial: func(addr string) (redigo.Conn, error) {
+			switch addr {
+			case "down:26379":
+				return nil, errors.New("connection refused")
+			case "sentinel:26379":
+				return fakeConn, nil
+			}
+			return redigo.Dial("tcp", addr)
+		},
+	}
+
+	setMaster := func(server *miniredis.Miniredis) {
+		fakeConn.Command("SENTINEL", "get-master-addr-by-name", "mymaster").
+			Expect([]interface{}{[]byte(server.Host()), []byte(server.Port())})
+	}
+
+	return sentinel, fakeConn, setMaster
+}
+
+func TestSentinel_Addrs(t *testing.T) {
+	sentinel, fakeConn, setMaster := newTestSentinel(t)
+
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	setMaster(server)
+
+	addr, err := sentinel.MasterAddr()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if addr != server.Addr() {
+		t.Fatalf("%s expected, %s given", server.Addr(), addr)
+	}
+
+	if sentinel.answered != "sentinel:26379" {
+		t.Fatal("the sentinel which answered should be asked first")
+	}
+
+	if sentinel.Addrs[0] != "down:26379" {
+		t.Fatal("the addresses of the sentinels should be left as is")
+	}
+
+	fakeConn.Command("SENTINEL", "slaves", "mymaster").Expect([]interface{}{
+		[]interface{}{[]byte("ip"), []byte("10.0.0.1"), []byte("port"), []byte("6379"), []byte("flags"), []byte("slave")},
+		[]interface{}{[]byte("ip"), []byte("10.0.0.2"), []byte("port"), []byte("6379"), []byte("flags"), []byte("s_down,slave")},
+	})
+
+	replicas, err := sentinel.ReplicaAddrs()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(replicas) != 1 || replicas[0] != net.JoinHostPort("10.0.0.1", "6379") {
+		t.Fatalf("only the replicas which are up expected, %v given", replicas)
+	}
+
+	sentinel.Addrs = []string{"down:26379"}
+	sentinel.Refresh()
+
+	_, err = sentinel.MasterAddr()
+	if err == nil {
+		t.Fatal("error expected without a reachable sentinel, none given")
+	}
+}
+
+func TestSentinel_Failover(t *testing.T) {
+	sentinel, _, setMaster := newTestSentinel(t)
+
+	first, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+
+	setMaster(first)
+
+	engine := NewSentinelStore("testing", sentinel, 1*time.Minute)
+	defer engine.Close()
+
+	err = engine.Put("key", []byte("first"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !first.Exists("testing:key") {
+		t.Fatal("data should have been written to the master")
+	}
+
+	// The first master is demoted, and its writes refused
+	setMaster(second)
+
+	conn := &sentinelConn{Conn: redigomock.NewConn(), addr: first.Addr(), sentinel: sentinel}
+	conn.Conn.(*redigomock.Conn).GenericCommand("SET").ExpectError(redigo.Error("READONLY You can't write against a read only replica."))
+
+	conn.Do("SET", "key", "value")
+	if conn.Err() == nil {
+		t.Fatal("connection should be discarded once a write is refused")
+	}
+
+	err = engine.Put("key", []byte("second"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	data, _ := second.Get("testing:key")
+	if data != "second" {
+		t.Fatalf("data should have been written to the new master, %s given", data)
+	}
+}
+
+func TestSentinel_ReadPool(t *testing.T) {
+	master, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	replica, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+
+	sentinel, fakeConn, setMaster := newTestSentinel(t)
+	setMaster(master)
+	fakeConn.Command("SENTINEL", "slaves", "mymaster").Expect([]interface{}{
+		[]interface{}{[]byte("ip"), []byte(replica.Host()), []byte("port"), []byte(replica.Port()), []byte("flags"), []byte("slave")},
+	})
+
+	engine := NewSentinelStore("testing", sentinel, 1*time.Minute, ReadPool(sentinel.ReplicaPool()))
+	defer engine.Close()
+
+	engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+
+	if engine.Exists("key") {
+		t.Fatal("existence should be checked on the replica")
+	}
+
+	replica.Set("testing:key", "hello")
+
+	if !engine.Exists("key") {
+		t.Fatal("existence should be checked on the replica")
+	}
+
+	data, err := engine.Get("key")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("data should be read from the replica, %v given", err)
+	}
+
+	replica.Set("testing:key", "replicated")
+
+	entry, err := engine.Fetch("key")
+	if err != nil || string(entry.Data) != "replicated" {
+		t.Fatalf("data should be read from the replica, %v given", err)
+	}
+
+	// Writes go to the master
+	written, _ := master.Get("testing:key")
+	if written != "hello" {
+		t.Fatalf("data should have been written to the master, %s given", written)
+	}
+}
+
+func TestSentinel_QueryUnlocked(t *testing.T) {
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+
+	sentinel := &Sentinel{
+		Addrs:      []string{"slow:26379"},
+		MasterName: "mymaster",
+		Dial: func(addr string) (redigo.Conn, error) {
+			close(blocked)
+			<-release
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := sentinel.ReplicaAddrs()
+		done <- err
+	}()
+
+	<-blocked
+
+	// The sentinel can be used while another query waits on the network
+	refreshed := make(chan struct{})
+	go func() {
+		sentinel.Refresh()
+		close(refreshed)
+	}()
+
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("the lock should not be held while querying sentinels")
+	}
+
+	close(release)
+
+	if err := <-done; err == nil {
+		t.Fatal("error expected without a reachable sentinel, none given")
+	}
+}
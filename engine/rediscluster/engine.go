@@ -0,0 +1,559 @@
+package rediscluster
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/go-redis/redis"
+)
+
+// Engine stores entries in a Redis Cluster. The data, expiry and lock keys of
+// an entry share a hash tag, the cache key wrapped in braces, so they always
+// live in the same slot and can be updated together by scripts. The prefix
+// must not contain braces, or it would become the hash tag instead, and empty
+// keys are rejected with ErrEmptyKey.
+type Engine struct {
+	prefix string
+	client *redis.ClusterClient
+
+	cleanupTimeout time.Duration
+
+	// Tokens of the locks held by this engine, so that only the holder of a
+	// lock can write while it is held, or release it
+	tokensLock sync.Mutex
+	tokens     map[string]string
+}
+
+// ErrEmptyKey is returned when given an empty key. The keys of its entry would
+// have an empty hash tag, and so could be spread over several slots.
+var ErrEmptyKey = errors.New("empty key")
+
+const expirePrefix = "expire:"
+const lockPrefix = "lock:"
+const tagPrefix = "tag:"
+
+// scanCount is the number of keys requested per SCAN iteration
+const scanCount = 1000
+
+// NewRedisClusterStore creates a new Redis Cluster backed store
+func NewRedisClusterStore(
+	prefix string,
+	client *redis.ClusterClient,
+	cleanupTimeout time.Duration,
+) (*Engine, error) {
+	if client == nil {
+		return nil, errors.New("nil client passed to NewRedisClusterStore")
+	}
+
+	return &Engine{
+		prefix:         prefix + ":",
+		client:         client,
+		cleanupTimeout: cleanupTimeout,
+		tokens:         make(map[string]string),
+	}, nil
+}
+
+// Exists checks to see if a key exists in the store
+func (e *Engine) Exists(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	result, err := e.client.Exists(e.getDataKey(key)).Result()
+	if err != nil {
+		return false
+	}
+
+	return result == 1
+}
+
+// Get retrieves data from the store based on key, if it exists, else it returns an error
+func (e *Engine) Get(key string) ([]byte, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+
+	data, err := e.client.Get(e.getDataKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, common.ErrNonExistentKey
+	}
+
+	return data, err
+}
+
+// GetMulti retrieves the data of many keys, with a single MGET for the keys
+// of each slot. Commands for the slots of a node are pipelined, and nodes are
+// queried concurrently.
+func (e *Engine) GetMulti(keys []string) (map[string][]byte, error) {
+	bySlot := make(map[int][]string)
+	for _, key := range keys {
+		if key == "" {
+			return nil, ErrEmptyKey
+		}
+
+		s := slot(e.getDataKey(key))
+		bySlot[s] = append(bySlot[s], key)
+	}
+
+	groups := make([][]string, 0, len(bySlot))
+	cmds := make([]*redis.SliceCmd, 0, len(bySlot))
+
+	_, err := e.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, group := range bySlot {
+			dataKeys := make([]string, len(group))
+			for i, key := range group {
+				dataKeys[i] = e.getDataKey(key)
+			}
+
+			groups = append(groups, group)
+			cmds = append(cmds, pipe.MGet(dataKeys...))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	result := make(map[string][]byte, len(keys))
+	for i, group := range groups {
+		values, err := cmds[i].Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for j, key := range group {
+			if data, ok := values[j].(string); ok {
+				result[key] = []byte(data)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Put stores data against a key, else it returns an error
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	return e.PutTagged(key, data, expires, nil)
+}
+
+// PutTagged stores data against a key and adds the key to the set of each tag.
+// While this engine holds the lock on the key, nothing is stored unless the
+// lock is still held, in which case common.ErrLockNotHeld is returned. Tag sets
+// live in slots of their own, so they are updated after the entry is stored.
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	stored, err := putScript.Run(e.client,
+		[]string{e.getDataKey(key), e.getExpireKey(key), e.getLockKey(key)},
+		data,
+		expires.Unix(),
+		e.ttl(),
+		e.token(key),
+	).Int64()
+	if err != nil {
+		return err
+	}
+
+	if stored == 0 {
+		return common.ErrLockNotHeld
+	}
+
+	if len(tags) == 0 {
+		return nil
+	}
+
+	_, err = e.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			pipe.SAdd(e.getTagKey(tag), key)
+			pipe.Expire(e.getTagKey(tag), e.cleanupTimeout)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state,
+// atomically and in a single round trip. If the key doesn't exist
+// common.ErrNonExistentKey is returned, along with the lock state.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	entry := common.Entry{Key: key}
+
+	if key == "" {
+		return entry, ErrEmptyKey
+	}
+
+	result, err := fetchScript.Run(e.client,
+		[]string{e.getDataKey(key), e.getExpireKey(key), e.getLockKey(key)},
+	).Result()
+	if err != nil {
+		return entry, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 3 {
+		return entry, common.ErrInvalidData
+	}
+
+	locked, _ := values[2].(int64)
+	entry.Locked = locked == 1
+
+	if s, ok := values[1].(string); ok {
+		expires, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return entry, common.ErrInvalidData
+		}
+
+		entry.Expires = time.Unix(expires, 0)
+	}
+
+	data, ok := values[0].(string)
+	if !ok {
+		return entry, common.ErrNonExistentKey
+	}
+	entry.Data = []byte(data)
+
+	return entry, nil
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	expiryTime, err := e.client.Get(e.getExpireKey(key)).Int64()
+	if err != nil {
+		return false
+	}
+
+	return time.Now().Unix() > expiryTime
+}
+
+// Expire marks the key as expired, and removes it from the storage engine
+func (e *Engine) Expire(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	return e.client.Del(e.getDataKey(key), e.getExpireKey(key), e.getLockKey(key)).Err()
+}
+
+// ExpireTag removes every key in the set of the given tag from the storage engine
+func (e *Engine) ExpireTag(tag string) error {
+	tagKey := e.getTagKey(tag)
+
+	keys, err := e.client.SMembers(tagKey).Result()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Only the members read are removed from the set, so that keys tagged in
+	// the meantime are kept
+	_, err = e.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(e.getDataKey(key), e.getExpireKey(key), e.getLockKey(key))
+			pipe.SRem(tagKey, key)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// DeletePrefix removes every key starting with the prefix from the storage engine
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.DeleteMatching(common.EscapeGlob(prefix)+"*", progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the storage
+// engine, scanning each master of the cluster concurrently
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	var mu sync.Mutex
+	deleted := 0
+
+	match := common.EscapeGlob(e.prefix+"{") + pattern + "}"
+	err := e.client.ForEachMaster(func(client *redis.Client) error {
+		var cursor uint64
+		for {
+			found, next, err := client.Scan(cursor, match, scanCount).Result()
+			if err != nil {
+				return err
+			}
+
+			if len(found) > 0 {
+				// The keys of an entry share its slot, so they are removed
+				// from the node they were found on
+				_, err = client.Pipelined(func(pipe redis.Pipeliner) error {
+					for _, k := range found {
+						key := e.trimDataKey(k)
+						pipe.Unlink(k, e.getExpireKey(key), e.getLockKey(key))
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+
+				mu.Lock()
+				deleted += len(found)
+				if progress != nil {
+					progress(deleted)
+				}
+				mu.Unlock()
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+
+	return deleted, err
+}
+
+// Scan returns a page of keys starting with prefix. Masters are scanned one
+// after another, ordered by address, and the cursor holds the master index and
+// its SCAN cursor. Keys may be skipped or repeated if slots move during a scan.
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	var master int
+	var masterCursor uint64
+	if cursor != "" {
+		_, err := fmt.Sscanf(cursor, "%d:%d", &master, &masterCursor)
+		if err != nil {
+			return nil, "", common.ErrInvalidCursor
+		}
+	}
+
+	masters, err := e.masters()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if master >= len(masters) {
+		return nil, "", nil
+	}
+
+	match := common.EscapeGlob(e.prefix+"{"+prefix) + "*"
+	found, next, err := masters[master].Scan(masterCursor, match, int64(count)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]string, 0, len(found))
+	for _, k := range found {
+		keys = append(keys, e.trimDataKey(k))
+	}
+
+	if next == 0 {
+		master++
+		if master >= len(masters) {
+			return keys, "", nil
+		}
+	}
+
+	return keys, fmt.Sprintf("%d:%d", master, next), nil
+}
+
+// ScanEntries returns a page of entries whose key starts with prefix, along
+// with their expiry and lock status. See Scan for details of the cursor.
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
+	keys, next, err := e.Scan(cursor, prefix, count)
+	if err != nil || len(keys) == 0 {
+		return nil, next, err
+	}
+
+	dataCmds := make([]*redis.StringCmd, len(keys))
+	expireCmds := make([]*redis.StringCmd, len(keys))
+	lockCmds := make([]*redis.IntCmd, len(keys))
+
+	_, err = e.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			dataCmds[i] = pipe.Get(e.getDataKey(key))
+			expireCmds[i] = pipe.Get(e.getExpireKey(key))
+			lockCmds[i] = pipe.Exists(e.getLockKey(key))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, next, err
+	}
+
+	entries := make([]common.Entry, 0, len(keys))
+	for i, key := range keys {
+		data, err := dataCmds[i].Bytes()
+		if err == redis.Nil {
+			// The key has been removed since it was scanned
+			continue
+		}
+		if err != nil {
+			return nil, next, err
+		}
+
+		entry := common.Entry{
+			Key:    key,
+			Data:   data,
+			Locked: lockCmds[i].Val() == 1,
+		}
+
+		expires, err := expireCmds[i].Int64()
+		if err == nil {
+			entry.Expires = time.Unix(expires, 0)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, next, nil
+}
+
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	result, err := e.client.Exists(e.getLockKey(key)).Result()
+	if err != nil {
+		return false
+	}
+
+	return result == 1
+}
+
+// Lock sets a lock against a given key, unless it is already locked in which
+// case common.ErrKeyAlreadyLocked is returned. The lock expires after the
+// cleanup timeout.
+func (e *Engine) Lock(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	locked, err := e.client.SetNX(e.getLockKey(key), token, time.Duration(e.ttl())*time.Second).Result()
+	if err != nil {
+		return err
+	}
+
+	if !locked {
+		return common.ErrKeyAlreadyLocked
+	}
+
+	e.tokensLock.Lock()
+	e.tokens[key] = token
+	e.tokensLock.Unlock()
+
+	return nil
+}
+
+// Unlock removes the lock from a given key. If this engine doesn't hold the
+// lock it returns common.ErrNonExistentKey, and if the lock expired or was
+// taken by another process since it returns common.ErrLockNotHeld.
+func (e *Engine) Unlock(key string) error {
+	e.tokensLock.Lock()
+	token, ok := e.tokens[key]
+	delete(e.tokens, key)
+	e.tokensLock.Unlock()
+
+	if !ok {
+		return common.ErrNonExistentKey
+	}
+
+	removed, err := unlockScript.Run(e.client, []string{e.getLockKey(key)}, token).Int64()
+	if err != nil {
+		return err
+	}
+
+	if removed == 0 {
+		return common.ErrLockNotHeld
+	}
+
+	return nil
+}
+
+// Close closes the client and its connections to every node
+func (e *Engine) Close() error {
+	return e.client.Close()
+}
+
+// masters returns the clients of the masters of the cluster, ordered by address
+func (e *Engine) masters() ([]*redis.Client, error) {
+	var mu sync.Mutex
+	var masters []*redis.Client
+
+	err := e.client.ForEachMaster(func(client *redis.Client) error {
+		mu.Lock()
+		masters = append(masters, client)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+
+	return masters, nil
+}
+
+// token returns the token of the lock held by this engine on the key, or ""
+func (e *Engine) token(key string) string {
+	e.tokensLock.Lock()
+	defer e.tokensLock.Unlock()
+
+	return e.tokens[key]
+}
+
+// ttl returns the cleanup timeout in whole seconds, as used for key expiry
+func (e *Engine) ttl() int64 {
+	ttl := int64(e.cleanupTimeout / time.Second)
+	if ttl < 1 {
+		ttl = 1
+	}
+
+	return ttl
+}
+
+// helper function for data keys, the key being the hash tag
+func (e *Engine) getDataKey(key string) string {
+	return e.prefix + "{" + key + "}"
+}
+
+// helper function for expiry keys
+func (e *Engine) getExpireKey(key string) string {
+	return e.prefix + expirePrefix + "{" + key + "}"
+}
+
+// helper function for locking / unlocking keys
+func (e *Engine) getLockKey(key string) string {
+	return e.prefix + lockPrefix + "{" + key + "}"
+}
+
+// helper function for tag sets
+func (e *Engine) getTagKey(tag string) string {
+	return e.prefix + tagPrefix + tag
+}
+
+// trimDataKey returns the cache key of a data key
+func (e *Engine) trimDataKey(k string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(k, e.prefix+"{"), "}")
+}
@@ -0,0 +1,286 @@
+package rediscluster
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/go-redis/redis"
+)
+
+// newTestStore starts a miniredis server, and returns it with an engine using
+// it as a cluster of a single node holding every slot
+func newTestStore(t *testing.T) (*miniredis.Miniredis, *Engine) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := server.Addr()
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		ClusterSlots: func() ([]redis.ClusterSlot, error) {
+			return []redis.ClusterSlot{{
+				Start: 0,
+				End:   slotCount - 1,
+				Nodes: []redis.ClusterNode{{Addr: addr}},
+			}}, nil
+		},
+	})
+
+	engine, err := NewRedisClusterStore("testing", client, 1*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, engine
+}
+
+func TestRedisClusterEngine_New(t *testing.T) {
+	_, err := NewRedisClusterStore("testing", nil, 1*time.Minute)
+	if err == nil {
+		t.Fatal("error expected for a nil client, none given")
+	}
+}
+
+func TestRedisClusterEngine_Put(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	content := []byte("hello")
+	expires := time.Now().Add(1 * time.Hour)
+
+	err := engine.Put("new-key", content, expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	data, _ := server.Get("testing:{new-key}")
+	if data != string(content) {
+		t.Fatalf("%s expected, %s given", content, data)
+	}
+
+	expiry, _ := server.Get("testing:expire:{new-key}")
+	if expiry != strconv.FormatInt(expires.Unix(), 10) {
+		t.Fatalf("%d expected, %s given", expires.Unix(), expiry)
+	}
+
+	if server.TTL("testing:{new-key}") != time.Minute || server.TTL("testing:expire:{new-key}") != time.Minute {
+		t.Fatal("keys should expire after the cleanup timeout")
+	}
+
+	if !engine.Exists("new-key") || engine.IsExpired("new-key") {
+		t.Fatal("key should exist and be fresh")
+	}
+
+	got, err := engine.Get("new-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if bytes.Compare(got, content) != 0 {
+		t.Fatalf("%s expected, %s given", content, got)
+	}
+
+	_, err = engine.Get("non-existing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+
+	err = engine.Expire("new-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(server.Keys()) != 0 {
+		t.Fatalf("every key should have been removed, %v given", server.Keys())
+	}
+}
+
+func TestRedisClusterEngine_GetMulti(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	expires := time.Now().Add(1 * time.Hour)
+	engine.Put("one", []byte("1"), expires)
+	engine.Put("two", []byte("2"), expires)
+
+	result, err := engine.GetMulti([]string{"one", "two", "missing"})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(result) != 2 || string(result["one"]) != "1" || string(result["two"]) != "2" {
+		t.Fatalf("the data of existing keys expected, %v given", result)
+	}
+}
+
+func TestRedisClusterEngine_Fetch(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	expires := time.Now().Add(-1 * time.Minute)
+	engine.Put("existing", []byte("hello"), expires)
+	engine.Lock("existing")
+
+	entry, err := engine.Fetch("existing")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if string(entry.Data) != "hello" || entry.Expires.Unix() != expires.Unix() || !entry.Locked {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	_, err = engine.Fetch("missing")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+}
+
+func TestRedisClusterEngine_Lock(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	err := engine.Lock("lock-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !engine.IsLocked("lock-key") || server.TTL("testing:lock:{lock-key}") != time.Minute {
+		t.Fatal("lock should be set, expiring after the cleanup timeout")
+	}
+
+	err = engine.Lock("lock-key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("already locked error expected, %v given", err)
+	}
+
+	err = engine.Put("lock-key", []byte("hello"), time.Now().Add(1*time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected while holding the lock, %s given", err)
+	}
+
+	// Another process takes the lock once it has expired
+	server.Set("testing:lock:{lock-key}", "other-token")
+
+	err = engine.Put("lock-key", []byte("stale"), time.Now().Add(1*time.Hour))
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("lock not held error expected, %v given", err)
+	}
+
+	err = engine.Unlock("lock-key")
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("lock not held error expected, %v given", err)
+	}
+
+	err = engine.Unlock("lock-key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected without holding the lock, %v given", err)
+	}
+
+	server.Del("testing:lock:{lock-key}")
+	engine.Lock("lock-key")
+
+	err = engine.Unlock("lock-key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.IsLocked("lock-key") {
+		t.Fatal("lock should have been removed")
+	}
+}
+
+func TestRedisClusterEngine_EmptyKey(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	_, fetchErr := engine.Fetch("")
+	_, getErr := engine.Get("")
+	_, getMultiErr := engine.GetMulti([]string{"key", ""})
+
+	for _, err := range []error{
+		engine.Put("", []byte("hello"), time.Now().Add(time.Hour)),
+		engine.Lock(""),
+		engine.Expire(""),
+		fetchErr,
+		getErr,
+		getMultiErr,
+	} {
+		if err != ErrEmptyKey {
+			t.Fatalf("%s expected, %v given", ErrEmptyKey, err)
+		}
+	}
+
+	if engine.Exists("") || engine.IsLocked("") || engine.IsExpired("") {
+		t.Fatal("an empty key should not exist")
+	}
+
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Fatalf("nothing should have been stored, %v given", keys)
+	}
+}
+
+func TestRedisClusterEngine_ExpireTag(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	expires := time.Now().Add(1 * time.Hour)
+	engine.PutTagged("tagged", []byte("hello"), expires, []string{"product:1"})
+	engine.Put("untagged", []byte("hello"), expires)
+
+	members, _ := server.Members("testing:tag:product:1")
+	if len(members) != 1 || members[0] != "tagged" {
+		t.Fatalf("key should have been added to the tag, %v given", members)
+	}
+
+	err := engine.ExpireTag("product:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if engine.Exists("tagged") || !engine.Exists("untagged") {
+		t.Fatal("only the tagged key should have been removed")
+	}
+}
+
+func TestRedisClusterEngine_ScanEntries(t *testing.T) {
+	server, engine := newTestStore(t)
+	defer server.Close()
+	defer engine.Close()
+
+	expires := time.Now().Add(1 * time.Hour)
+	engine.Put("product:1", []byte("one"), expires)
+	engine.Put("product:2", []byte("two"), expires)
+	engine.Put("user:1", []byte("user"), expires)
+	engine.Lock("product:2")
+
+	entries, next, err := engine.ScanEntries("", "product:", 100)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if next != "" || len(entries) != 2 {
+		t.Fatalf("2 entries expected in a single page, %d given", len(entries))
+	}
+
+	for _, entry := range entries {
+		if entry.Locked != (entry.Key == "product:2") || entry.Expires.Unix() != expires.Unix() {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+	}
+
+	_, _, err = engine.Scan("invalid", "", 100)
+	if err != common.ErrInvalidCursor {
+		t.Fatalf("invalid cursor error expected, %v given", err)
+	}
+}
@@ -0,0 +1,64 @@
+package rediscluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/go-redis/redis"
+)
+
+// Scripts run atomically on the node holding the slot of their keys, so every
+// key passed to a script must share a hash tag. go-redis sends them with
+// EVALSHA, falling back to EVAL when the node doesn't know them yet.
+var (
+	// fetchScript returns the data, expiry time and lock state of a key.
+	//
+	// KEYS: data, expire, lock
+	fetchScript = redis.NewScript(`
+return {
+	redis.call("GET", KEYS[1]),
+	redis.call("GET", KEYS[2]),
+	redis.call("EXISTS", KEYS[3])
+}
+`)
+
+	// putScript stores the data and expiry time of a key. Given a lock token,
+	// nothing is stored unless the lock is still held with that token.
+	// Returns 1 if stored, else 0.
+	//
+	// KEYS: data, expire, lock
+	// ARGV: data, expires, ttl, lock token or ""
+	putScript = redis.NewScript(`
+if ARGV[4] ~= "" and redis.call("GET", KEYS[3]) ~= ARGV[4] then
+	return 0
+end
+
+redis.call("SETEX", KEYS[1], ARGV[3], ARGV[1])
+redis.call("SETEX", KEYS[2], ARGV[3], ARGV[2])
+
+return 1
+`)
+
+	// unlockScript removes a lock if it is held with the given token. Returns
+	// 1 if removed, else 0.
+	//
+	// KEYS: lock
+	// ARGV: lock token
+	unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+
+return 0
+`)
+)
+
+// newToken returns a random lock token, unique to the lock holder
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,35 @@
+package rediscluster
+
+import "strings"
+
+// slotCount is the number of hash slots of a Redis Cluster
+const slotCount = 16384
+
+// slot returns the hash slot of a Redis key, hashing only its hash tag if it
+// has one, as Redis Cluster does
+func slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+
+	return int(crc16(key) % slotCount)
+}
+
+// crc16 implements CRC-16/XMODEM, the checksum used for hash slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+
+	return crc
+}
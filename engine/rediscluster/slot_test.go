@@ -0,0 +1,27 @@
+package rediscluster
+
+import "testing"
+
+func TestSlot(t *testing.T) {
+	if crc16("123456789") != 0x31c3 {
+		t.Fatalf("0x31c3 expected, %#x given", crc16("123456789"))
+	}
+
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"foo", 12182},
+		{"{user1000}.following", slot("user1000")},
+		{"{user1000}.followers", slot("user1000")},
+		{"foo{}{bar}", slot("foo{}{bar}")},
+		{"foo{{bar}}zap", slot("{bar")},
+		{"foo{bar}{zap}", slot("bar")},
+	}
+
+	for _, test := range tests {
+		if s := slot(test.key); s != test.slot {
+			t.Fatalf("slot %d expected for %s, %d given", test.slot, test.key, s)
+		}
+	}
+}
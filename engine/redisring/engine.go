@@ -2,37 +2,92 @@ package redisring
 
 import (
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/fresh8/go-cache/engine/common"
 	"github.com/go-redis/redis"
 )
 
-// Engine uses redis.v4 as the back end
+// Engine uses redis.v4 as the back end. The data, expiry and lock keys of an
+// entry share a hash tag, the cache key wrapped in braces, so the ring keeps
+// them on the same shard and they can be written in a single transaction. The
+// prefix must not contain braces, or it would become the hash tag instead.
 type Engine struct {
 	prefix string
 	ring   *redis.Ring
 
 	cleanupTimeout time.Duration
+	layout         Layout
+
+	// noUnlink is set once a shard rejects UNLINK
+	noUnlink int32
 }
 
+// ErrEmptyKey is returned when given an empty key. The keys of its entry would
+// have no hash tag, and so could be spread over several shards.
+var ErrEmptyKey = errors.New("empty key")
+
 const expirePrefix = "expire:"
 const lockPrefix = "lock:"
+const tagPrefix = "tag:"
+
+// scanCount is the number of keys requested per SCAN iteration
+const scanCount = 1000
+
+// fetchScript returns the data, expiry time and lock state of a key. The ring
+// runs it on the shard of the first key, which the others share.
+//
+// KEYS: data, expire, lock
+var fetchScript = redis.NewScript(`
+return {
+	redis.call("GET", KEYS[1]),
+	redis.call("GET", KEYS[2]),
+	redis.call("EXISTS", KEYS[3])
+}
+`)
+
+// txRetries is the number of times a transaction is attempted before giving
+// up, when it is aborted by a concurrent write
+const txRetries = 3
+
+// Option configures optional behaviour of the redis ring engine
+type Option func(*Engine)
+
+// StorageLayout sets the way entries are stored, KeysLayout by default
+func StorageLayout(layout Layout) Option {
+	return func(e *Engine) {
+		e.layout = layout
+	}
+}
 
 // NewRedisRingStore creates a new redis ring for use as a store
 func NewRedisRingStore(
 	prefix string,
 	ring *redis.Ring,
 	cleanupTimeout time.Duration,
+	opts ...Option,
 ) (*Engine, error) {
 	if ring == nil {
 		return nil, errors.New("nil ring passed to NewRedisRingStore")
 	}
 
-	return &Engine{
+	e := &Engine{
 		prefix:         prefix + ":",
 		ring:           ring,
 		cleanupTimeout: cleanupTimeout,
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(e)
+	}
+
+	return e, nil
 }
 
 // Exists checks to see if a key exists in the store
@@ -40,14 +95,16 @@ func (e *Engine) Exists(key string) bool {
 	var result int64
 	var err error
 
-	err = e.hasRing("Exists")
+	err = e.checkKey("Exists", key)
 	if err != nil {
 		return false
 	}
 
-	k := e.prefix + key
+	if e.layout == HashLayout {
+		return e.hashExists(key)
+	}
 
-	cmd := e.ring.Exists(k)
+	cmd := e.ring.Exists(e.getDataKey(key))
 	result, err = cmd.Result()
 
 	if err != nil {
@@ -62,43 +119,115 @@ func (e *Engine) Exists(key string) bool {
 func (e *Engine) Get(key string) ([]byte, error) {
 	var err error
 
-	err = e.hasRing("Get")
+	err = e.checkKey("Get", key)
 	if err != nil {
 		return nil, err
 	}
 
-	k := e.prefix + key
+	if e.layout == HashLayout {
+		return e.hashGet(key)
+	}
 
-	cmd := e.ring.Get(k)
+	cmd := e.ring.Get(e.getDataKey(key))
 	return cmd.Bytes()
 }
 
-// Put stores data against a key, else it returns an error
+// Put stores data against a key, else it returns an error. The data and expiry
+// keys are written in a transaction on the shard of the key.
 // SETEX doesn't exist within this lib, it's advised to use Set for similar behavior
 // https://github.com/go-redis/redis/blob/dc9d5006b3c319de24b2fa4de242e442553fcce2/commands.go#L726
 func (e *Engine) Put(key string, data []byte, expires time.Time) error {
 	var err error
-	err = e.hasRing("Put")
+	err = e.checkKey("Put", key)
 	if err != nil {
 		return err
 	}
 
-	dataKey := e.prefix + key
+	if e.layout == HashLayout {
+		return e.hashPut(key, data, expires)
+	}
+
+	dataKey := e.getDataKey(key)
+	expireKey := e.getExpireKey(key)
+
+	return e.tx(func(pipe redis.Pipeliner) error {
+		pipe.Set(dataKey, data, e.cleanupTimeout)
+		pipe.Set(expireKey, expires.Unix(), e.cleanupTimeout)
+		return nil
+	}, dataKey, expireKey)
+}
 
-	dataCmd := e.ring.Set(dataKey, data, e.cleanupTimeout)
-	err = dataCmd.Err()
+// PutTagged stores data against a key and adds the key to the set of each tag
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	err := e.Put(key, data, expires)
 	if err != nil {
 		return err
 	}
 
-	expireKey := e.getExpireKey(key)
-	expireCmd := e.ring.Set(expireKey, expires.Unix(), e.cleanupTimeout)
-	err = expireCmd.Err()
+	if len(tags) == 0 {
+		return nil
+	}
+
+	// Tag sets live on shards of their own, which the ring pipelines to
+	// separately
+	_, err = e.ring.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, tag := range tags {
+			tagKey := e.getTagKey(tag)
+			pipe.SAdd(tagKey, key)
+			pipe.Expire(tagKey, e.cleanupTimeout)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state,
+// atomically and in a single round trip to the shard of the key. If the key
+// doesn't exist common.ErrNonExistentKey is returned, along with the lock state.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	err := e.checkKey("Fetch", key)
 	if err != nil {
-		return err
+		return common.Entry{Key: key}, err
 	}
 
-	return nil
+	if e.layout == HashLayout {
+		return e.hashFetch(key)
+	}
+
+	entry := common.Entry{Key: key}
+
+	result, err := fetchScript.Run(e.ring,
+		[]string{e.getDataKey(key), e.getExpireKey(key), e.getLockKey(key)},
+	).Result()
+	if err != nil {
+		return entry, err
+	}
+
+	values, ok := result.([]interface{})
+	if !ok || len(values) != 3 {
+		return entry, common.ErrInvalidData
+	}
+
+	locked, _ := values[2].(int64)
+	entry.Locked = locked == 1
+
+	if s, ok := values[1].(string); ok {
+		expires, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return entry, common.ErrInvalidData
+		}
+
+		entry.Expires = time.Unix(expires, 0)
+	}
+
+	data, ok := values[0].(string)
+	if !ok {
+		return entry, common.ErrNonExistentKey
+	}
+	entry.Data = []byte(data)
+
+	return entry, nil
 }
 
 // IsExpired checks to see if the given key has expired
@@ -106,62 +235,84 @@ func (e *Engine) IsExpired(key string) bool {
 	var result int64
 	var err error
 
-	err = e.hasRing("IsExpired")
+	err = e.checkKey("IsExpired", key)
 	if err != nil {
 		return false
 	}
 
-	if e.Exists(expirePrefix + key) {
-		k := e.getExpireKey(key)
-		cmd := e.ring.Get(k)
-		result, err = cmd.Int64()
+	if e.layout == HashLayout {
+		return e.hashIsExpired(key)
+	}
 
-		if err != nil {
-			return false
-		}
+	cmd := e.ring.Get(e.getExpireKey(key))
+	result, err = cmd.Int64()
 
-		if time.Now().Unix() > result {
-			return true
-		}
+	if err != nil {
+		return false
 	}
 
-	return false
+	return time.Now().Unix() > result
 }
 
 // IsLocked checks to see if the key has been locked
 func (e *Engine) IsLocked(key string) bool {
-	err := e.hasRing("IsLocked")
+	err := e.checkKey("IsLocked", key)
+	if err != nil {
+		return false
+	}
+
+	if e.layout == HashLayout {
+		return e.hashIsLocked(key)
+	}
+
+	result, err := e.ring.Exists(e.getLockKey(key)).Result()
 	if err != nil {
 		return false
 	}
 
-	return e.Exists(lockPrefix + key)
+	return result == 1
 }
 
-// Lock sets a lock against a given key
+// Lock sets a lock against a given key, if it is already locked it returns
+// common.ErrKeyAlreadyLocked
 // SETEX doesn't exist within this lib, it's advised to use Set for similar behavior
 // https://github.com/go-redis/redis/blob/dc9d5006b3c319de24b2fa4de242e442553fcce2/commands.go#L726
 func (e *Engine) Lock(key string) error {
 	var err error
-	err = e.hasRing("Lock")
+	err = e.checkKey("Lock", key)
 	if err != nil {
 		return err
 	}
 
+	if e.layout == HashLayout {
+		return e.hashLock(key)
+	}
+
 	k := e.getLockKey(key)
-	cmd := e.ring.Set(k, []byte("1"), e.cleanupTimeout)
+	locked, err := e.ring.SetNX(k, []byte("1"), e.cleanupTimeout).Result()
+	if err != nil {
+		return err
+	}
 
-	return cmd.Err()
+	if !locked {
+		return common.ErrKeyAlreadyLocked
+	}
+
+	return nil
 }
 
 // Unlock removes the lock from a given key
 func (e *Engine) Unlock(key string) error {
 	var err error
-	err = e.hasRing("Unlock")
+	err = e.checkKey("Unlock", key)
 	if err != nil {
 		return err
 	}
 
+	if e.layout == HashLayout {
+		return e.hashUnlock(key)
+	}
+
 	k := e.getLockKey(key)
 	cmd := e.ring.Del(k)
 	return cmd.Err()
@@ -170,19 +321,293 @@ func (e *Engine) Unlock(key string) error {
 // Expire marks the key as expired and removes it from the storage engine
 func (e *Engine) Expire(key string) error {
 	var err error
-	err = e.hasRing("Expire")
+	err = e.checkKey("Expire", key)
 	if err != nil {
 		return err
 	}
 
-	k := e.prefix + key
-	expiryKey := e.getExpireKey(key)
-	lockKey := e.getLockKey(key)
-
-	cmd := e.ring.Del(k, expiryKey, lockKey)
+	// The keys of an entry share a shard, so a single DEL removes them all
+	cmd := e.ring.Del(e.entryKeys(key)...)
 	return cmd.Err()
 }
 
+// ExpireTag removes every key in the set of the given tag from the storage engine
+func (e *Engine) ExpireTag(tag string) error {
+	var err error
+	err = e.hasRing("ExpireTag")
+	if err != nil {
+		return err
+	}
+
+	tagKey := e.getTagKey(tag)
+
+	keys, err := e.ring.SMembers(tagKey).Result()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	// Entries may live on different shards, which the ring pipelines to
+	// separately. Only the members read are removed from the set, so that keys
+	// tagged in the meantime are kept.
+	_, err = e.ring.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			pipe.Del(e.entryKeys(key)...)
+			pipe.SRem(tagKey, key)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// DeletePrefix removes every key starting with the prefix from the storage engine
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.DeleteMatching(common.EscapeGlob(prefix)+"*", progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the storage
+// engine, scanning each shard of the ring concurrently
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	var err error
+	err = e.hasRing("DeleteMatching")
+	if err != nil {
+		return 0, err
+	}
+
+	var mu sync.Mutex
+	deleted := 0
+
+	match := common.EscapeGlob(e.prefix+"{") + pattern + "}"
+	err = e.ring.ForEachShard(func(client *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, match, scanCount).Result()
+			if err != nil {
+				return err
+			}
+
+			n, err := e.unlink(client, keys)
+			if err != nil {
+				return err
+			}
+
+			if n > 0 {
+				mu.Lock()
+				deleted += n
+				if progress != nil {
+					progress(deleted)
+				}
+				mu.Unlock()
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+
+	return deleted, err
+}
+
+// unlink removes the data keys found by a scan of a shard along with their
+// companion keys, which live on the same shard, returning the number of data
+// keys removed. Servers without UNLINK, before Redis 4.0, are sent DEL instead.
+func (e *Engine) unlink(client *redis.Client, keys []string) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	del := atomic.LoadInt32(&e.noUnlink) == 1
+
+	_, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			entryKeys := e.entryKeys(e.trimDataKey(k))
+			if del {
+				pipe.Del(entryKeys...)
+			} else {
+				pipe.Unlink(entryKeys...)
+			}
+		}
+		return nil
+	})
+
+	if !del && err != nil && strings.HasPrefix(err.Error(), "ERR unknown command") {
+		atomic.StoreInt32(&e.noUnlink, 1)
+		return e.unlink(client, keys)
+	}
+
+	return len(keys), err
+}
+
+// Scan returns a page of keys starting with prefix. Shards are scanned one after another, ordered by
+// address, and the cursor holds the shard index and its SCAN cursor. Keys may
+// be skipped or repeated if the live shards change during a scan.
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	var err error
+	err = e.hasRing("Scan")
+	if err != nil {
+		return nil, "", err
+	}
+
+	var shard int
+	var shardCursor uint64
+	if cursor != "" {
+		_, err = fmt.Sscanf(cursor, "%d:%d", &shard, &shardCursor)
+		if err != nil {
+			return nil, "", common.ErrInvalidCursor
+		}
+	}
+
+	shards, err := e.shards()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if shard >= len(shards) {
+		return nil, "", nil
+	}
+
+	match := common.EscapeGlob(e.prefix+"{"+prefix) + "*"
+	found, next, err := shards[shard].Scan(shardCursor, match, int64(count)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	keys := make([]string, 0, len(found))
+	for _, k := range found {
+		keys = append(keys, e.trimDataKey(k))
+	}
+
+	if next == 0 {
+		shard++
+		if shard >= len(shards) {
+			return keys, "", nil
+		}
+	}
+
+	return keys, fmt.Sprintf("%d:%d", shard, next), nil
+}
+
+// ScanEntries returns a page of entries whose key starts with prefix, along
+// with their expiry and lock status. See Scan for details of the cursor.
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
+	keys, next, err := e.Scan(cursor, prefix, count)
+	if err != nil || len(keys) == 0 {
+		return nil, next, err
+	}
+
+	if e.layout == HashLayout {
+		return e.hashEntries(keys, next)
+	}
+
+	dataCmds := make([]*redis.StringCmd, len(keys))
+	expireCmds := make([]*redis.StringCmd, len(keys))
+	lockCmds := make([]*redis.IntCmd, len(keys))
+
+	_, err = e.ring.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			dataCmds[i] = pipe.Get(e.getDataKey(key))
+			expireCmds[i] = pipe.Get(e.getExpireKey(key))
+			lockCmds[i] = pipe.Exists(e.getLockKey(key))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, next, err
+	}
+
+	entries := make([]common.Entry, 0, len(keys))
+	for i, key := range keys {
+		data, err := dataCmds[i].Bytes()
+		if err == redis.Nil {
+			// The key has been removed since it was scanned
+			continue
+		}
+		if err != nil {
+			return nil, next, err
+		}
+
+		entry := common.Entry{
+			Key:    key,
+			Data:   data,
+			Locked: lockCmds[i].Val() == 1,
+		}
+
+		expires, err := expireCmds[i].Int64()
+		if err == nil {
+			entry.Expires = time.Unix(expires, 0)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, next, nil
+}
+
+// shards returns the clients of the ring, ordered by address
+func (e *Engine) shards() ([]*redis.Client, error) {
+	var mu sync.Mutex
+	var shards []*redis.Client
+
+	err := e.ring.ForEachShard(func(client *redis.Client) error {
+		mu.Lock()
+		shards = append(shards, client)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(shards, func(i, j int) bool {
+		return shards[i].Options().Addr < shards[j].Options().Addr
+	})
+
+	return shards, nil
+}
+
+// Close closes the ring and its connections to every shard
+func (e *Engine) Close() error {
+	err := e.hasRing("Close")
+	if err != nil {
+		return err
+	}
+
+	return e.ring.Close()
+}
+
+// tx runs the commands queued by fn in a MULTI/EXEC transaction on the shard
+// of the keys, which must share a hash tag. The transaction is retried if a
+// concurrent write to the keys aborts it.
+func (e *Engine) tx(fn func(redis.Pipeliner) error, keys ...string) error {
+	var err error
+	for i := 0; i < txRetries; i++ {
+		err = e.ring.Watch(func(tx *redis.Tx) error {
+			_, err := tx.Pipelined(fn)
+			return err
+		}, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return err
+}
+
+// entryKeys returns the keys holding the entry of a key
+func (e *Engine) entryKeys(key string) []string {
+	if e.layout == HashLayout {
+		return []string{e.getDataKey(key)}
+	}
+
+	return []string{e.getDataKey(key), e.getExpireKey(key), e.getLockKey(key)}
+}
+
 // helper function that checks to see if a valid ring exists on the engine
 func (e *Engine) hasRing(method string) error {
 	if e.ring != nil {
@@ -192,12 +617,37 @@ func (e *Engine) hasRing(method string) error {
 	return errors.New(method + ": nil ring in redisring engine")
 }
 
+// checkKey checks the ring, and that the key can be used as a hash tag
+func (e *Engine) checkKey(method string, key string) error {
+	err := e.hasRing(method)
+	if err == nil && key == "" {
+		err = ErrEmptyKey
+	}
+
+	return err
+}
+
+// helper function for data keys, the key being the hash tag
+func (e *Engine) getDataKey(key string) string {
+	return e.prefix + "{" + key + "}"
+}
+
 // helper function for locking / unlocking keys
 func (e *Engine) getLockKey(key string) string {
-	return e.prefix + lockPrefix + key
+	return e.prefix + lockPrefix + "{" + key + "}"
 }
 
 // helper function for expiry keys
 func (e *Engine) getExpireKey(key string) string {
-	return e.prefix + expirePrefix + key
+	return e.prefix + expirePrefix + "{" + key + "}"
+}
+
+// helper function for tag sets
+func (e *Engine) getTagKey(tag string) string {
+	return e.prefix + tagPrefix + tag
+}
+
+// trimDataKey returns the cache key of a data key
+func (e *Engine) trimDataKey(k string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(k, e.prefix+"{"), "}")
 }
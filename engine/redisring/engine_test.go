@@ -0,0 +1,430 @@
+package redisring
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/go-redis/redis"
+)
+
+// newTestStore starts miniredis servers, and returns them with an engine using
+// them as the shards of a ring. miniredis doesn't describe its commands, so the
+// ring routes commands to random shards, except within transactions.
+func newTestStore(t *testing.T, shards int, opts ...Option) ([]*miniredis.Miniredis, *Engine) {
+	var servers []*miniredis.Miniredis
+	addrs := make(map[string]string)
+
+	for i := 0; i < shards; i++ {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		servers = append(servers, server)
+		addrs["shard"+strconv.Itoa(i)] = server.Addr()
+	}
+
+	engine, err := NewRedisRingStore("testing", redis.NewRing(&redis.RingOptions{Addrs: addrs}), time.Minute, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return servers, engine
+}
+
+func closeServers(servers []*miniredis.Miniredis) {
+	for _, server := range servers {
+		server.Close()
+	}
+}
+
+// shardOf returns the server holding the key, or nil
+func shardOf(servers []*miniredis.Miniredis, key string) *miniredis.Miniredis {
+	for _, server := range servers {
+		if server.Exists(key) {
+			return server
+		}
+	}
+
+	return nil
+}
+
+func TestRedisRingEngine_PutSharesShard(t *testing.T) {
+	servers, engine := newTestStore(t, 2)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	for i := 0; i < 20; i++ {
+		key := "key:" + strconv.Itoa(i)
+
+		err := engine.Put(key, []byte("hello"), time.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		server := shardOf(servers, "testing:{"+key+"}")
+		if server == nil {
+			t.Fatalf("data of %s should have been written", key)
+		}
+
+		if !server.Exists("testing:expire:{" + key + "}") {
+			t.Fatalf("the keys of %s should share its shard", key)
+		}
+	}
+}
+
+func TestRedisRingEngine_Put(t *testing.T) {
+	servers, engine := newTestStore(t, 1)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+
+	for i := 0; i < 20; i++ {
+		key := "key:" + strconv.Itoa(i)
+
+		err := engine.PutTagged(key, []byte("hello"), expires, []string{"all"})
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		engine.Lock(key)
+	}
+
+	if !engine.Exists("key:1") || engine.IsExpired("key:1") || !engine.IsLocked("key:1") {
+		t.Fatal("key should exist, be fresh and locked")
+	}
+
+	data, err := engine.Get("key:1")
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("hello expected, %s given", data)
+	}
+
+	entry, err := engine.Fetch("key:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if string(entry.Data) != "hello" || entry.Expires.Unix() != expires.Unix() || !entry.Locked {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	err = engine.Expire("key:1")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if shardOf(servers, "testing:{key:1}") != nil || shardOf(servers, "testing:expire:{key:1}") != nil {
+		t.Fatal("the keys of the entry should have been removed")
+	}
+
+	entries, _, err := engine.ScanEntries("", "key:", 100)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(entries) == 0 || entries[0].Expires.Unix() != expires.Unix() || !entries[0].Locked {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	err = engine.ExpireTag("all")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	for _, server := range servers {
+		if keys := server.Keys(); len(keys) != 0 {
+			t.Fatalf("every key should have been removed, %v given", keys)
+		}
+	}
+}
+
+func TestRedisRingEngine_Lock(t *testing.T) {
+	for name, layout := range map[string]Layout{"keys": KeysLayout, "hash": HashLayout} {
+		servers, engine := newTestStore(t, 1, StorageLayout(layout))
+
+		engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+
+		err := engine.Lock("key")
+		if err != nil {
+			t.Fatalf("%s: no error expected, %s given", name, err)
+		}
+
+		err = engine.Lock("key")
+		if err != common.ErrKeyAlreadyLocked {
+			t.Fatalf("%s: %s expected, %v given", name, common.ErrKeyAlreadyLocked, err)
+		}
+
+		err = engine.Unlock("key")
+		if err != nil {
+			t.Fatalf("%s: no error expected, %s given", name, err)
+		}
+
+		err = engine.Lock("key")
+		if err != nil {
+			t.Fatalf("%s: no error expected once unlocked, %s given", name, err)
+		}
+
+		for _, err := range []error{
+			engine.Put("", []byte("hello"), time.Now().Add(time.Hour)),
+			engine.Lock(""),
+		} {
+			if err != ErrEmptyKey {
+				t.Fatalf("%s: %s expected, %v given", name, ErrEmptyKey, err)
+			}
+		}
+
+		engine.Close()
+		closeServers(servers)
+	}
+}
+
+func TestRedisRingEngine_HashKeysLayoutEntry(t *testing.T) {
+	servers, engine := newTestStore(t, 1)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	engine.Put("old", []byte("hello"), time.Now().Add(time.Hour))
+
+	hashEngine, _ := NewRedisRingStore("testing", engine.ring, time.Minute, StorageLayout(HashLayout))
+
+	// Entries left over from the keys layout are missing until migrated
+	if hashEngine.Exists("old") || hashEngine.IsLocked("old") {
+		t.Fatal("old entry should be missing")
+	}
+
+	_, err := hashEngine.Get("old")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+
+	_, err = hashEngine.Fetch("old")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("non-existent key error expected, %v given", err)
+	}
+
+	entries, _, err := hashEngine.ScanEntries("", "", 10)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("no entries expected, %v given", entries)
+	}
+
+	// and are replaced when locked
+	err = hashEngine.Lock("old")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if servers[0].Type("testing:{old}") != "hash" || !hashEngine.IsLocked("old") {
+		t.Fatal("old entry should have been replaced by a locked entry hash")
+	}
+
+	err = hashEngine.Put("old", []byte("world"), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	data, err := hashEngine.Get("old")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if string(data) != "world" {
+		t.Fatalf("world expected, %s given", data)
+	}
+}
+
+func TestRedisRingEngine_MigrateToHashLayout(t *testing.T) {
+	servers, engine := newTestStore(t, 1)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 10; i++ {
+		engine.Put("key:"+strconv.Itoa(i), []byte("hello"), expires)
+	}
+
+	hashEngine, _ := NewRedisRingStore("testing", engine.ring, time.Minute, StorageLayout(HashLayout))
+
+	migrated, err := hashEngine.MigrateToHashLayout(nil)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if migrated != 10 {
+		t.Fatalf("10 entries should have been migrated, %d given", migrated)
+	}
+
+	for _, server := range servers {
+		for _, key := range server.Keys() {
+			if server.Type(key) != "hash" {
+				t.Fatalf("only entry hashes should be left, %s given", key)
+			}
+		}
+	}
+
+	if !hashEngine.Exists("key:1") || hashEngine.IsExpired("key:1") {
+		t.Fatal("migrated entries should exist and be fresh")
+	}
+
+	entry, err := hashEngine.Fetch("key:1")
+	if err != nil || string(entry.Data) != "hello" || entry.Expires.Unix() != expires.Unix() {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+}
+
+func TestRedisRingEngine_DeletePrefix(t *testing.T) {
+	servers, engine := newTestStore(t, 2)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 50; i++ {
+		engine.Put("a*:"+strconv.Itoa(i), []byte("hello"), expires)
+	}
+	engine.Put("ab:1", []byte("hello"), expires)
+	engine.Put("b:1", []byte("hello"), expires)
+
+	var progress []int
+	deleted, err := engine.DeletePrefix("a*", func(n int) {
+		progress = append(progress, n)
+	})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if deleted != 50 {
+		t.Fatalf("50 deletions expected, %d given", deleted)
+	}
+
+	if len(progress) == 0 || progress[len(progress)-1] != deleted {
+		t.Fatalf("progress should end with the total, %v given", progress)
+	}
+
+	for i := 1; i < len(progress); i++ {
+		if progress[i] <= progress[i-1] {
+			t.Fatalf("progress should be a running total, %v given", progress)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		key := "a*:" + strconv.Itoa(i)
+		if shardOf(servers, "testing:{"+key+"}") != nil || shardOf(servers, "testing:expire:{"+key+"}") != nil {
+			t.Fatalf("the keys of %s should have been deleted", key)
+		}
+	}
+
+	// The prefix is matched literally
+	if shardOf(servers, "testing:{ab:1}") == nil || shardOf(servers, "testing:{b:1}") == nil {
+		t.Fatal("keys not starting with the prefix shouldn't have been deleted")
+	}
+}
+
+func TestRedisRingEngine_DeleteMatching(t *testing.T) {
+	servers, engine := newTestStore(t, 2)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"a?1", "ab1", "a?22", "b?1"} {
+		engine.Put(key, []byte("hello"), expires)
+	}
+
+	var progress []int
+	deleted, err := engine.DeleteMatching(`a\??`, func(n int) {
+		progress = append(progress, n)
+	})
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if deleted != 1 || len(progress) != 1 || progress[0] != 1 {
+		t.Fatalf("1 deletion expected, %d given with progress %v", deleted, progress)
+	}
+
+	if shardOf(servers, "testing:{a?1}") != nil {
+		t.Fatal("the matching key should have been deleted")
+	}
+
+	for _, key := range []string{"ab1", "a?22", "b?1"} {
+		if shardOf(servers, "testing:{"+key+"}") == nil {
+			t.Fatalf("%s doesn't match the escaped pattern and shouldn't have been deleted", key)
+		}
+	}
+}
+
+func TestRedisRingEngine_Scan(t *testing.T) {
+	servers, engine := newTestStore(t, 3)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < 30; i++ {
+		engine.Put("a*:"+strconv.Itoa(i), []byte("hello"), expires)
+	}
+	engine.Put("ab:1", []byte("hello"), expires)
+	engine.PutTagged("b:1", []byte("hello"), expires, []string{"a*"})
+
+	found := make(map[string]bool)
+	cursor := ""
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("the scan should complete")
+		}
+
+		keys, next, err := engine.Scan(cursor, "a*", 5)
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+
+		for _, key := range keys {
+			found[key] = true
+		}
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if len(found) != 30 || found["ab:1"] {
+		t.Fatalf("the 30 keys starting with the prefix expected, %d given", len(found))
+	}
+
+	_, _, err := engine.Scan("invalid", "", 5)
+	if err != common.ErrInvalidCursor {
+		t.Fatalf("%s expected, %v given", common.ErrInvalidCursor, err)
+	}
+}
+
+func TestRedisRingEngine_ScanEntries(t *testing.T) {
+	servers, engine := newTestStore(t, 1)
+	defer closeServers(servers)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	engine.Put("a:1", []byte("first"), expires)
+	engine.Put("a:2", []byte("second"), expires)
+	engine.Lock("a:2")
+
+	entries, cursor, err := engine.ScanEntries("", "a:", 10)
+	if err != nil || cursor != "" {
+		t.Fatalf("a single page expected, %q %v given", cursor, err)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("2 entries expected, %d given", len(entries))
+	}
+
+	for _, entry := range entries {
+		if entry.Expires.Unix() != expires.Unix() || entry.Locked != (entry.Key == "a:2") {
+			t.Fatalf("unexpected entry %+v", entry)
+		}
+	}
+}
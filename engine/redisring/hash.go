@@ -0,0 +1,375 @@
+package redisring
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	"github.com/go-redis/redis"
+)
+
+// Layout is the way entries are stored in Redis
+type Layout int
+
+// Storage layouts
+const (
+	// KeysLayout stores each entry as up to three keys, holding the data, the
+	// expiry time and the lock. This is the default.
+	KeysLayout Layout = iota
+	// HashLayout stores each entry as a single hash, with data, expires,
+	// locked and stored_at fields, expiring as a whole after the cleanup
+	// timeout. As an entry is a single key, it always lives on one shard.
+	HashLayout
+)
+
+// Hash fields of an entry stored with HashLayout
+const (
+	dataField     = "data"
+	expiresField  = "expires"
+	lockedField   = "locked"
+	storedAtField = "stored_at"
+)
+
+var (
+	// hashPutScript stores the data and expiry time of an entry hash. An
+	// entry stored with KeysLayout is replaced.
+	//
+	// KEYS: entry
+	// ARGV: data, expires, stored at, ttl in milliseconds
+	hashPutScript = redis.NewScript(`
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) == "string" then
+	redis.call("DEL", KEYS[1])
+end
+
+redis.call("HMSET", KEYS[1], "data", ARGV[1], "expires", ARGV[2], "stored_at", ARGV[3])
+redis.call("PEXPIRE", KEYS[1], ARGV[4])
+
+return 1
+`)
+
+	// hashReadScript reads the data, expires and locked fields of an entry
+	// hash. An entry stored with KeysLayout is reported as missing.
+	//
+	// KEYS: entry
+	hashReadScript = redis.NewScript(`
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) ~= "hash" then
+	return {false, false, false}
+end
+
+return redis.call("HMGET", KEYS[1], "data", "expires", "locked")
+`)
+
+	// hashLockScript locks an entry hash until the deadline, making sure the
+	// hash lives at least as long as the lock. Locks are held as
+	// "<deadline>:", the format used by the redis engine without a token. An
+	// entry stored with KeysLayout is removed. Returns 0 if the lock is
+	// already held, else 1.
+	//
+	// KEYS: entry
+	// ARGV: lock deadline, ttl in milliseconds, now
+	hashLockScript = redis.NewScript(`
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) == "string" then
+	redis.call("DEL", KEYS[1])
+end
+
+local locked = redis.call("HGET", KEYS[1], "locked")
+if locked then
+	local deadline = tonumber(string.match(locked, "^(%d+):"))
+	if deadline and deadline > tonumber(ARGV[3]) then
+		return 0
+	end
+end
+
+redis.call("HSET", KEYS[1], "locked", ARGV[1] .. ":")
+if redis.call("PTTL", KEYS[1]) < tonumber(ARGV[2]) then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+
+return 1
+`)
+
+	// migrateScript converts an entry stored with KeysLayout into an entry
+	// hash, keeping its remaining time to live. Locks aren't carried over.
+	// Returns 1 if converted, else 0.
+	//
+	// KEYS: data, expire, lock
+	// ARGV: stored at
+	migrateScript = redis.NewScript(`
+-- TYPE replies with a status, which scripts see as a table
+local kind = redis.call("TYPE", KEYS[1])
+if (kind.ok or kind) ~= "string" then
+	return 0
+end
+
+local data = redis.call("GET", KEYS[1])
+local expires = redis.call("GET", KEYS[2])
+local ttl = redis.call("PTTL", KEYS[1])
+
+redis.call("DEL", KEYS[1], KEYS[2], KEYS[3])
+redis.call("HMSET", KEYS[1], "data", data, "stored_at", ARGV[1])
+if expires then
+	redis.call("HSET", KEYS[1], "expires", expires)
+end
+if ttl > 0 then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+
+return 1
+`)
+)
+
+func (e *Engine) hashExists(key string) bool {
+	exists, err := e.ring.HExists(e.getDataKey(key), dataField).Result()
+	if err != nil {
+		return false
+	}
+
+	return exists
+}
+
+func (e *Engine) hashGet(key string) ([]byte, error) {
+	values, err := hashValues(hashReadScript.Run(e.ring, []string{e.getDataKey(key)}))
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := hashEntry(key, values, time.Now())
+
+	return entry.Data, err
+}
+
+func (e *Engine) hashPut(key string, data []byte, expires time.Time) error {
+	return hashPutScript.Run(e.ring, []string{e.getDataKey(key)},
+		data,
+		expires.Unix(),
+		time.Now().Unix(),
+		e.ttl(),
+	).Err()
+}
+
+func (e *Engine) hashIsExpired(key string) bool {
+	expiryTime, err := e.ring.HGet(e.getDataKey(key), expiresField).Int64()
+	if err != nil {
+		return false
+	}
+
+	return time.Now().Unix() > expiryTime
+}
+
+func (e *Engine) hashIsLocked(key string) bool {
+	locked, err := e.ring.HGet(e.getDataKey(key), lockedField).Result()
+	if err != nil {
+		return false
+	}
+
+	return lockHeld(locked, time.Now())
+}
+
+func (e *Engine) hashLock(key string) error {
+	now := time.Now()
+
+	locked, err := hashLockScript.Run(e.ring, []string{e.getDataKey(key)},
+		now.Add(e.cleanupTimeout).Unix(),
+		e.ttl(),
+		now.Unix(),
+	).Int64()
+	if err != nil {
+		return err
+	}
+
+	if locked == 0 {
+		return common.ErrKeyAlreadyLocked
+	}
+
+	return nil
+}
+
+func (e *Engine) hashUnlock(key string) error {
+	return e.ring.HDel(e.getDataKey(key), lockedField).Err()
+}
+
+// hashEntries reads the entry hashes of the keys, skipping those removed since
+// they were scanned
+func (e *Engine) hashEntries(keys []string, next string) ([]common.Entry, string, error) {
+	cmds := make([]*redis.Cmd, len(keys))
+
+	_, err := e.ring.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = hashReadScript.Eval(pipe, []string{e.getDataKey(key)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, next, err
+	}
+
+	now := time.Now()
+	entries := make([]common.Entry, 0, len(keys))
+	for i, key := range keys {
+		values, err := hashValues(cmds[i])
+		if err != nil {
+			return nil, next, err
+		}
+
+		entry, err := hashEntry(key, values, now)
+		if err == common.ErrNonExistentKey {
+			// The key has been removed since it was scanned
+			continue
+		}
+		if err != nil {
+			return nil, next, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, next, nil
+}
+
+func (e *Engine) hashFetch(key string) (common.Entry, error) {
+	values, err := hashValues(hashReadScript.Run(e.ring, []string{e.getDataKey(key)}))
+	if err != nil {
+		return common.Entry{Key: key}, err
+	}
+
+	return hashEntry(key, values, time.Now())
+}
+
+// hashValues returns the fields read by hashReadScript
+func hashValues(cmd *redis.Cmd) ([]interface{}, error) {
+	reply, err := cmd.Result()
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, common.ErrInvalidData
+	}
+
+	return values, nil
+}
+
+// hashEntry builds an entry from the data, expires and locked fields of an
+// entry hash, returning common.ErrNonExistentKey if there is no data
+func hashEntry(key string, values []interface{}, now time.Time) (common.Entry, error) {
+	entry := common.Entry{Key: key}
+
+	if len(values) != 3 {
+		return entry, common.ErrInvalidData
+	}
+
+	if locked, ok := values[2].(string); ok {
+		entry.Locked = lockHeld(locked, now)
+	}
+
+	if s, ok := values[1].(string); ok {
+		expires, err := strconv.ParseInt(s, 10, 64)
+		if err == nil {
+			entry.Expires = time.Unix(expires, 0)
+		}
+	}
+
+	data, ok := values[0].(string)
+	if !ok {
+		return entry, common.ErrNonExistentKey
+	}
+	entry.Data = []byte(data)
+
+	return entry, nil
+}
+
+// MigrateToHashLayout converts every entry stored with KeysLayout into an
+// entry hash, keeping its remaining time to live, and returns the number of
+// entries converted. Locks aren't carried over. Each shard of the ring is
+// scanned concurrently, and the progress function, if not nil, is called
+// after each batch with the running total.
+//
+// Until converted, old entries are reported as missing by engines using
+// HashLayout, and are replaced when stored again or locked, so migrating is
+// optional.
+func (e *Engine) MigrateToHashLayout(progress func(int)) (int, error) {
+	err := e.hasRing("MigrateToHashLayout")
+	if err != nil {
+		return 0, err
+	}
+
+	var mu sync.Mutex
+	migrated := 0
+
+	match := common.EscapeGlob(e.prefix+"{") + "*"
+	err = e.ring.ForEachShard(func(client *redis.Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, match, scanCount).Result()
+			if err != nil {
+				return err
+			}
+
+			n := 0
+			for _, k := range keys {
+				key := e.trimDataKey(k)
+
+				// The keys of an entry share the scanned shard
+				converted, err := migrateScript.Run(client,
+					[]string{k, e.getExpireKey(key), e.getLockKey(key)},
+					time.Now().Unix(),
+				).Int64()
+				if err != nil {
+					return err
+				}
+
+				n += int(converted)
+			}
+
+			if n > 0 {
+				mu.Lock()
+				migrated += n
+				if progress != nil {
+					progress(migrated)
+				}
+				mu.Unlock()
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+
+	return migrated, err
+}
+
+// ttl returns the time to live of entry hashes in milliseconds, at least 1
+func (e *Engine) ttl() int64 {
+	ms := int64(e.cleanupTimeout / time.Millisecond)
+	if ms < 1 {
+		return 1
+	}
+
+	return ms
+}
+
+// lockHeld checks if a "<deadline>:<token>" lock is held at the given time
+func lockHeld(locked string, now time.Time) bool {
+	i := strings.IndexByte(locked, ':')
+	if i < 0 {
+		return false
+	}
+
+	deadline, err := strconv.ParseInt(locked[:i], 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return deadline > now.Unix()
+}
@@ -0,0 +1,169 @@
+package sql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the flavour of SQL spoken by the database
+type Dialect int
+
+const (
+	// Postgres is PostgreSQL 9.5 or later, locking with advisory locks
+	Postgres Dialect = iota
+	// MySQL is MySQL 5.7 or later, locking with named locks
+	MySQL
+	// SQLite is SQLite 3.24 or later. It has no locks outliving a
+	// transaction, so locks are rows of the locks table, leased for the
+	// cleanup timeout.
+	SQLite
+)
+
+// Schema returns the statements creating the tables used by an engine with
+// the given table name, if they don't exist yet. Every table name starts with
+// it:
+//
+//	<table>        the entries
+//	    cache_key   the key, compared byte by byte
+//	    data        the data
+//	    expires_at  when the entry expires, in Unix nanoseconds
+//	    delete_at   when the entry is removed, in Unix nanoseconds
+//	<table>_tags   the tags of each entry
+//	    tag, cache_key
+//	<table>_locks  the locks, with SQLite only
+//	    cache_key, token, expires_at
+func (d Dialect) Schema(table string) []string {
+	switch d {
+	case Postgres:
+		return []string{
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	cache_key VARCHAR(250) COLLATE "C" PRIMARY KEY,
+	data BYTEA NOT NULL,
+	expires_at BIGINT NOT NULL,
+	delete_at BIGINT NOT NULL
+)`, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_delete_at ON %s (delete_at)`, table, table),
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_tags (
+	tag VARCHAR(250) NOT NULL,
+	cache_key VARCHAR(250) COLLATE "C" NOT NULL,
+	PRIMARY KEY (tag, cache_key)
+)`, table),
+			fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_tags_cache_key ON %s_tags (cache_key)`, table, table),
+		}
+
+	case MySQL:
+		return []string{
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	cache_key VARCHAR(250) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin PRIMARY KEY,
+	data LONGBLOB NOT NULL,
+	expires_at BIGINT NOT NULL,
+	delete_at BIGINT NOT NULL,
+	INDEX %s_delete_at (delete_at)
+)`, table, table),
+			fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_tags (
+	tag VARCHAR(250) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+	cache_key VARCHAR(250) CHARACTER SET utf8mb4 COLLATE utf8mb4_bin NOT NULL,
+	PRIMARY KEY (tag, cache_key),
+	INDEX %s_tags_cache_key (cache_key)
+)`, table, table),
+		}
+	}
+
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	cache_key TEXT PRIMARY KEY,
+	data BLOB NOT NULL,
+	expires_at INTEGER NOT NULL,
+	delete_at INTEGER NOT NULL
+)`, table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_delete_at ON %s (delete_at)`, table, table),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_tags (
+	tag TEXT NOT NULL,
+	cache_key TEXT NOT NULL,
+	PRIMARY KEY (tag, cache_key)
+)`, table),
+		fmt.Sprintf(`CREATE INDEX IF NOT EXISTS %s_tags_cache_key ON %s_tags (cache_key)`, table, table),
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s_locks (
+	cache_key TEXT PRIMARY KEY,
+	token TEXT NOT NULL,
+	expires_at INTEGER NOT NULL
+)`, table),
+	}
+}
+
+// rebind replaces the ? placeholders of a query with those of the dialect
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r != '?' {
+			b.WriteRune(r)
+			continue
+		}
+
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return b.String()
+}
+
+// upsert returns the statement storing an entry, replacing any existing one
+func (d Dialect) upsert(table string) string {
+	insert := fmt.Sprintf("INSERT INTO %s (cache_key, data, expires_at, delete_at) VALUES (?, ?, ?, ?)", table)
+
+	if d == MySQL {
+		return insert + " ON DUPLICATE KEY UPDATE data = VALUES(data), expires_at = VALUES(expires_at), delete_at = VALUES(delete_at)"
+	}
+
+	return insert + " ON CONFLICT (cache_key) DO UPDATE SET data = excluded.data, expires_at = excluded.expires_at, delete_at = excluded.delete_at"
+}
+
+// insertIgnore returns the statement inserting a row unless one with the same
+// primary key exists
+func (d Dialect) insertIgnore(table string, columns ...string) string {
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	insert := fmt.Sprintf("INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+
+	if d == MySQL {
+		return "INSERT IGNORE " + insert
+	}
+
+	return "INSERT " + insert + " ON CONFLICT DO NOTHING"
+}
+
+// prefixCondition returns the condition selecting the keys starting with
+// prefix, along with its arguments. LIKE ignores the case of ASCII letters with
+// SQLite, so keys are compared byte by byte against the range of those starting
+// with prefix instead. With Postgres and MySQL keys are collated byte by byte,
+// so LIKE is case sensitive and ranges could hold invalid UTF-8.
+func (d Dialect) prefixCondition(prefix string) (string, []interface{}) {
+	if d != SQLite {
+		return "cache_key LIKE ? ESCAPE '!'", []interface{}{likePrefix(prefix)}
+	}
+
+	// The first string after every string starting with prefix
+	end := []byte(prefix)
+	for len(end) > 0 && end[len(end)-1] == 0xff {
+		end = end[:len(end)-1]
+	}
+
+	if len(end) == 0 {
+		return "cache_key >= ?", []interface{}{prefix}
+	}
+
+	end[len(end)-1]++
+	return "cache_key >= ? AND cache_key < ?", []interface{}{prefix, string(end)}
+}
+
+// likePrefix returns a LIKE pattern matching strings starting with prefix,
+// escaped with !
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return r.Replace(prefix) + "%"
+}
@@ -0,0 +1,489 @@
+// Package sql is a storage engine keeping entries in a relational database
+// through database/sql, for deployments where no cache server is available.
+// Postgres, MySQL and SQLite are supported, see Dialect.
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// Engine stores entries in the tables described by Dialect.Schema. Like the
+// other engines, an entry stays available once it has expired, so that stale
+// data can be served while it is regenerated, until cleanupTimeout after it
+// was stored. A background job deletes the rows of such entries every
+// expirePoll.
+type Engine struct {
+	db      *sql.DB
+	dialect Dialect
+	table   string
+
+	expirePoll     time.Duration
+	cleanupTimeout time.Duration
+
+	// The connections holding the advisory locks taken by this engine, or the
+	// tokens of its leased locks with SQLite
+	heldLock sync.Mutex
+	held     map[string]*heldConn
+	tokens   map[string]string
+
+	// done is closed by Close to stop the cleanup job
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// deleteBatchSize is the number of keys removed per transaction when deleting
+// by prefix or pattern
+const deleteBatchSize = 1000
+
+// NewSQLStore creates a store keeping its entries in tables whose name starts
+// with table, which must be a valid identifier. The tables are created if they
+// don't exist, see Dialect.Schema.
+func NewSQLStore(db *sql.DB, dialect Dialect, table string, expirePoll time.Duration, cleanupTimeout time.Duration) (*Engine, error) {
+	for _, statement := range dialect.Schema(table) {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e := &Engine{
+		db:             db,
+		dialect:        dialect,
+		table:          table,
+		expirePoll:     expirePoll,
+		cleanupTimeout: cleanupTimeout,
+		held:           make(map[string]*heldConn),
+		tokens:         make(map[string]string),
+		done:           make(chan struct{}),
+	}
+
+	e.cleanupExpiredKeys()
+
+	return e, nil
+}
+
+// Exists checks to see if a key exists in the store
+func (e *Engine) Exists(key string) bool {
+	var exists bool
+
+	err := e.queryRow(
+		"SELECT COUNT(*) > 0 FROM %s WHERE cache_key = ? AND delete_at > ?",
+		key, time.Now().UnixNano(),
+	).Scan(&exists)
+
+	return err == nil && exists
+}
+
+// Get retrieves data from the store based on key, if it exists, else it returns an error
+func (e *Engine) Get(key string) ([]byte, error) {
+	var data []byte
+
+	err := e.queryRow(
+		"SELECT data FROM %s WHERE cache_key = ? AND delete_at > ?",
+		key, time.Now().UnixNano(),
+	).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNonExistentKey
+	}
+
+	return data, err
+}
+
+// Fetch retrieves the data of a key along with its expiry time and lock state.
+// If the key doesn't exist common.ErrNonExistentKey is returned, along with the
+// lock state.
+func (e *Engine) Fetch(key string) (common.Entry, error) {
+	entry := common.Entry{
+		Key:    key,
+		Locked: e.IsLocked(key),
+	}
+
+	var expires int64
+	err := e.queryRow(
+		"SELECT data, expires_at FROM %s WHERE cache_key = ? AND delete_at > ?",
+		key, time.Now().UnixNano(),
+	).Scan(&entry.Data, &expires)
+	if err == sql.ErrNoRows {
+		return entry, common.ErrNonExistentKey
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	entry.Expires = time.Unix(0, expires)
+
+	return entry, nil
+}
+
+// Put stores data against a key, else it returns an error
+func (e *Engine) Put(key string, data []byte, expires time.Time) error {
+	return e.PutTagged(key, data, expires, nil)
+}
+
+// PutTagged stores data against a key and associates it with the given tags,
+// replacing any tags previously held by the key
+func (e *Engine) PutTagged(key string, data []byte, expires time.Time, tags []string) error {
+	if data == nil {
+		data = []byte{}
+	}
+
+	return e.lockedTransaction(key, func(tx *sql.Tx) error {
+		_, err := tx.Exec(e.dialect.rebind(e.dialect.upsert(e.table)),
+			key, data, expires.UnixNano(), e.hardExpiry(expires).UnixNano())
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(e.query("DELETE FROM %s_tags WHERE cache_key = ?"), key)
+		if err != nil {
+			return err
+		}
+
+		insertTag := e.dialect.rebind(e.dialect.insertIgnore(e.table+"_tags", "tag", "cache_key"))
+		for _, tag := range tags {
+			_, err = tx.Exec(insertTag, tag, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// IsExpired checks to see if the key has expired
+func (e *Engine) IsExpired(key string) bool {
+	var expires int64
+
+	now := time.Now().UnixNano()
+	err := e.queryRow(
+		"SELECT expires_at FROM %s WHERE cache_key = ? AND delete_at > ?",
+		key, now,
+	).Scan(&expires)
+	if err != nil {
+		return true
+	}
+
+	return now > expires
+}
+
+// Expire marks the key as expired, and removes it from the storage engine
+func (e *Engine) Expire(key string) error {
+	return e.lockedTransaction(key, func(tx *sql.Tx) error {
+		removed, err := e.remove(tx, key)
+		if err != nil {
+			return err
+		}
+
+		if !removed {
+			return common.ErrNonExistentKey
+		}
+
+		return nil
+	})
+}
+
+// ExpireTag removes every key carrying the given tag from the storage engine
+func (e *Engine) ExpireTag(tag string) error {
+	return e.transaction(func(tx *sql.Tx) error {
+		keys, err := e.keys(tx, "SELECT cache_key FROM %s_tags WHERE tag = ?", tag)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			_, err = e.remove(tx, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// DeletePrefix removes every key starting with the prefix from the storage engine
+func (e *Engine) DeletePrefix(prefix string, progress func(int)) (int, error) {
+	return e.deleteWhere(prefix, func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	}, progress)
+}
+
+// DeleteMatching removes every key matching the glob pattern from the storage engine
+func (e *Engine) DeleteMatching(pattern string, progress func(int)) (int, error) {
+	return e.deleteWhere("", func(key string) bool {
+		return common.MatchGlob(pattern, key)
+	}, progress)
+}
+
+// Scan returns up to count keys starting with prefix, in key order. The cursor
+// is the last key returned by the previous page.
+func (e *Engine) Scan(cursor string, prefix string, count int) ([]string, string, error) {
+	var keys []string
+
+	next, err := e.scan(cursor, prefix, count, "cache_key", func(rows *sql.Rows) (string, error) {
+		var key string
+		err := rows.Scan(&key)
+		keys = append(keys, key)
+		return key, err
+	})
+
+	return keys, next, err
+}
+
+// ScanEntries returns up to count entries whose key starts with prefix, in key
+// order. The cursor is the last key returned by the previous page.
+func (e *Engine) ScanEntries(cursor string, prefix string, count int) ([]common.Entry, string, error) {
+	var entries []common.Entry
+
+	next, err := e.scan(cursor, prefix, count, "cache_key, data, expires_at", func(rows *sql.Rows) (string, error) {
+		var entry common.Entry
+		var expires int64
+
+		err := rows.Scan(&entry.Key, &entry.Data, &expires)
+		entry.Expires = time.Unix(0, expires)
+		entries = append(entries, entry)
+		return entry.Key, err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	for i := range entries {
+		entries[i].Locked = e.IsLocked(entries[i].Key)
+	}
+
+	return entries, next, nil
+}
+
+// Close stops the cleanup job and releases the locks held by this engine,
+// returning the first error met releasing them. The database is left open, as
+// it is owned by the caller.
+func (e *Engine) Close() error {
+	e.closeOnce.Do(func() {
+		close(e.done)
+		e.closeErr = e.releaseAll()
+	})
+
+	return e.closeErr
+}
+
+// query formats a query with the table name, and the dialect's placeholders
+func (e *Engine) query(query string) string {
+	return e.dialect.rebind(strings.Replace(query, "%s", e.table, -1))
+}
+
+// queryRow runs a query formatted by query, expected to return one row
+func (e *Engine) queryRow(query string, args ...interface{}) *sql.Row {
+	return e.db.QueryRow(e.query(query), args...)
+}
+
+// transaction runs fn in a transaction, which is committed unless fn returns
+// an error
+func (e *Engine) transaction(fn func(tx *sql.Tx) error) error {
+	tx, err := e.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	return commit(tx, fn)
+}
+
+// commit runs fn in the transaction, which is committed unless fn returns an
+// error
+func commit(tx *sql.Tx, fn func(tx *sql.Tx) error) error {
+	err := fn(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// hardExpiry returns when an entry stored now with the given expiry is removed
+func (e *Engine) hardExpiry(expires time.Time) time.Time {
+	if e.cleanupTimeout <= 0 {
+		return expires
+	}
+
+	return time.Now().Add(e.cleanupTimeout)
+}
+
+// remove deletes the entry of a key and its tags, reporting whether it existed
+func (e *Engine) remove(tx *sql.Tx, key string) (bool, error) {
+	_, err := tx.Exec(e.query("DELETE FROM %s_tags WHERE cache_key = ?"), key)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec(e.query("DELETE FROM %s WHERE cache_key = ?"), key)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// keys returns the keys selected by a query formatted by query
+func (e *Engine) keys(tx *sql.Tx, query string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(e.query(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// scan selects the columns of the live entries following the cursor and
+// starting with prefix, in key order, passing each row to fn which returns its
+// key, and returns the cursor of the next page
+func (e *Engine) scan(cursor string, prefix string, count int, columns string, fn func(*sql.Rows) (string, error)) (string, error) {
+	condition, prefixArgs := e.dialect.prefixCondition(prefix)
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE cache_key > ? AND %s AND delete_at > ? ORDER BY cache_key",
+		columns, e.table, condition,
+	)
+	args := append([]interface{}{cursor}, prefixArgs...)
+	args = append(args, time.Now().UnixNano())
+
+	// One more row than requested tells whether there is a next page
+	if count > 0 {
+		query += " LIMIT ?"
+		args = append(args, count+1)
+	}
+
+	rows, err := e.db.Query(e.dialect.rebind(query), args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		if count > 0 && n == count {
+			return cursor, nil
+		}
+
+		cursor, err = fn(rows)
+		if err != nil {
+			return "", err
+		}
+		n++
+	}
+
+	return "", rows.Err()
+}
+
+// deleteWhere pages through the keys starting with prefix and removes those
+// matching in batches, so that large deletions don't hold locks for their
+// whole duration
+func (e *Engine) deleteWhere(prefix string, match func(string) bool, progress func(int)) (int, error) {
+	deleted := 0
+	cursor := ""
+
+	for {
+		keys, next, err := e.Scan(cursor, prefix, deleteBatchSize)
+		if err != nil {
+			return deleted, err
+		}
+
+		n := 0
+		err = e.transaction(func(tx *sql.Tx) error {
+			for _, key := range keys {
+				if !match(key) {
+					continue
+				}
+
+				removed, err := e.remove(tx, key)
+				if err != nil {
+					return err
+				}
+				if removed {
+					n++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+
+		if n > 0 {
+			deleted += n
+			if progress != nil {
+				progress(deleted)
+			}
+		}
+
+		if next == "" {
+			return deleted, nil
+		}
+		cursor = next
+	}
+}
+
+// cleanupExpiredKeys deletes the rows of hard expired keys every expirePoll,
+// until the engine is closed
+func (e *Engine) cleanupExpiredKeys() {
+	if e.expirePoll <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(e.expirePoll)
+
+	go func() {
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				e.removeExpired()
+			case <-e.done:
+				return
+			}
+		}
+	}()
+}
+
+// removeExpired deletes the rows of every hard expired key and lock
+func (e *Engine) removeExpired() error {
+	now := time.Now().UnixNano()
+
+	err := e.transaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec(e.query(
+			"DELETE FROM %s_tags WHERE cache_key IN (SELECT cache_key FROM %s WHERE delete_at <= ?)",
+		), now)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(e.query("DELETE FROM %s WHERE delete_at <= ?"), now)
+		return err
+	})
+	if err != nil || e.dialect != SQLite {
+		return err
+	}
+
+	_, err = e.db.Exec(e.query("DELETE FROM %s_locks WHERE expires_at <= ?"), now)
+	return err
+}
@@ -0,0 +1,332 @@
+package sql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestStore opens a SQLite database in a new directory, which the caller
+// removes
+func newTestStore(t *testing.T) (*Engine, string) {
+	dir, err := ioutil.TempDir("", "go-cache-sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "cache.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	engine, err := NewSQLStore(db, SQLite, "cache", time.Hour, time.Hour)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return engine, dir
+}
+
+func TestSQLEngine_PutGet(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	content := []byte("hello")
+	expires := time.Now().Add(time.Hour)
+
+	err := engine.Put("key", content, expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// Puts replace the existing entry
+	err = engine.Put("key", content, expires)
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !engine.Exists("key") || engine.IsExpired("key") {
+		t.Fatal("key should exist and be fresh")
+	}
+
+	entry, err := engine.Fetch("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !bytes.Equal(entry.Data, content) || !entry.Expires.Equal(expires) {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	err = engine.Expire("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	_, err = engine.Get("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestSQLEngine_Expiry(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	engine.Put("stale", []byte("hello"), time.Now().Add(-time.Minute))
+
+	if !engine.Exists("stale") || !engine.IsExpired("stale") {
+		t.Fatal("expired keys should stay available until the cleanup timeout")
+	}
+
+	engine.cleanupTimeout = time.Nanosecond
+	engine.PutTagged("gone", []byte("hello"), time.Now().Add(-time.Minute), []string{"all"})
+	time.Sleep(time.Millisecond)
+
+	if engine.Exists("gone") {
+		t.Fatal("hard expired keys shouldn't exist")
+	}
+
+	err := engine.removeExpired()
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	var rows int
+	engine.db.QueryRow("SELECT COUNT(*) FROM cache_tags").Scan(&rows)
+	if rows != 0 {
+		t.Fatalf("the tags of hard expired keys should have been deleted, %d rows given", rows)
+	}
+
+	if !engine.Exists("stale") {
+		t.Fatal("only hard expired keys should have been deleted")
+	}
+}
+
+func TestSQLEngine_Tags(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	engine.PutTagged("first", []byte("1"), expires, []string{"all", "odd"})
+	engine.PutTagged("second", []byte("2"), expires, []string{"all"})
+
+	// Tags are replaced by each write
+	engine.PutTagged("first", []byte("1"), expires, []string{"all"})
+
+	engine.ExpireTag("odd")
+	if !engine.Exists("first") {
+		t.Fatal("first no longer carries the odd tag")
+	}
+
+	engine.ExpireTag("all")
+	if engine.Exists("first") || engine.Exists("second") {
+		t.Fatal("every key carrying the tag should have been removed")
+	}
+}
+
+func TestSQLEngine_Scan(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for _, key := range []string{"a:1", "a:2", "a:3", "a_1", "b:1"} {
+		engine.Put(key, []byte(key), expires)
+	}
+
+	keys, cursor, err := engine.Scan("", "a:", 2)
+	if err != nil || len(keys) != 2 || keys[0] != "a:1" || cursor != "a:2" {
+		t.Fatalf("the first page expected, %v %q %v given", keys, cursor, err)
+	}
+
+	entries, cursor, err := engine.ScanEntries(cursor, "a:", 2)
+	if err != nil || len(entries) != 1 || string(entries[0].Data) != "a:3" || cursor != "" {
+		t.Fatalf("the last page expected, %+v %q %v given", entries, cursor, err)
+	}
+
+	var progress int
+	deleted, err := engine.DeleteMatching("a:*", func(n int) { progress = n })
+	if err != nil || deleted != 3 || progress != 3 {
+		t.Fatalf("3 deletions expected, %d given", deleted)
+	}
+
+	if !engine.Exists("a_1") || !engine.Exists("b:1") {
+		t.Fatal("keys not matching shouldn't have been deleted")
+	}
+
+	// Prefixes are case sensitive
+	for _, key := range []string{"Apple", "apple", "apples", "apq"} {
+		engine.Put(key, []byte(key), expires)
+	}
+
+	keys, _, err = engine.Scan("", "app", 0)
+	if err != nil || len(keys) != 2 || keys[0] != "apple" || keys[1] != "apples" {
+		t.Fatalf("[apple apples] expected, %v %v given", keys, err)
+	}
+
+	keys, _, err = engine.Scan("", "", 0)
+	if err != nil || len(keys) != 6 {
+		t.Fatalf("every key expected, %v %v given", keys, err)
+	}
+}
+
+func TestSQLEngine_Lock(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	other, err := NewSQLStore(engine.db, SQLite, "cache", time.Hour, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	err = engine.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	if !other.IsLocked("key") {
+		t.Fatal("the lock should be seen by other processes")
+	}
+
+	err = other.Lock("key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("%s expected, %v given", common.ErrKeyAlreadyLocked, err)
+	}
+
+	err = other.Unlock("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("only the holder should release the lock, %v given", err)
+	}
+
+	err = engine.Unlock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	// A lock whose lease ran out can be taken by another process
+	engine.cleanupTimeout = time.Nanosecond
+	engine.Lock("key")
+	time.Sleep(time.Millisecond)
+
+	err = other.Lock("key")
+	if err != nil {
+		t.Fatalf("no error expected, %s given", err)
+	}
+
+	err = engine.Unlock("key")
+	if err != common.ErrLockNotHeld {
+		t.Fatalf("%s expected, %v given", common.ErrLockNotHeld, err)
+	}
+}
+
+func TestSQLEngine_LockedWrites(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	// The only connection of the pool stands in for one holding the lock on
+	// the key, as taken with Postgres or MySQL
+	engine.db.SetMaxOpenConns(1)
+
+	conn, err := engine.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	engine.held["key"] = &heldConn{conn: conn}
+	defer delete(engine.held, "key")
+
+	done := make(chan error)
+	go func() {
+		err := engine.Put("key", []byte("hello"), time.Now().Add(time.Hour))
+		if err == nil {
+			err = engine.Expire("key")
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("writes to a locked key should run on the connection holding the lock")
+	}
+}
+
+func TestSQLEngine_LockReserved(t *testing.T) {
+	engine, dir := newTestStore(t)
+	defer os.RemoveAll(dir)
+	defer engine.Close()
+
+	// Locks are taken as with MySQL, while the only connection of the pool is
+	// busy, so that the first Lock waits for it
+	engine.dialect = MySQL
+	defer func() { engine.dialect = SQLite }()
+	engine.db.SetMaxOpenConns(1)
+
+	conn, err := engine.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- engine.Lock("key")
+	}()
+
+	for reserved := false; !reserved; {
+		engine.heldLock.Lock()
+		_, reserved = engine.held["key"]
+		engine.heldLock.Unlock()
+	}
+
+	err = engine.Lock("key")
+	if err != common.ErrKeyAlreadyLocked {
+		t.Fatalf("%s expected while the lock is being taken, %v given", common.ErrKeyAlreadyLocked, err)
+	}
+
+	// SQLite can't take the lock, so the key is no longer reserved
+	conn.Close()
+	if err := <-done; err == nil {
+		t.Fatal("error expected taking the lock, none given")
+	}
+
+	if len(engine.held) != 0 {
+		t.Fatalf("the key should no longer be reserved, %v given", engine.held)
+	}
+
+	err = engine.Unlock("key")
+	if err != common.ErrNonExistentKey {
+		t.Fatalf("%s expected, %v given", common.ErrNonExistentKey, err)
+	}
+}
+
+func TestDialect_Rebind(t *testing.T) {
+	query := Postgres.rebind("SELECT data FROM cache WHERE cache_key = ? AND delete_at > ?")
+	if query != "SELECT data FROM cache WHERE cache_key = $1 AND delete_at > $2" {
+		t.Fatalf("numbered placeholders expected, %s given", query)
+	}
+
+	if MySQL.rebind("cache_key = ?") != "cache_key = ?" {
+		t.Fatal("MySQL placeholders should be unchanged")
+	}
+}
@@ -0,0 +1,323 @@
+package sql
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fresh8/go-cache/engine/common"
+)
+
+// Locks are taken with the session level advisory locks of Postgres, or named
+// locks of MySQL, which are held by a connection until released or the
+// connection is lost. Each lock held therefore keeps a connection of the pool
+// to itself until unlocked. A crashed process loses its connections, so its
+// locks are released straight away.
+//
+// Put, PutTagged and Expire run on the connection holding the lock on their
+// key, if this engine holds it, so writing a locked key never waits for
+// another connection. Still, the pool must allow as many open connections as
+// keys locked at once, such as the number of regeneration workers of a cacher,
+// plus those used by everything else. Should the pool be exhausted, Lock gives
+// up after lockConnTimeout rather than waiting for a connection.
+//
+// SQLite has no such locks, so locks are rows of the locks table instead, which
+// expire after the cleanup timeout should a process crash before unlocking.
+
+// IsLocked checks to see if the key has been locked
+func (e *Engine) IsLocked(key string) bool {
+	var locked bool
+	var err error
+
+	switch e.dialect {
+	case Postgres:
+		id := e.lockID(key)
+		err = e.db.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND classid = $1 AND objid = $2 AND objsubid = 1)",
+			int64(uint32(id>>32)), int64(uint32(id)),
+		).Scan(&locked)
+	case MySQL:
+		err = e.db.QueryRow("SELECT IS_USED_LOCK(?) IS NOT NULL", e.lockName(key)).Scan(&locked)
+	default:
+		err = e.db.QueryRow(
+			fmt.Sprintf("SELECT COUNT(*) > 0 FROM %s_locks WHERE cache_key = ? AND expires_at > ?", e.table),
+			key, time.Now().UnixNano(),
+		).Scan(&locked)
+	}
+
+	return err == nil && locked
+}
+
+// lockConnTimeout is how long Lock waits for a connection of the pool
+const lockConnTimeout = 5 * time.Second
+
+// heldConn is the connection holding the lock on a key. Its mutex serialises
+// taking the lock, the writes to the key run on it, and releasing the lock. The
+// connection is nil if the lock couldn't be taken.
+type heldConn struct {
+	sync.Mutex
+	conn *sql.Conn
+}
+
+// Lock sets a lock against the given key, if it is already locked it returns
+// common.ErrKeyAlreadyLocked
+func (e *Engine) Lock(key string) error {
+	if e.dialect == SQLite {
+		return e.leaseLock(key)
+	}
+
+	// Reserve the key, so that the lock is only taken once by this engine
+	held := &heldConn{}
+	held.Lock()
+	defer held.Unlock()
+
+	e.heldLock.Lock()
+	_, reserved := e.held[key]
+	if !reserved {
+		e.held[key] = held
+	}
+	e.heldLock.Unlock()
+
+	if reserved {
+		return common.ErrKeyAlreadyLocked
+	}
+
+	err := e.takeLock(held, key)
+	if err != nil {
+		e.heldLock.Lock()
+		if e.held[key] == held {
+			delete(e.held, key)
+		}
+		e.heldLock.Unlock()
+	}
+
+	return err
+}
+
+// takeLock takes the lock on a key on a connection of its own, kept in held
+func (e *Engine) takeLock(held *heldConn, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), lockConnTimeout)
+	conn, err := e.db.Conn(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+
+	ctx = context.Background()
+
+	var locked bool
+	if e.dialect == Postgres {
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", e.lockID(key)).Scan(&locked)
+	} else {
+		err = conn.QueryRowContext(ctx, "SELECT COALESCE(GET_LOCK(?, 0), 0) = 1", e.lockName(key)).Scan(&locked)
+	}
+	if err != nil || !locked {
+		conn.Close()
+		if err != nil {
+			return err
+		}
+		return common.ErrKeyAlreadyLocked
+	}
+
+	held.conn = conn
+
+	return nil
+}
+
+// Unlock removes the lock from a given key. If this engine doesn't hold the
+// lock it returns common.ErrNonExistentKey, and if the lock expired or was
+// lost along with its connection it returns common.ErrLockNotHeld.
+func (e *Engine) Unlock(key string) error {
+	if e.dialect == SQLite {
+		return e.leaseUnlock(key)
+	}
+
+	e.heldLock.Lock()
+	held, ok := e.held[key]
+	delete(e.held, key)
+	e.heldLock.Unlock()
+
+	if !ok {
+		return common.ErrNonExistentKey
+	}
+
+	return e.release(held, key)
+}
+
+// lockedTransaction runs fn in a transaction on the connection holding the
+// lock on key, if this engine holds it, else on any connection of the pool
+func (e *Engine) lockedTransaction(key string, fn func(tx *sql.Tx) error) error {
+	e.heldLock.Lock()
+	held, ok := e.held[key]
+	e.heldLock.Unlock()
+
+	if !ok {
+		return e.transaction(fn)
+	}
+
+	held.Lock()
+	defer held.Unlock()
+
+	if held.conn == nil {
+		// The lock couldn't be taken
+		return e.transaction(fn)
+	}
+
+	tx, err := held.conn.BeginTx(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	return commit(tx, fn)
+}
+
+// release unlocks a key on the connection holding its lock, and returns the
+// connection to the pool
+func (e *Engine) release(held *heldConn, key string) error {
+	held.Lock()
+	defer held.Unlock()
+
+	if held.conn == nil {
+		// The lock couldn't be taken
+		return common.ErrLockNotHeld
+	}
+	defer held.conn.Close()
+
+	ctx := context.Background()
+
+	var released bool
+	var err error
+	if e.dialect == Postgres {
+		err = held.conn.QueryRowContext(ctx, "SELECT pg_advisory_unlock($1)", e.lockID(key)).Scan(&released)
+	} else {
+		err = held.conn.QueryRowContext(ctx, "SELECT COALESCE(RELEASE_LOCK(?), 0) = 1", e.lockName(key)).Scan(&released)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !released {
+		return common.ErrLockNotHeld
+	}
+
+	return nil
+}
+
+// leaseLock adds a row for the lock to the locks table, unless a lock which
+// hasn't expired exists
+func (e *Engine) leaseLock(key string) error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	_, err = e.db.Exec(
+		fmt.Sprintf("DELETE FROM %s_locks WHERE cache_key = ? AND expires_at <= ?", e.table),
+		key, now.UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	result, err := e.db.Exec(
+		e.dialect.insertIgnore(e.table+"_locks", "cache_key", "token", "expires_at"),
+		key, token, now.Add(e.cleanupTimeout).UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return common.ErrKeyAlreadyLocked
+	}
+
+	e.heldLock.Lock()
+	e.tokens[key] = token
+	e.heldLock.Unlock()
+
+	return nil
+}
+
+// leaseUnlock removes the row of the lock, if it still holds this engine's
+// token
+func (e *Engine) leaseUnlock(key string) error {
+	e.heldLock.Lock()
+	token, ok := e.tokens[key]
+	delete(e.tokens, key)
+	e.heldLock.Unlock()
+
+	if !ok {
+		return common.ErrNonExistentKey
+	}
+
+	result, err := e.db.Exec(
+		fmt.Sprintf("DELETE FROM %s_locks WHERE cache_key = ? AND token = ? AND expires_at > ?", e.table),
+		key, token, time.Now().UnixNano(),
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		if err != nil {
+			return err
+		}
+		return common.ErrLockNotHeld
+	}
+
+	return nil
+}
+
+// releaseAll unlocks every key locked by this engine, and returns the first
+// error met
+func (e *Engine) releaseAll() error {
+	e.heldLock.Lock()
+	held := e.held
+	e.held = make(map[string]*heldConn)
+	e.heldLock.Unlock()
+
+	var first error
+	for key, conn := range held {
+		err := e.release(conn, key)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// lockID returns the Postgres advisory lock ID of a key
+func (e *Engine) lockID(key string) int64 {
+	sum := sha256.Sum256([]byte(e.table + ":" + key))
+	return int64(binary.BigEndian.Uint64(sum[:8]))
+}
+
+// lockName returns the MySQL lock name of a key, which is limited to 64
+// characters
+func (e *Engine) lockName(key string) string {
+	sum := sha256.Sum256([]byte(e.table + ":" + key))
+	return hex.EncodeToString(sum[:24])
+}
+
+// newToken returns a random token identifying a lock holder
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -10,7 +10,7 @@ import (
 )
 
 func main() {
-	memoryEngine := engine.NewMemoryStore(10 * time.Second)
+	memoryEngine := engine.NewMemoryStore(10*time.Second, 10*time.Second)
 
 	cache := cacher.NewCacher(memoryEngine, 10, 10)
 
@@ -0,0 +1,67 @@
+package joque
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrQueueClosed is returned when pushing a job to a closed queue
+var ErrQueueClosed = errors.New("job queue closed")
+
+// Queue is a job queue processed by a pool of workers, which unlike the queue
+// returned by Setup can be closed to stop its workers
+type Queue struct {
+	jobs chan Job
+
+	lock    sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+// New creates a job queue, and starts the workers to process it
+func New(maxQueueSize int, maxWorkers int) *Queue {
+	q := &Queue{
+		jobs: make(chan Job, maxQueueSize),
+	}
+
+	q.workers.Add(maxWorkers)
+	for i := 0; i < maxWorkers; i++ {
+		go func() {
+			defer q.workers.Done()
+
+			for job := range q.jobs {
+				job()
+			}
+		}()
+	}
+
+	return q
+}
+
+// Push adds a job to the queue, blocking while the queue is full. It returns
+// ErrQueueClosed once the queue has been closed.
+func (q *Queue) Push(job Job) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	q.jobs <- job
+
+	return nil
+}
+
+// Close stops the queue accepting jobs, and waits for the jobs already queued
+// to be processed before stopping the workers
+func (q *Queue) Close() {
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.lock.Unlock()
+
+	q.workers.Wait()
+}
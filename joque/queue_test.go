@@ -0,0 +1,33 @@
+package joque
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestQueueClose(t *testing.T) {
+	q := New(10, 2)
+
+	var processed int32
+	for i := 0; i < 10; i++ {
+		err := q.Push(func() {
+			atomic.AddInt32(&processed, 1)
+		})
+		if err != nil {
+			t.Fatalf("no error expected, %s given", err)
+		}
+	}
+
+	q.Close()
+
+	if processed != 10 {
+		t.Fatalf("queued jobs should be processed before close returns, %d processed", processed)
+	}
+
+	if err := q.Push(func() {}); err != ErrQueueClosed {
+		t.Fatalf("%s expected, %v given", ErrQueueClosed, err)
+	}
+
+	// Closing twice is harmless
+	q.Close()
+}
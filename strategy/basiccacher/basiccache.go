@@ -4,6 +4,7 @@
 package basiccacher
 
 import (
+	"io"
 	"time"
 
 	"github.com/fresh8/go-cache/engine/common"
@@ -12,25 +13,47 @@ import (
 
 type cacher struct {
 	engine   common.Engine
-	jobQueue chan joque.Job
+	jobQueue *joque.Queue
 }
 
 // Cacher defines the interface for a caching system so it can be customised.
 type Cacher interface {
 	Get(string) ([]byte, error)
 	Put(string, time.Time, []byte) error
+	PutTagged(string, time.Time, []byte, []string) error
 	Expire(string) error
+	ExpireTag(string) error
+	ExpirePrefix(string, func(int)) (int, error)
+	Close() error
 }
 
 // NewCacher creates a new generic cacher with the given engine.
 func NewCacher(engine common.Engine, maxQueueSize int, maxWorkers int) Cacher {
 	return cacher{
 		engine:   engine,
-		jobQueue: joque.Setup(maxQueueSize, maxWorkers),
+		jobQueue: joque.New(maxQueueSize, maxWorkers),
 	}
 }
 
 func (c cacher) get(key string) (data []byte, err error) {
+	// Read the key in a single round trip when the engine supports it
+	if fetcher, ok := c.engine.(common.Fetcher); ok {
+		entry, err := fetcher.Fetch(key)
+		if err == common.ErrNonExistentKey {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Return, data is stale
+		if !entry.Expires.IsZero() && time.Now().After(entry.Expires) {
+			return nil, nil
+		}
+
+		return entry.Data, nil
+	}
+
 	if c.engine.Exists(key) {
 		data, err = c.engine.Get(key)
 
@@ -48,7 +71,12 @@ func (c cacher) get(key string) (data []byte, err error) {
 	return
 }
 
-func (c cacher) put(key string, expires time.Time, data []byte) (err error) {
+func (c cacher) put(key string, expires time.Time, data []byte, tags []string) (err error) {
+	tagger, ok := c.engine.(common.Tagger)
+	if len(tags) > 0 && !ok {
+		return common.ErrNotSupported
+	}
+
 	// Return, as data is being regenerated by another process
 	if c.engine.IsLocked(key) {
 		return common.ErrEngineLocked
@@ -60,14 +88,18 @@ func (c cacher) put(key string, expires time.Time, data []byte) (err error) {
 		return err
 	}
 
-	err = c.engine.Put(key, data, expires)
-	if err != nil {
-		return err
-	}
+	defer func() {
+		unlockErr := c.engine.Unlock(key)
+		if err == nil {
+			err = unlockErr
+		}
+	}()
 
-	err = c.engine.Unlock(key)
+	if len(tags) == 0 {
+		return c.engine.Put(key, data, expires)
+	}
 
-	return
+	return tagger.PutTagged(key, data, expires, tags)
 }
 
 func (c cacher) Get(key string) ([]byte, error) {
@@ -76,10 +108,49 @@ func (c cacher) Get(key string) ([]byte, error) {
 
 // Put a key into the cache
 func (c cacher) Put(key string, expires time.Time, data []byte) error {
-	return c.put(key, expires, data)
+	return c.put(key, expires, data, nil)
+}
+
+// PutTagged puts a key into the cache, associating it with the given tags
+func (c cacher) PutTagged(key string, expires time.Time, data []byte, tags []string) error {
+	return c.put(key, expires, data, tags)
 }
 
 // Expire the given key within the cache engine
 func (c cacher) Expire(key string) error {
 	return c.engine.Expire(key)
 }
+
+// ExpireTag expires every key carrying the given tag within the cache engine
+func (c cacher) ExpireTag(tag string) error {
+	tagger, ok := c.engine.(common.Tagger)
+	if !ok {
+		return common.ErrNotSupported
+	}
+
+	return tagger.ExpireTag(tag)
+}
+
+// ExpirePrefix expires every key starting with the prefix within the cache
+// engine. As this may take a while on large keyspaces, progress (if not nil)
+// is called with the running total of expired keys.
+func (c cacher) ExpirePrefix(prefix string, progress func(int)) (int, error) {
+	deleter, ok := c.engine.(common.PrefixDeleter)
+	if !ok {
+		return 0, common.ErrNotSupported
+	}
+
+	return deleter.DeletePrefix(prefix, progress)
+}
+
+// Close stops the regeneration workers once the queued jobs are done, and
+// closes the cache engine if it can be closed
+func (c cacher) Close() error {
+	c.jobQueue.Close()
+
+	if closer, ok := c.engine.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
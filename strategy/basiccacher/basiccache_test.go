@@ -130,6 +130,26 @@ func TestPut(t *testing.T) {
 		}
 	})
 
+	t.Run("tags not supported", func(*testing.T) {
+		locked := false
+		engine := &common.EngineMock{
+			IsLockedFunc: func(in1 string) bool { return false },
+			LockFunc: func(in1 string) error {
+				locked = true
+				return nil
+			},
+		}
+
+		err := NewCacher(engine, 5, 5).PutTagged("anything else", expires, data, []string{"tag"})
+		if err != common.ErrNotSupported {
+			t.Errorf("expected error %s, got %v", common.ErrNotSupported, err)
+		}
+
+		if locked {
+			t.Errorf("the key shouldn't have been locked")
+		}
+	})
+
 	t.Run("put valid", func(*testing.T) {
 		err := cacher.Put("anything else", expires, data)
 		if err != nil {
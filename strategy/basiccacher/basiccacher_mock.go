@@ -9,9 +9,13 @@ import (
 )
 
 var (
-	lockCacherMockExpire sync.RWMutex
-	lockCacherMockGet    sync.RWMutex
-	lockCacherMockPut    sync.RWMutex
+	lockCacherMockClose        sync.RWMutex
+	lockCacherMockExpire       sync.RWMutex
+	lockCacherMockExpirePrefix sync.RWMutex
+	lockCacherMockExpireTag    sync.RWMutex
+	lockCacherMockGet          sync.RWMutex
+	lockCacherMockPut          sync.RWMutex
+	lockCacherMockPutTagged    sync.RWMutex
 )
 
 // CacherMock is a mock implementation of Cacher.
@@ -20,15 +24,27 @@ var (
 //
 //         // make and configure a mocked Cacher
 //         mockedCacher := &CacherMock{
+//             CloseFunc: func() error {
+// 	               panic("TODO: mock out the Close method")
+//             },
 //             ExpireFunc: func(in1 string) error {
 // 	               panic("TODO: mock out the Expire method")
 //             },
+//             ExpirePrefixFunc: func(in1 string, in2 func(int)) (int, error) {
+// 	               panic("TODO: mock out the ExpirePrefix method")
+//             },
+//             ExpireTagFunc: func(in1 string) error {
+// 	               panic("TODO: mock out the ExpireTag method")
+//             },
 //             GetFunc: func(in1 string) ([]byte, error) {
 // 	               panic("TODO: mock out the Get method")
 //             },
 //             PutFunc: func(in1 string, in2 time.Time, in3 []byte) error {
 // 	               panic("TODO: mock out the Put method")
 //             },
+//             PutTaggedFunc: func(in1 string, in2 time.Time, in3 []byte, in4 []string) error {
+// 	               panic("TODO: mock out the PutTagged method")
+//             },
 //         }
 //
 //         // TODO: use mockedCacher in code that requires Cacher
@@ -36,22 +52,49 @@ var (
 //
 //     }
 type CacherMock struct {
+	// CloseFunc mocks the Close method.
+	CloseFunc func() error
+
 	// ExpireFunc mocks the Expire method.
 	ExpireFunc func(in1 string) error
 
+	// ExpirePrefixFunc mocks the ExpirePrefix method.
+	ExpirePrefixFunc func(in1 string, in2 func(int)) (int, error)
+
+	// ExpireTagFunc mocks the ExpireTag method.
+	ExpireTagFunc func(in1 string) error
+
 	// GetFunc mocks the Get method.
 	GetFunc func(in1 string) ([]byte, error)
 
 	// PutFunc mocks the Put method.
 	PutFunc func(in1 string, in2 time.Time, in3 []byte) error
 
+	// PutTaggedFunc mocks the PutTagged method.
+	PutTaggedFunc func(in1 string, in2 time.Time, in3 []byte, in4 []string) error
+
 	// calls tracks calls to the methods.
 	calls struct {
+		// Close holds details about calls to the Close method.
+		Close []struct {
+		}
 		// Expire holds details about calls to the Expire method.
 		Expire []struct {
 			// In1 is the in1 argument value.
 			In1 string
 		}
+		// ExpirePrefix holds details about calls to the ExpirePrefix method.
+		ExpirePrefix []struct {
+			// In1 is the in1 argument value.
+			In1 string
+			// In2 is the in2 argument value.
+			In2 func(int)
+		}
+		// ExpireTag holds details about calls to the ExpireTag method.
+		ExpireTag []struct {
+			// In1 is the in1 argument value.
+			In1 string
+		}
 		// Get holds details about calls to the Get method.
 		Get []struct {
 			// In1 is the in1 argument value.
@@ -66,7 +109,45 @@ type CacherMock struct {
 			// In3 is the in3 argument value.
 			In3 []byte
 		}
+		// PutTagged holds details about calls to the PutTagged method.
+		PutTagged []struct {
+			// In1 is the in1 argument value.
+			In1 string
+			// In2 is the in2 argument value.
+			In2 time.Time
+			// In3 is the in3 argument value.
+			In3 []byte
+			// In4 is the in4 argument value.
+			In4 []string
+		}
+	}
+}
+
+// Close calls CloseFunc.
+func (mock *CacherMock) Close() error {
+	if mock.CloseFunc == nil {
+		panic("moq: CacherMock.CloseFunc is nil but Cacher.Close was just called")
+	}
+	callInfo := struct {
+	}{
+	}
+	lockCacherMockClose.Lock()
+	mock.calls.Close = append(mock.calls.Close, callInfo)
+	lockCacherMockClose.Unlock()
+	return mock.CloseFunc()
+}
+
+// CloseCalls gets all the calls that were made to Close.
+// Check the length with:
+//     len(mockedCacher.CloseCalls())
+func (mock *CacherMock) CloseCalls() []struct {
+} {
+	var calls []struct {
 	}
+	lockCacherMockClose.RLock()
+	calls = mock.calls.Close
+	lockCacherMockClose.RUnlock()
+	return calls
 }
 
 // Expire calls ExpireFunc.
@@ -100,6 +181,72 @@ func (mock *CacherMock) ExpireCalls() []struct {
 	return calls
 }
 
+// ExpirePrefix calls ExpirePrefixFunc.
+func (mock *CacherMock) ExpirePrefix(in1 string, in2 func(int)) (int, error) {
+	if mock.ExpirePrefixFunc == nil {
+		panic("moq: CacherMock.ExpirePrefixFunc is nil but Cacher.ExpirePrefix was just called")
+	}
+	callInfo := struct {
+		In1 string
+		In2 func(int)
+	}{
+		In1: in1,
+		In2: in2,
+	}
+	lockCacherMockExpirePrefix.Lock()
+	mock.calls.ExpirePrefix = append(mock.calls.ExpirePrefix, callInfo)
+	lockCacherMockExpirePrefix.Unlock()
+	return mock.ExpirePrefixFunc(in1, in2)
+}
+
+// ExpirePrefixCalls gets all the calls that were made to ExpirePrefix.
+// Check the length with:
+//     len(mockedCacher.ExpirePrefixCalls())
+func (mock *CacherMock) ExpirePrefixCalls() []struct {
+	In1 string
+	In2 func(int)
+} {
+	var calls []struct {
+		In1 string
+		In2 func(int)
+	}
+	lockCacherMockExpirePrefix.RLock()
+	calls = mock.calls.ExpirePrefix
+	lockCacherMockExpirePrefix.RUnlock()
+	return calls
+}
+
+// ExpireTag calls ExpireTagFunc.
+func (mock *CacherMock) ExpireTag(in1 string) error {
+	if mock.ExpireTagFunc == nil {
+		panic("moq: CacherMock.ExpireTagFunc is nil but Cacher.ExpireTag was just called")
+	}
+	callInfo := struct {
+		In1 string
+	}{
+		In1: in1,
+	}
+	lockCacherMockExpireTag.Lock()
+	mock.calls.ExpireTag = append(mock.calls.ExpireTag, callInfo)
+	lockCacherMockExpireTag.Unlock()
+	return mock.ExpireTagFunc(in1)
+}
+
+// ExpireTagCalls gets all the calls that were made to ExpireTag.
+// Check the length with:
+//     len(mockedCacher.ExpireTagCalls())
+func (mock *CacherMock) ExpireTagCalls() []struct {
+	In1 string
+} {
+	var calls []struct {
+		In1 string
+	}
+	lockCacherMockExpireTag.RLock()
+	calls = mock.calls.ExpireTag
+	lockCacherMockExpireTag.RUnlock()
+	return calls
+}
+
 // Get calls GetFunc.
 func (mock *CacherMock) Get(in1 string) ([]byte, error) {
 	if mock.GetFunc == nil {
@@ -169,3 +316,46 @@ func (mock *CacherMock) PutCalls() []struct {
 	lockCacherMockPut.RUnlock()
 	return calls
 }
+
+// PutTagged calls PutTaggedFunc.
+func (mock *CacherMock) PutTagged(in1 string, in2 time.Time, in3 []byte, in4 []string) error {
+	if mock.PutTaggedFunc == nil {
+		panic("moq: CacherMock.PutTaggedFunc is nil but Cacher.PutTagged was just called")
+	}
+	callInfo := struct {
+		In1 string
+		In2 time.Time
+		In3 []byte
+		In4 []string
+	}{
+		In1: in1,
+		In2: in2,
+		In3: in3,
+		In4: in4,
+	}
+	lockCacherMockPutTagged.Lock()
+	mock.calls.PutTagged = append(mock.calls.PutTagged, callInfo)
+	lockCacherMockPutTagged.Unlock()
+	return mock.PutTaggedFunc(in1, in2, in3, in4)
+}
+
+// PutTaggedCalls gets all the calls that were made to PutTagged.
+// Check the length with:
+//     len(mockedCacher.PutTaggedCalls())
+func (mock *CacherMock) PutTaggedCalls() []struct {
+	In1 string
+	In2 time.Time
+	In3 []byte
+	In4 []string
+} {
+	var calls []struct {
+		In1 string
+		In2 time.Time
+		In3 []byte
+		In4 []string
+	}
+	lockCacherMockPutTagged.RLock()
+	calls = mock.calls.PutTagged
+	lockCacherMockPutTagged.RUnlock()
+	return calls
+}
@@ -14,7 +14,7 @@ import (
 
 func TestCacherGet(t *testing.T) {
 	var (
-		e       = engine.NewMemoryStore(time.Second * 60)
+		e       = engine.NewMemoryStore(time.Second*60, time.Hour)
 		cache   = NewCacher(e, 5, 5)
 		content = []byte("hello")
 